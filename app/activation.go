@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+)
+
+/*
+   Socket activation (systemd, sd_listen_fds(3)):
+
+     systemd binds :4221 itself, then starts us with the socket already open:
+
+       fd 0-2   stdin/stdout/stderr
+       fd 3     the listening socket        ← first inherited fd
+       LISTEN_FDS=1                         ← number of inherited sockets
+       LISTEN_PID=<our pid>                 ← they are meant for this process
+
+   The server can be restarted without ever refusing a connection: the
+   socket stays open in systemd while we are down, clients just queue.
+*/
+
+// listenFdsStart is the first inherited descriptor, SD_LISTEN_FDS_START
+const listenFdsStart = 3
+
+// inheritedListener returns the socket passed in by the service manager,
+// or nil if the process was not socket-activated.
+func inheritedListener() (net.Listener, error) {
+	// LISTEN_PID guards against the variables leaking into child processes
+	if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	fds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || fds < 1 {
+		return nil, nil
+	}
+
+	file := os.NewFile(listenFdsStart, "listen")
+	defer file.Close() // FileListener dups the descriptor
+	l, err := net.FileListener(file)
+	if err != nil {
+		return nil, fmt.Errorf("inherited fd %d: %w", listenFdsStart, err)
+	}
+	return l, nil
+}
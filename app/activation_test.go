@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// TestSocketActivationChild is the activated process TestSocketActivation
+// starts, it does nothing in a normal test run
+func TestSocketActivationChild(t *testing.T) {
+	if os.Getenv("SOCKET_ACTIVATION_CHILD") != "1" {
+		t.Skip("only run by TestSocketActivation")
+	}
+	// The service manager sets it between fork and exec, exec.Cmd can't
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+
+	config := testConfig()
+	config.SocketActivation = true
+	config.LogLevel = LevelWarn
+	config.Protocol, config.Host, config.Port = "tcp", "127.0.0.1", "bogus" // listening itself would fail
+	s, err := NewServer(config, log.New(os.Stderr, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Start(context.Background()) // until the parent kills us
+}
+
+func TestSocketActivation(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := l.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestSocketActivationChild$")
+	cmd.Env = append(os.Environ(), "SOCKET_ACTIVATION_CHILD=1", "LISTEN_FDS=1")
+	cmd.ExtraFiles = []*os.File{file} // the first extra file is fd 3
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+	// The child holds the socket now, connections queue until it accepts
+	file.Close()
+	addr := l.Addr().String()
+	l.Close()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(conn, "GET /echo/activated HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("no response through the inherited socket: %v", err)
+	}
+	defer resp.Body.Close()
+	if body, _ := io.ReadAll(resp.Body); resp.StatusCode != http.StatusOK || string(body) != "activated" {
+		t.Errorf("got %d %q", resp.StatusCode, body)
+	}
+}
+
+func TestSocketActivationFallback(t *testing.T) {
+	config := testConfig()
+	config.SocketActivation = true
+	config.Protocol, config.Host, config.Port = "tcp", "127.0.0.1", "0"
+
+	for _, pid := range []string{"", strconv.Itoa(os.Getppid())} { // not activated, meant for another process
+		t.Setenv("LISTEN_PID", pid)
+		t.Setenv("LISTEN_FDS", "1")
+		s, err := NewServer(config, log.New(io.Discard, "", 0))
+		if err != nil {
+			t.Fatalf("LISTEN_PID=%q: %v", pid, err)
+		}
+		if addr, ok := s.Addr().(*net.TCPAddr); !ok || addr.Port == 0 {
+			t.Errorf("LISTEN_PID=%q: Addr %v, want a fresh listener on 127.0.0.1", pid, s.Addr())
+		}
+		s.Shutdown()
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httputil"
+)
+
+/*
+   Request bodies are read through a bodyReader, whether parseRequest reads
+   them up front into Request.Body or a WithLazyBody handler streams them
+   from Request.BodyReader:
+
+     Content-Length: 13         → exactly 13 bytes, then io.EOF
+     Transfer-Encoding: chunked → chunks decoded until the 0-sized one
+
+   Either way it stops at the end of this body, never reading into the next
+   pipelined request on the same connection.
+*/
+
+// bodyReader reads one request body off the connection
+type bodyReader struct {
+	conn   *bufio.Reader
+	r      io.Reader // the framing: limited to Content-Length, or chunked
+	length int64     // declared Content-Length, -1 if chunked
+	read   int64
+
+	// continueWriter is where "100 Continue" goes on the first read,
+	// nil if the client didn't ask for it or it has been sent
+	continueWriter *bufio.Writer
+
+	done bool  // the whole body has been read, the connection is at the next request
+	err  error // sticky, a broken body can't be resumed
+}
+
+func newBodyReader(reader *bufio.Reader, writer *bufio.Writer, length int64, expectContinue bool) *bodyReader {
+	b := &bodyReader{conn: reader, length: length, done: length == 0}
+	if length < 0 {
+		b.r = httputil.NewChunkedReader(reader)
+	} else {
+		b.r = io.LimitReader(reader, length)
+	}
+	if expectContinue && !b.done {
+		b.continueWriter = writer
+	}
+	return b
+}
+
+func (b *bodyReader) Read(p []byte) (int, error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+	if b.done {
+		return 0, io.EOF
+	}
+	if b.continueWriter != nil {
+		w := b.continueWriter
+		b.continueWriter = nil
+		if _, err := w.WriteString("HTTP/1.1 100 Continue\r\n\r\n"); err != nil {
+			b.err = err
+			return 0, err
+		}
+		if err := w.Flush(); err != nil {
+			b.err = err
+			return 0, err
+		}
+	}
+
+	n, err := b.r.Read(p)
+	b.read += int64(n)
+	switch {
+	case err == nil:
+		// io.ReadFull stops at exactly Content-Length, it never sees the io.EOF after it
+		b.done = b.length >= 0 && b.read == b.length
+	case errors.Is(err, io.EOF) && b.length >= 0 && b.read < b.length,
+		errors.Is(err, io.ErrUnexpectedEOF):
+		// Content-Length promised more than the client sent before hanging
+		// up; it may only have closed its write side and still be listening
+		truncated := fmt.Errorf("chunked body truncated after %d bytes: %w", b.read, io.ErrUnexpectedEOF)
+		if b.length >= 0 {
+			truncated = fmt.Errorf("body truncated after %d of %d bytes: %w", b.read, b.length, io.ErrUnexpectedEOF)
+		}
+		b.err = &requestError{StatusCode: http.StatusBadRequest, Err: truncated}
+		return n, b.err
+	case errors.Is(err, io.EOF):
+		if b.length < 0 {
+			// The chunked reader stops after "0\r\n", the trailer section is still ahead
+			if terr := b.skipTrailers(); terr != nil {
+				b.err = terr
+				return n, terr
+			}
+		}
+		b.done = true
+	default:
+		if b.length < 0 {
+			// Malformed chunk framing, the client sent something that isn't HTTP
+			err = newRequestError(http.StatusBadRequest, "malformed chunked body: %w", err)
+		}
+		b.err = err
+	}
+	return n, err
+}
+
+// maxDrainBytes is how much of an unread body is skipped to keep the
+// connection alive; bigger leftovers are cheaper to drop with the connection
+const maxDrainBytes = 256 << 10 // 256 KB
+
+// drain skips whatever the handler left of the body, so the connection is at
+// the next request again. It reports false if the connection can't be reused:
+// the rest is over maxDrainBytes, the body is broken, or the client is still
+// waiting for a "100 Continue" it will now never get.
+func (b *bodyReader) drain() bool {
+	if b.done {
+		return true
+	}
+	if b.err != nil || b.continueWriter != nil {
+		return false
+	}
+	if b.length >= 0 && b.length-b.read > maxDrainBytes {
+		return false
+	}
+	io.CopyN(io.Discard, b, maxDrainBytes+1)
+	return b.done
+}
+
+// skipTrailers reads past the trailer fields after the last chunk, up to the
+// empty line ending the message. Handlers don't get to see request trailers.
+func (b *bodyReader) skipTrailers() error {
+	for {
+		line, err := b.conn.ReadString('\n')
+		if err != nil {
+			return newRequestError(http.StatusBadRequest, "chunked body truncated in trailers: %w", io.ErrUnexpectedEOF)
+		}
+		if line == "\r\n" || line == "\n" {
+			return nil
+		}
+	}
+}
+
+// Close is a no-op: the connection belongs to the server, which drains or
+// closes it once the handler is done.
+func (b *bodyReader) Close() error {
+	return nil
+}
+
+// ReadAllBody returns the whole request body. On a WithLazyBody route it
+// reads BodyReader to the end (at most 10 MB) and keeps the result in Body,
+// so it can be called more than once; on other routes it simply returns Body.
+// Truncated or malformed bodies fail with a 400, oversized ones with a 413,
+// see BodyErrorResponse.
+func (r *Request) ReadAllBody() ([]byte, error) {
+	if r.BodyReader == nil {
+		return r.Body, nil
+	}
+	body, err := io.ReadAll(io.LimitReader(r.BodyReader, maxBodyBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > maxBodyBytes {
+		return nil, newRequestError(http.StatusRequestEntityTooLarge, "body too large")
+	}
+	r.Body, r.BodyReader = body, nil
+	return body, nil
+}
+
+// BodyErrorResponse answers a failed read of the request body with the
+// status it calls for, 400 unless the error says otherwise.
+func BodyErrorResponse(err error) *Response {
+	status := http.StatusBadRequest
+	var reqErr *requestError
+	if errors.As(err, &reqErr) {
+		status = reqErr.StatusCode
+	}
+	return NewResponse(status, http.StatusText(status), []byte(err.Error()))
+}
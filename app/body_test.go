@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// lazyServer serves /ignore, which never looks at the body, and /stream,
+// which hashes it as it arrives. Both are WithLazyBody routes.
+func lazyServer(t *testing.T) (*Server, *bool) {
+	t.Helper()
+	s, _ := newTestServer(t, testConfig())
+	var unread bool
+	s.router.RegisterExactRoute("/ignore", func(r *Request) *Response {
+		unread = r.Body == nil && r.BodyReader != nil
+		return NewResponse(http.StatusOK, "OK", []byte("ignored"))
+	}, WithLazyBody())
+	s.router.RegisterExactRoute("/stream", func(r *Request) *Response {
+		sum := sha256.New()
+		n, err := io.Copy(sum, r.BodyReader)
+		if err != nil {
+			return BodyErrorResponse(err)
+		}
+		return NewResponse(http.StatusOK, "OK", fmt.Appendf(nil, "%d %x", n, sum.Sum(nil)))
+	}, WithLazyBody())
+	start(t, s)
+	return s, &unread
+}
+
+func TestLazyBodyIgnored(t *testing.T) {
+	s, unread := lazyServer(t)
+	resp, body := sendBody(t, s, http.MethodPost, "/ignore", []byte("nobody reads this"))
+	if resp.StatusCode != http.StatusOK || body != "ignored" {
+		t.Errorf("got %d %q", resp.StatusCode, body)
+	}
+	if !*unread {
+		t.Error("the body was read before the handler ran")
+	}
+}
+
+func TestLazyBodyStreamed(t *testing.T) {
+	s, _ := lazyServer(t)
+
+	// Past the 10 MB Request.Body limit, a streaming handler never holds it all
+	big := bytes.Repeat([]byte("0123456789abcdef"), 12<<20/16)
+	resp, body := sendBody(t, s, http.MethodPost, "/stream", big)
+	if want := fmt.Sprintf("%d %x", len(big), sha256.Sum256(big)); resp.StatusCode != http.StatusOK || body != want {
+		t.Errorf("12 MB body: got %d %q, want %q", resp.StatusCode, body, want)
+	}
+
+	// Chunked bodies are decoded on the way
+	resp, body = roundTrip(t, s, "POST /stream HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n6\r\n world\r\n0\r\n\r\n")
+	if want := fmt.Sprintf("11 %x", sha256.Sum256([]byte("hello world"))); resp.StatusCode != http.StatusOK || body != want {
+		t.Errorf("chunked body: got %d %q, want %q", resp.StatusCode, body, want)
+	}
+
+	// A body cut short surfaces as a read error the handler can answer
+	resp, _ = roundTrip(t, s, "POST /stream HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: chunked\r\n\r\nzz\r\n")
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("malformed chunk: got %d, want 400", resp.StatusCode)
+	}
+}
+
+func TestReadAllBody(t *testing.T) {
+	s, _ := newTestServer(t, testConfig())
+	readTwice := func(r *Request) *Response {
+		first, err := r.ReadAllBody()
+		if err != nil {
+			return BodyErrorResponse(err)
+		}
+		second, _ := r.ReadAllBody()
+		return NewResponse(http.StatusOK, "OK", []byte(string(first)+"|"+string(second)))
+	}
+	s.router.RegisterExactRoute("/lazy", readTwice, WithLazyBody())
+	s.router.RegisterExactRoute("/eager", readTwice)
+	start(t, s)
+
+	for _, target := range []string{"/lazy", "/eager"} {
+		if resp, body := sendBody(t, s, http.MethodPost, target, []byte("data")); resp.StatusCode != http.StatusOK || body != "data|data" {
+			t.Errorf("%s: got %d %q", target, resp.StatusCode, body)
+		}
+	}
+	big := strings.Repeat("x", maxBodyBytes+1)
+	if resp, _ := sendBody(t, s, http.MethodPost, "/lazy", []byte(big)); resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("over 10 MB: got %d, want 413", resp.StatusCode)
+	}
+}
+
+func TestUnreadBodyDrained(t *testing.T) {
+	s, _ := lazyServer(t)
+
+	// The ignored body and the next request arrive together, the body must not be parsed as a request
+	unread := "GET /echo/smuggled HTTP/1.1\r\n\r\n"
+	out := rawResponse(t, s, "POST /ignore HTTP/1.1\r\nHost: localhost\r\nContent-Length: "+strconv.Itoa(len(unread))+"\r\n\r\n"+unread+
+		"GET /echo/next HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+	if strings.Count(out, "HTTP/1.1 200 OK") != 2 || !strings.HasSuffix(out, "\r\n\r\nnext") || strings.Contains(out, "smuggled") {
+		t.Errorf("pipelined after an unread body:\n%s", out)
+	}
+
+	// Same for a chunked body
+	out = rawResponse(t, s, "POST /ignore HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: chunked\r\n\r\n4\r\nskip\r\n0\r\n\r\n"+
+		"GET /echo/next HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+	if strings.Count(out, "HTTP/1.1 200 OK") != 2 || !strings.HasSuffix(out, "\r\n\r\nnext") {
+		t.Errorf("pipelined after an unread chunked body:\n%s", out)
+	}
+}
+
+func TestUnreadBodyTooLargeToDrain(t *testing.T) {
+	s, _ := lazyServer(t)
+
+	conn, r := dial(t, s)
+	// Only the headers: skipping 1 MB that may never come isn't worth the connection
+	fmt.Fprintf(conn, "POST /ignore HTTP/1.1\r\nHost: localhost\r\nContent-Length: %d\r\n\r\n", maxDrainBytes*4)
+	resp, body := readResponse(t, r, http.MethodPost)
+	if body != "ignored" || !resp.Close {
+		t.Errorf("got %q, want the response with Connection: close", body)
+	}
+	if _, err := r.ReadByte(); err != io.EOF {
+		t.Errorf("after the response: got %v, want the connection closed", err)
+	}
+}
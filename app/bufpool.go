@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"sync"
+)
+
+/*
+   Every connection needs a bufio.Reader and a bufio.Writer (4 KB each,
+   the writer's size is Config.WriteBufferSize).
+   On a busy server connections come and go constantly, so instead of
+   allocating fresh buffers per connection they are recycled:
+
+     accept → get reader/writer from pool, Reset onto the new conn
+     close  → Reset(nil) (drop the conn reference) and put them back
+
+   The reader lives as long as the connection, never just one request:
+   it may already hold bytes of the *next* request (see handleConnection).
+*/
+
+var bufioReaderPool = sync.Pool{
+	New: func() any { return bufio.NewReader(nil) },
+}
+
+// defaultWriteBufferSize is bufio's own default, used when Config.WriteBufferSize is 0
+const defaultWriteBufferSize = 4096
+
+// bufioWriterPools holds one *sync.Pool per buffer size: a Reset never
+// resizes a bufio.Writer, so writers of different sizes must not mix.
+var bufioWriterPools sync.Map // int → *sync.Pool
+
+func getBufioReader(r io.Reader) *bufio.Reader {
+	br := bufioReaderPool.Get().(*bufio.Reader)
+	br.Reset(r)
+	return br
+}
+
+func putBufioReader(br *bufio.Reader) {
+	br.Reset(nil)
+	bufioReaderPool.Put(br)
+}
+
+func bufioWriterPool(size int) *sync.Pool {
+	if pool, ok := bufioWriterPools.Load(size); ok {
+		return pool.(*sync.Pool)
+	}
+	pool, _ := bufioWriterPools.LoadOrStore(size, &sync.Pool{
+		New: func() any { return bufio.NewWriterSize(nil, size) },
+	})
+	return pool.(*sync.Pool)
+}
+
+func getBufioWriter(w io.Writer, size int) *bufio.Writer {
+	bw := bufioWriterPool(size).Get().(*bufio.Writer)
+	bw.Reset(w)
+	return bw
+}
+
+func putBufioWriter(bw *bufio.Writer) {
+	bw.Reset(nil)
+	bufioWriterPool(bw.Size()).Put(bw)
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBufioPools(t *testing.T) {
+	br := getBufioReader(strings.NewReader("left over"))
+	br.ReadByte()
+	putBufioReader(br)
+	// Whatever a recycled reader gets, it never hands out the old connection's bytes
+	br = getBufioReader(strings.NewReader("fresh"))
+	if got, _ := io.ReadAll(br); string(got) != "fresh" {
+		t.Errorf("recycled reader: got %q", got)
+	}
+	putBufioReader(br)
+
+	// Writers only come back at the size they were asked for
+	putBufioWriter(getBufioWriter(io.Discard, 4096))
+	for _, size := range []int{8192, 4096, 65536} {
+		bw := getBufioWriter(io.Discard, size)
+		if bw.Size() != size {
+			t.Errorf("getBufioWriter(%d): got a %d byte writer", size, bw.Size())
+		}
+		putBufioWriter(bw)
+	}
+}
+
+// The buffers a connection needs, pooled and freshly allocated
+
+func BenchmarkConnBuffersPooled(b *testing.B) {
+	b.ReportAllocs()
+	for b.Loop() {
+		br := getBufioReader(strings.NewReader(""))
+		bw := getBufioWriter(io.Discard, defaultWriteBufferSize)
+		putBufioWriter(bw)
+		putBufioReader(br)
+	}
+}
+
+func BenchmarkConnBuffersUnpooled(b *testing.B) {
+	b.ReportAllocs()
+	for b.Loop() {
+		bufio.NewReader(strings.NewReader(""))
+		bufio.NewWriterSize(io.Discard, defaultWriteBufferSize)
+	}
+}
+
+// BenchmarkServerNewConnections measures requests per second when every
+// request comes on its own connection, where the pools are used the most
+func BenchmarkServerNewConnections(b *testing.B) {
+	config := testConfig()
+	config.LogLevel = LevelWarn // no access log
+	s, _ := startTestServer(b, config)
+	b.ReportAllocs()
+	start := time.Now()
+	for b.Loop() {
+		// Not dial, its connections stay open until the benchmark ends
+		conn, err := net.Dial("tcp", s.Addr().String())
+		if err != nil {
+			b.Fatal(err)
+		}
+		io.WriteString(conn, "GET /echo/hi HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil || resp.StatusCode != http.StatusOK {
+			b.Fatalf("got %v %v", resp, err)
+		}
+		conn.Close()
+	}
+	b.ReportMetric(float64(b.N)/time.Since(start).Seconds(), "req/s")
+}
+
+func TestWriteBufferSizeValidation(t *testing.T) {
+	for size, ok := range map[int]bool{0: true, minWriteBufferSize: true, 65536: true, minWriteBufferSize - 1: false, -1: false} {
+		if err := (Config{WriteBufferSize: size}).validate(); (err == nil) != ok {
+			t.Errorf("WriteBufferSize %d: got %v", size, err)
+		}
+	}
+}
+
+func TestWriteBufferSizeLargeBody(t *testing.T) {
+	config := testConfig()
+	config.WriteBufferSize = 65536
+	s, _ := newTestServer(t, config)
+	body := strings.Repeat("0123456789abcdef", 64*1024) // 1 MB, many buffers' worth
+	s.router.RegisterExactRoute("/big", func(r *Request) *Response {
+		return NewResponse(http.StatusOK, "OK", []byte(body))
+	})
+	start(t, s)
+
+	if resp, got := get(t, s, http.MethodGet, "/big"); resp.StatusCode != http.StatusOK || got != body {
+		t.Errorf("got %d with %d of %d bytes", resp.StatusCode, len(got), len(body))
+	}
+}
+
+// writeCounter counts the writes, each of which would be a syscall on a socket
+type writeCounter struct{ writes int }
+
+func (w *writeCounter) Write(p []byte) (int, error) {
+	w.writes++
+	return len(p), nil
+}
+
+// benchmarkWriteBufferSize sends a 4 MB stream written in 1 KB pieces, the
+// way a handler copying from a file or a pipe would
+func benchmarkWriteBufferSize(b *testing.B, size int) {
+	const bodySize, piece = 4 << 20, 1024
+	chunk := []byte(strings.Repeat("x", piece))
+	resp := NewStreamResponse(http.StatusOK, "OK", func(w io.Writer) error {
+		for range bodySize / piece {
+			if _, err := w.Write(chunk); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	var counter writeCounter
+	w := bufio.NewWriterSize(&counter, size)
+	b.SetBytes(bodySize)
+	for b.Loop() {
+		if err := writeResponse(w, resp); err != nil {
+			b.Fatal(err)
+		}
+		w.Flush()
+	}
+	b.ReportMetric(float64(counter.writes)/float64(b.N), "writes/op")
+}
+
+func BenchmarkWriteBuffer4K(b *testing.B)  { benchmarkWriteBufferSize(b, 4096) }
+func BenchmarkWriteBuffer64K(b *testing.B) { benchmarkWriteBufferSize(b, 65536) }
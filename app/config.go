@@ -0,0 +1,285 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"os"
+	"time"
+)
+
+// minWriteBufferSize keeps a response's status line and headers in one write
+const minWriteBufferSize = 1024
+
+// defaultMaxHeaderCount is MaxHeaderCount's zero value, generous for any real client
+const defaultMaxHeaderCount = 100
+
+// defaultMaxPathSegments is MaxPathSegments' zero value
+const defaultMaxPathSegments = 64
+
+type Config struct {
+	Port         string
+	Host         string
+	Protocol     string
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+
+	// Directory is served under /files/ (--directory). Empty serves the
+	// working directory.
+	Directory string
+
+	// LogLevel drops log lines below it. The default, LevelInfo, leaves out
+	// the per-request dumps of LevelDebug.
+	LogLevel LogLevel
+
+	// LogFormat is LogFormatText (the default when empty) or LogFormatJSON,
+	// one JSON object per line for log pipelines.
+	LogFormat string
+
+	// RedactHeaders are the header names, in any casing, whose values are
+	// logged as "***" in request and response dumps. nil uses Authorization,
+	// Proxy-Authorization, Cookie and Set-Cookie; an empty, non-nil list
+	// logs every header as it is.
+	RedactHeaders []string
+
+	// AccessLogSampleRate is the fraction of requests access-logged, from 0
+	// to 1, for traffic where a line per request costs too much. 5xx
+	// responses are always logged, so 0 logs nothing else. nil logs every
+	// request.
+	AccessLogSampleRate *float64
+
+	// RedirectTrailingSlash redirects "/a/" to "/a" (or the reverse) with a 308
+	// when only the other form has a route. Disabled by default.
+	RedirectTrailingSlash bool
+
+	// CaseInsensitivePaths routes "/ECHO/Hi" like "/echo/Hi" while handlers
+	// still see the path exactly as the client sent it.
+	CaseInsensitivePaths bool
+
+	// EnableDirListing answers GET /files/ (and /files/<dir>/) with an HTML
+	// listing of the directory instead of 400 Bad Request.
+	EnableDirListing bool
+
+	// DirectoryIndex is the file served for GET requests on a directory.
+	// nil uses index.html; an empty name disables index files.
+	DirectoryIndex *string
+
+	// DefaultFileContentType is the Content-Type of served files whose
+	// extension has no known MIME type, or that have none. Empty uses
+	// application/octet-stream, which browsers download instead of showing.
+	DefaultFileContentType string
+
+	// SniffContentType guesses the Content-Type of files without a known
+	// extension from their first 512 bytes, before DefaultFileContentType.
+	SniffContentType bool
+
+	// FileMode and DirMode are the permissions of files and directories
+	// created by uploads, before the process umask. 0 uses 0644 and 0755.
+	FileMode os.FileMode
+	DirMode  os.FileMode
+
+	// FileCacheBytes is the memory budget of the in-memory cache for small
+	// served files. 0 disables the cache.
+	FileCacheBytes int64
+
+	// StaticMaxAge lets browsers cache served files for this long
+	// (Cache-Control: max-age and Expires). 0 sends no caching headers.
+	StaticMaxAge time.Duration
+
+	// TrustProxy takes the client address from X-Forwarded-For.
+	// Only enable it behind a proxy that sets the header, clients can forge it otherwise.
+	TrustProxy bool
+
+	// ProxyProtocol expects every connection to start with a PROXY protocol v1
+	// line (HAProxy, AWS NLB...) and uses the client address it carries.
+	ProxyProtocol bool
+
+	// SocketActivation serves on the socket inherited from systemd (fd 3,
+	// LISTEN_FDS) when there is one, and listens on Host:Port otherwise.
+	SocketActivation bool
+
+	// DisableTCPNoDelay turns Nagle's algorithm back on for accepted
+	// connections. By default TCP_NODELAY is set: responses are written
+	// whole, holding back their last segment only adds latency. Only worth
+	// it for handlers that stream many tiny writes.
+	DisableTCPNoDelay bool
+
+	// TCPKeepAlive is the idle time before TCP keep-alive probes are sent on
+	// accepted connections, so dead peers are noticed even between requests.
+	// 0 keeps Go's default of 15s, negative disables keep-alive probes.
+	TCPKeepAlive time.Duration
+
+	// LoadShedFunc, when set, is asked on every accepted connection whether
+	// the server is overloaded, by whatever metric the operator picks (CPU,
+	// memory, queue depth). While it returns true, new connections get an
+	// immediate 503 with Retry-After and are closed. It runs in the accept
+	// loop, so it must be cheap.
+	LoadShedFunc func() bool
+
+	// CompressionLevel is the gzip level for compressed responses, from
+	// gzip.BestSpeed (1) to gzip.BestCompression (9). 0 uses gzip.DefaultCompression.
+	CompressionLevel int
+
+	// CompressionPreference lists the content codings responses may be
+	// compressed with, most preferred first; it breaks ties between codings
+	// the client weights equally. nil uses gzip, then deflate. An empty,
+	// non-nil list disables compression, .gz sidecars included.
+	CompressionPreference []string
+
+	// WriteBufferSize is the per-connection response buffer, at least
+	// minWriteBufferSize. Larger buffers mean fewer write syscalls for big
+	// bodies at the cost of memory per connection. 0 uses 4 KB.
+	WriteBufferSize int
+
+	// MaxHeaderCount caps the header lines of a request, more are answered
+	// with 431 Request Header Fields Too Large. 0 uses 100.
+	MaxHeaderCount int
+
+	// MaxPathSegments caps the "/"-separated segments of a request path,
+	// deeper paths are answered with 400 before routing. 0 uses 64.
+	MaxPathSegments int
+
+	// EnableTrace answers TRACE requests by echoing the request back.
+	// Off by default (405): a reflected request can leak headers to scripts.
+	EnableTrace bool
+
+	// EnableH2C serves HTTP/2 cleartext to clients that open the connection
+	// with the HTTP/2 preface (prior knowledge, e.g. curl --http2-prior-knowledge).
+	EnableH2C bool
+
+	// NoSniff sends X-Content-Type-Options: nosniff on every response, so
+	// browsers trust Content-Type instead of guessing from the body.
+	NoSniff bool
+
+	// EnablePprof serves the net/http/pprof profiles under /debug/pprof/.
+	EnablePprof bool
+
+	// EnableStats serves the connection and request counters as JSON at /stats.
+	EnableStats bool
+}
+
+// validate rejects settings that would only fail later, per request
+func (c Config) validate() error {
+	if c.CompressionLevel != 0 && (c.CompressionLevel < gzip.BestSpeed || c.CompressionLevel > gzip.BestCompression) {
+		return fmt.Errorf("invalid CompressionLevel %d: must be between %d and %d",
+			c.CompressionLevel, gzip.BestSpeed, gzip.BestCompression)
+	}
+	if rate := c.accessLogSampleRate(); !(rate >= 0 && rate <= 1) {
+		return fmt.Errorf("invalid AccessLogSampleRate %v: must be between 0 and 1", rate)
+	}
+	for _, coding := range c.CompressionPreference {
+		if !supportedCompression[coding] {
+			return fmt.Errorf("invalid CompressionPreference %q: unsupported coding", coding)
+		}
+	}
+	if c.WriteBufferSize != 0 && c.WriteBufferSize < minWriteBufferSize {
+		return fmt.Errorf("invalid WriteBufferSize %d: must be at least %d", c.WriteBufferSize, minWriteBufferSize)
+	}
+	if c.FileMode&^os.ModePerm != 0 {
+		return fmt.Errorf("invalid FileMode %v: only permission bits are allowed", c.FileMode)
+	}
+	// Without owner rwx the server couldn't create anything inside its own directories
+	if c.DirMode&^os.ModePerm != 0 || (c.DirMode != 0 && c.DirMode&0700 != 0700) {
+		return fmt.Errorf("invalid DirMode %v: only permission bits are allowed, including 0700", c.DirMode)
+	}
+	if c.MaxHeaderCount < 0 {
+		return fmt.Errorf("invalid MaxHeaderCount %d: must not be negative", c.MaxHeaderCount)
+	}
+	if c.MaxPathSegments < 0 {
+		return fmt.Errorf("invalid MaxPathSegments %d: must not be negative", c.MaxPathSegments)
+	}
+	if c.LogLevel < LevelDebug || c.LogLevel > LevelError {
+		return fmt.Errorf("invalid LogLevel %d", c.LogLevel)
+	}
+	if c.LogFormat != "" && c.LogFormat != LogFormatText && c.LogFormat != LogFormatJSON {
+		return fmt.Errorf("invalid LogFormat %q: must be %q or %q", c.LogFormat, LogFormatText, LogFormatJSON)
+	}
+	return nil
+}
+
+// writeBufferSize maps the zero value to the default
+func (c Config) writeBufferSize() int {
+	if c.WriteBufferSize == 0 {
+		return defaultWriteBufferSize
+	}
+	return c.WriteBufferSize
+}
+
+// maxHeaderCount maps the zero value to the default
+func (c Config) maxHeaderCount() int {
+	if c.MaxHeaderCount == 0 {
+		return defaultMaxHeaderCount
+	}
+	return c.MaxHeaderCount
+}
+
+// defaultFileContentType maps the zero value to the default
+func (c Config) defaultFileContentType() string {
+	if c.DefaultFileContentType == "" {
+		return "application/octet-stream"
+	}
+	return c.DefaultFileContentType
+}
+
+// directoryIndex maps nil to index.html
+func (c Config) directoryIndex() string {
+	if c.DirectoryIndex == nil {
+		return "index.html"
+	}
+	return *c.DirectoryIndex
+}
+
+// fileMode maps the zero value to the default
+func (c Config) fileMode() os.FileMode {
+	if c.FileMode == 0 {
+		return 0644
+	}
+	return c.FileMode
+}
+
+// dirMode maps the zero value to the default
+func (c Config) dirMode() os.FileMode {
+	if c.DirMode == 0 {
+		return 0755
+	}
+	return c.DirMode
+}
+
+// maxPathSegments maps the zero value to the default
+func (c Config) maxPathSegments() int {
+	if c.MaxPathSegments == 0 {
+		return defaultMaxPathSegments
+	}
+	return c.MaxPathSegments
+}
+
+// accessLogSampleRate maps nil to logging every request
+func (c Config) accessLogSampleRate() float64 {
+	if c.AccessLogSampleRate == nil {
+		return 1
+	}
+	return *c.AccessLogSampleRate
+}
+
+// redactHeaders maps nil to defaultRedactHeaders
+func (c Config) redactHeaders() []string {
+	if c.RedactHeaders == nil {
+		return defaultRedactHeaders
+	}
+	return c.RedactHeaders
+}
+
+// compressionPreference maps nil to the default order
+func (c Config) compressionPreference() []string {
+	if c.CompressionPreference == nil {
+		return []string{"gzip", "deflate"}
+	}
+	return c.CompressionPreference
+}
+
+// gzipLevel maps the zero value to the library default
+func (c Config) gzipLevel() int {
+	if c.CompressionLevel == 0 {
+		return gzip.DefaultCompression
+	}
+	return c.CompressionLevel
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"net/textproto"
+	"slices"
+	"strings"
+)
+
+/*
+   Request dumps, for debug logs:
+
+     POST /files/notes.txt?mode=append HTTP/1.1
+     Authorization: ***
+     Content-Length: 11
+     Content-Type: text/plain
+     Host: localhost:4221
+
+     <11 bytes body>
+
+   Unlike a %+v of the struct, headers come out sorted and in their usual
+   spelling, and credentials never reach the log (Config.RedactHeaders).
+   The body itself is left out, it may be large, binary or just as
+   sensitive as the headers.
+*/
+
+// defaultRedactHeaders are the headers shown as "***" unless Config.RedactHeaders says otherwise
+var defaultRedactHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie"}
+
+// redacted is value, or "***" if name is one of redact, in any casing
+func redacted(name, value string, redact []string) string {
+	if slices.ContainsFunc(redact, func(r string) bool { return strings.EqualFold(r, name) }) {
+		return "***"
+	}
+	return value
+}
+
+// Dump renders the request roughly as it came over the wire, for debugging:
+// request line, sorted headers with credentials redacted, and the body's size.
+func (r *Request) Dump() string {
+	return r.dump(defaultRedactHeaders)
+}
+
+// dump is Dump with the header names to redact
+func (r *Request) dump(redact []string) string {
+	var b strings.Builder
+	target := r.Path
+	if r.RawQuery != "" {
+		target += "?" + r.RawQuery
+	}
+	fmt.Fprintf(&b, "%s %s %s\n", r.Method, target, r.Version)
+	for _, name := range slices.Sorted(maps.Keys(r.Headers)) {
+		fmt.Fprintf(&b, "%s: %s\n", textproto.CanonicalMIMEHeaderKey(name), redacted(name, r.Headers[name], redact))
+	}
+
+	switch {
+	case r.BodyReader != nil:
+		b.WriteString("\n<body not read yet>")
+	case len(r.Body) > 0:
+		fmt.Fprintf(&b, "\n<%d bytes body>", len(r.Body))
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// dump renders the response like Request.dump, Set-Cookie lines included
+func (resp *Response) dump(redact []string) string {
+	var b strings.Builder
+	version := resp.Version
+	if version == "" {
+		version = "HTTP/1.1"
+	}
+	fmt.Fprintf(&b, "%s %d %s\n", version, resp.StatusCode, resp.StatusText)
+	for _, name := range slices.Sorted(maps.Keys(resp.Headers)) {
+		fmt.Fprintf(&b, "%s: %s\n", name, redacted(name, resp.Headers[name], redact))
+	}
+	for _, cookie := range resp.Cookies {
+		fmt.Fprintf(&b, "Set-Cookie: %s\n", redacted("Set-Cookie", cookie, redact))
+	}
+
+	switch {
+	case resp.Stream != nil:
+		b.WriteString("\n<streamed body>")
+	case resp.BodyReader != nil:
+		b.WriteString("\n<body read from a file or reader>")
+	case len(resp.Body) > 0:
+		fmt.Fprintf(&b, "\n<%d bytes body>", len(resp.Body))
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
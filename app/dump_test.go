@@ -0,0 +1,109 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestDebugLogRedactsHeaders(t *testing.T) {
+	config := testConfig()
+	config.LogLevel = LevelDebug
+	s, logs := startTestServer(t, config)
+
+	get(t, s, http.MethodGet, "/echo/hi", "Authorization: Bearer secret-token", "Cookie: session=secret-cookie")
+	out := logs.String()
+	if !strings.Contains(out, "Authorization: ***") || !strings.Contains(out, "Cookie: ***") {
+		t.Errorf("credentials not redacted in:\n%s", out)
+	}
+	if strings.Contains(out, "secret") {
+		t.Errorf("a credential reached the log:\n%s", out)
+	}
+}
+
+func TestDebugLogRedactHeadersConfig(t *testing.T) {
+	config := testConfig()
+	config.LogLevel = LevelDebug
+	config.RedactHeaders = []string{"x-api-key"}
+	s, logs := startTestServer(t, config)
+
+	get(t, s, http.MethodGet, "/echo/hi", "X-Api-Key: k-123", "Authorization: Bearer visible")
+	out := logs.String()
+	if !strings.Contains(out, "X-Api-Key: ***") {
+		t.Errorf("X-Api-Key not redacted in:\n%s", out)
+	}
+	// The list replaces the defaults
+	if !strings.Contains(out, "Authorization: Bearer visible") {
+		t.Errorf("Authorization redacted although RedactHeaders leaves it out:\n%s", out)
+	}
+}
+
+func TestResponseDumpRedactsSetCookie(t *testing.T) {
+	resp := NewResponse(http.StatusOK, "OK", []byte("hi"))
+	resp.SetHeader("Content-Type", "text/plain")
+	resp.Cookies = append(resp.Cookies, "session=secret; HttpOnly")
+
+	want := "HTTP/1.1 200 OK\nContent-Type: text/plain\nSet-Cookie: ***\n\n<2 bytes body>"
+	if got := resp.dump(defaultRedactHeaders); got != want {
+		t.Errorf("dump:\ngot  %q\nwant %q", got, want)
+	}
+}
+
+func TestNoDumpsAtInfoLevel(t *testing.T) {
+	s, logs := startTestServer(t, testConfig())
+	get(t, s, http.MethodGet, "/echo/hi")
+	if out := logs.String(); strings.Contains(out, "Received request") {
+		t.Errorf("request dump logged at info level:\n%s", out)
+	}
+}
+
+func TestRequestDump(t *testing.T) {
+	req, err := parse("POST /files/notes.txt?mode=append HTTP/1.1\r\n" +
+		"host: localhost:4221\r\nContent-Type: text/plain\r\nAUTHORIZATION: Bearer secret\r\nCookie: id=secret\r\nContent-Length: 11\r\n\r\nhello world")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "POST /files/notes.txt?mode=append HTTP/1.1\n" +
+		"Authorization: ***\n" +
+		"Content-Length: 11\n" +
+		"Content-Type: text/plain\n" +
+		"Cookie: ***\n" +
+		"Host: localhost:4221\n" +
+		"\n" +
+		"<11 bytes body>"
+	if got := req.Dump(); got != want {
+		t.Errorf("Dump:\ngot  %q\nwant %q", got, want)
+	}
+
+	// Without a body the dump ends with the headers
+	req = newTestRequest(http.MethodGet, "/", map[string]string{"Accept": "*/*"}, "")
+	if got, want := req.Dump(), "GET / HTTP/1.1\nAccept: */*"; got != want {
+		t.Errorf("Dump without a body:\ngot  %q\nwant %q", got, want)
+	}
+	req.BodyReader = io.NopCloser(strings.NewReader("lazy"))
+	if got := req.Dump(); !strings.HasSuffix(got, "\n\n<body not read yet>") {
+		t.Errorf("Dump of a lazy body: %q", got)
+	}
+}
+
+func TestDebugLogRedactsResponseCookies(t *testing.T) {
+	config := testConfig()
+	config.LogLevel = LevelDebug
+	s, logs := newTestServer(t, config)
+	s.router.RegisterExactRoute("/login", func(r *Request) *Response {
+		resp := NewResponse(http.StatusOK, "OK", nil)
+		resp.Cookies = append(resp.Cookies, "session=secret-session; HttpOnly")
+		return resp
+	})
+	start(t, s)
+
+	resp, _ := get(t, s, http.MethodGet, "/login")
+	if resp.Header.Get("Set-Cookie") != "session=secret-session; HttpOnly" {
+		t.Fatalf("Set-Cookie on the wire: %q, only the log is redacted", resp.Header.Get("Set-Cookie"))
+	}
+	out := logs.String()
+	if !strings.Contains(out, "Set-Cookie: ***") || strings.Contains(out, "secret-session") {
+		t.Errorf("response cookie not redacted in:\n%s", out)
+	}
+}
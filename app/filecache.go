@@ -0,0 +1,119 @@
+package main
+
+import (
+	"container/list"
+	"os"
+	"sync"
+	"time"
+)
+
+// maxCachedFileBytes keeps a single large file from evicting everything else
+const maxCachedFileBytes = 1 << 20 // 1 MB
+
+type fileCacheEntry struct {
+	path    string
+	content []byte
+	modTime time.Time
+	size    int64
+}
+
+/*
+LRU cache for small static files:
+
+	entries: map path → list element (O(1) lookup)
+	order:   doubly linked list, most recently used at the front
+
+	Get(a):  move a to the front
+	Put(d):  insert at the front, evict from the back until size <= maxBytes
+
+Handlers run in parallel goroutines (one per connection), so every
+operation - including Get, which reorders the list - takes the mutex.
+*/
+type fileCache struct {
+	mu       sync.Mutex
+	maxBytes int64
+	curBytes int64
+	order    *list.List
+	entries  map[string]*list.Element
+}
+
+func newFileCache(maxBytes int64) *fileCache {
+	return &fileCache{
+		maxBytes: maxBytes,
+		order:    list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+// ReadFile returns the file content, from the cache if the cached copy is still current.
+// The cached mtime and size are validated against os.Stat on every call,
+// so a modified file is re-read on the next request.
+func (c *fileCache) ReadFile(path string) ([]byte, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if content, ok := c.get(path, info); ok {
+		return content, nil
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() <= maxCachedFileBytes {
+		c.put(path, content, info)
+	}
+	return content, nil
+}
+
+func (c *fileCache) get(path string, info os.FileInfo) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[path]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*fileCacheEntry)
+	if !entry.modTime.Equal(info.ModTime()) || entry.size != info.Size() {
+		// Stale, drop it so the caller re-reads and refreshes it
+		c.remove(elem)
+		return nil, false
+	}
+	c.order.MoveToFront(elem)
+	return entry.content, true
+}
+
+func (c *fileCache) put(path string, content []byte, info os.FileInfo) {
+	size := int64(len(content))
+	if size > c.maxBytes {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[path]; ok {
+		c.remove(elem)
+	}
+	c.entries[path] = c.order.PushFront(&fileCacheEntry{
+		path:    path,
+		content: content,
+		modTime: info.ModTime(),
+		size:    info.Size(),
+	})
+	c.curBytes += size
+
+	for c.curBytes > c.maxBytes {
+		c.remove(c.order.Back())
+	}
+}
+
+// remove must be called with mu held
+func (c *fileCache) remove(elem *list.Element) {
+	entry := c.order.Remove(elem).(*fileCacheEntry)
+	delete(c.entries, entry.path)
+	c.curBytes -= int64(len(entry.content))
+}
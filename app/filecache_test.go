@@ -0,0 +1,115 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFileCacheHit(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "a.txt")
+	writeTestFile(t, dir, "a.txt", "first")
+	info, _ := os.Stat(path)
+
+	c := newFileCache(1 << 10)
+	if got, err := c.ReadFile(path); err != nil || string(got) != "first" {
+		t.Fatalf("first read: %q %v", got, err)
+	}
+
+	// Same size and mtime: only the cache can still answer "first"
+	writeTestFile(t, dir, "a.txt", "other")
+	os.Chtimes(path, info.ModTime(), info.ModTime())
+	if got, _ := c.ReadFile(path); string(got) != "first" {
+		t.Errorf("second read: got %q, want the cached copy", got)
+	}
+
+	// A new mtime invalidates it
+	later := info.ModTime().Add(time.Second)
+	os.Chtimes(path, later, later)
+	if got, _ := c.ReadFile(path); string(got) != "other" {
+		t.Errorf("after modification: got %q, want the new content", got)
+	}
+}
+
+func TestFileCacheEviction(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a", "b", "c"} {
+		writeTestFile(t, dir, name, "0123456789")
+	}
+	c := newFileCache(25) // room for two 10-byte files
+	for _, name := range []string{"a", "b", "a", "c"} {
+		if _, err := c.ReadFile(filepath.Join(dir, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// b was the least recently used when c came in
+	if _, ok := c.entries[filepath.Join(dir, "b")]; ok {
+		t.Error("b is still cached")
+	}
+	for _, name := range []string{"a", "c"} {
+		if _, ok := c.entries[filepath.Join(dir, name)]; !ok {
+			t.Errorf("%s was evicted", name)
+		}
+	}
+	if c.curBytes != 20 {
+		t.Errorf("curBytes: got %d, want 20", c.curBytes)
+	}
+}
+
+func TestFileCacheSkipsLargeFiles(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "big")
+	writeTestFile(t, dir, "big", string(make([]byte, maxCachedFileBytes+1)))
+	c := newFileCache(4 * maxCachedFileBytes)
+	if got, err := c.ReadFile(path); err != nil || len(got) != maxCachedFileBytes+1 {
+		t.Fatalf("read: %d bytes, %v", len(got), err)
+	}
+	if len(c.entries) != 0 {
+		t.Error("a file over maxCachedFileBytes was cached")
+	}
+}
+
+func TestFileCacheConcurrent(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a", "b", "c", "d"} {
+		writeTestFile(t, dir, name, name)
+	}
+	c := newFileCache(3)
+	var wg sync.WaitGroup
+	for i := range 16 {
+		wg.Go(func() {
+			for j := range 100 {
+				name := string(rune('a' + (i+j)%4))
+				if got, err := c.ReadFile(filepath.Join(dir, name)); err != nil || string(got) != name {
+					t.Errorf("%s: got %q %v", name, got, err)
+					return
+				}
+			}
+		})
+	}
+	wg.Wait()
+	if c.curBytes > 3 || int(c.curBytes) != c.order.Len() {
+		t.Errorf("curBytes %d with %d entries", c.curBytes, c.order.Len())
+	}
+}
+
+func TestFileCacheServesFiles(t *testing.T) {
+	config := testConfig()
+	config.FileCacheBytes = 1 << 10
+	s, dir := filesServer(t, config, map[string]string{"a.txt": "hello"})
+	for range 2 {
+		if resp, body := get(t, s, http.MethodGet, "/files/a.txt"); resp.StatusCode != http.StatusOK || body != "hello" {
+			t.Fatalf("GET: got %d %q", resp.StatusCode, body)
+		}
+	}
+	s.fileCache.mu.Lock()
+	_, cached := s.fileCache.entries[filepath.Join(dir, "a.txt")]
+	s.fileCache.mu.Unlock()
+	if !cached {
+		t.Error("GET /files/a.txt didn't go through the cache")
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+   HTTP/2 cleartext with prior knowledge (h2c, RFC 9113 §3.3):
+
+     curl --http2-prior-knowledge http://localhost:4221/echo/hi
+     grpc clients dialing without TLS
+
+   A client that already knows the server speaks HTTP/2 skips the HTTP/1.1
+   Upgrade dance and opens with the connection preface:
+
+     PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n     ← then binary frames
+
+   Framing, HPACK and flow control are net/http's own HTTP/2 server, which
+   serves just this one connection. Its streams are turned back into Request
+   and Response, so they go through the same router, middlewares and
+   processCommonHeaders as HTTP/1.1.
+*/
+
+const h2Preface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+// isH2Preface reports whether the connection opens with the HTTP/2 preface.
+// Bytes are only waited for while they still match it, an HTTP/1.1 request
+// is recognized from its first byte and nothing is consumed either way.
+func isH2Preface(reader *bufio.Reader) bool {
+	for n := 1; n <= len(h2Preface); n++ {
+		b, err := reader.Peek(n)
+		if err != nil || string(b) != h2Preface[:n] {
+			return false
+		}
+	}
+	return true
+}
+
+// serveH2C hands the connection to an HTTP/2 server until the client or the server is done with it
+func (s *Server) serveH2C(ctx context.Context, conn net.Conn, reader *bufio.Reader, peerAddr string) {
+	// net/http sets its own deadlines, IdleTimeout plays ReadTimeout's part between streams
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		s.errorf("Error clearing deadlines: %v", err)
+		return
+	}
+
+	protocols := new(http.Protocols)
+	protocols.SetUnencryptedHTTP2(true)
+	bc := &bufferedConn{Conn: conn, reader: reader}
+	defer bc.detach()
+	l := newOneConnListener(bc)
+	h2 := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			s.serveH2CStream(ctx, w, r, peerAddr)
+		}),
+		Protocols:   protocols,
+		IdleTimeout: s.config.Load().ReadTimeout,
+		ErrorLog:    s.logger,
+		ConnState: func(_ net.Conn, state http.ConnState) {
+			if state == http.StateClosed {
+				l.Close()
+			}
+		},
+	}
+	// Shutdown sends GOAWAY and lets open streams finish
+	stop := context.AfterFunc(ctx, func() { h2.Shutdown(context.Background()) })
+	defer stop()
+
+	s.debugf("Serving HTTP/2 (h2c) for %s", conn.RemoteAddr().String())
+	err := h2.Serve(l)
+	if errors.Is(err, http.ErrServerClosed) {
+		// Serve returns right away on Shutdown, the streams still in flight don't
+		<-l.closed
+	} else if !errors.Is(err, net.ErrClosed) {
+		s.warnf("Error serving h2c: %v", err)
+	}
+}
+
+// serveH2CStream runs one HTTP/2 stream through the router like an HTTP/1.1 request
+func (s *Server) serveH2CStream(ctx context.Context, w http.ResponseWriter, hr *http.Request, peerAddr string) {
+	start := time.Now()
+	s.totalRequests.Add(1)
+
+	path, rawQuery, _ := strings.Cut(hr.RequestURI, "?")
+	req := &Request{
+		Method:     hr.Method,
+		Path:       path,
+		RawQuery:   rawQuery,
+		Version:    hr.Proto,
+		ProtoMajor: hr.ProtoMajor,
+		ProtoMinor: hr.ProtoMinor,
+		Host:       hr.Host,
+		Headers:    make(map[string]string, len(hr.Header)),
+		ctx:        ctx,
+	}
+	for name, values := range hr.Header {
+		req.Headers[strings.ToLower(name)] = strings.Join(values, ", ")
+	}
+	req.RemoteAddr = s.clientAddr(peerAddr, req)
+	if err := s.checkPathDepth(req.Path); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var handler HandleFunc
+	var route RouteInfo
+	if unrouted := s.unroutedHandler(req); unrouted != nil {
+		handler = unrouted
+	} else {
+		handler, req.Params, route = s.routerFor(req.Host).Match(req.Path)
+	}
+
+	// Like HTTP/1.1, a rejected request's body is never read, and without
+	// a read net/http never sends the client its 100 Continue
+	var resp *Response
+	if route.Precheck != nil {
+		resp = route.Precheck(req)
+	}
+	switch {
+	case resp != nil:
+	case route.LazyBody:
+		req.BodyReader = hr.Body
+	default:
+		body, err := io.ReadAll(http.MaxBytesReader(w, hr.Body, maxBodyBytes))
+		if err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+			}
+			return
+		}
+		req.Body = body
+		if encoding, ok := req.GetHeader("Content-Encoding"); ok && len(req.Body) > 0 {
+			if err := decodeBody(req, strings.ToLower(strings.TrimSpace(encoding))); err != nil {
+				resp := BodyErrorResponse(err)
+				http.Error(w, string(resp.Body), resp.StatusCode)
+				return
+			}
+		}
+	}
+	if resp == nil {
+		resp = handler(req)
+	}
+	if resp.Hijack != nil {
+		// There is no connection of its own to take over, a stream is not a socket
+		resp = NewResponse(http.StatusNotImplemented, "Not Implemented", []byte("protocol switch is not supported over HTTP/2"))
+	}
+	if err := s.processCommonHeaders(req, resp); err != nil {
+		s.errorf("Error processing common headers: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if err := writeH2CResponse(w, resp); err != nil {
+		s.errorf("Error writing response: %v", err)
+		return
+	}
+	s.accessLog(req, resp, start)
+}
+
+// h2cHopHeaders are connection-specific, HTTP/2 forbids them (RFC 9113 §8.2.2)
+var h2cHopHeaders = []string{"Connection", "Keep-Alive", "Proxy-Connection", "Transfer-Encoding", "Upgrade"}
+
+// writeH2CResponse sends resp on an HTTP/2 stream
+func writeH2CResponse(w http.ResponseWriter, resp *Response) error {
+	if closer, ok := resp.BodyReader.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	header := w.Header()
+	for name, value := range resp.Headers {
+		header.Set(name, value)
+	}
+	for _, name := range h2cHopHeaders {
+		header.Del(name)
+	}
+	for _, cookie := range resp.Cookies {
+		header.Add("Set-Cookie", cookie)
+	}
+	if resp.Stream != nil {
+		header.Del("Content-Length")
+	}
+	w.WriteHeader(resp.StatusCode)
+
+	switch {
+	case resp.Stream != nil:
+		if err := resp.Stream(&h2cStreamWriter{w: w, rc: http.NewResponseController(w)}); err != nil {
+			return err
+		}
+		for name, value := range resp.Trailers {
+			if headerHasToken(resp.Headers["Trailer"], name) {
+				header.Set(name, value)
+			}
+		}
+	case resp.BodyReader != nil:
+		if _, err := io.Copy(w, resp.BodyReader); err != nil {
+			return err
+		}
+	case len(resp.Body) > 0:
+		if _, err := w.Write(resp.Body); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// h2cStreamWriter gives a StreamFunc its Flusher on an HTTP/2 stream
+type h2cStreamWriter struct {
+	w  io.Writer
+	rc *http.ResponseController
+}
+
+func (sw *h2cStreamWriter) Write(p []byte) (int, error) {
+	return sw.w.Write(p)
+}
+
+func (sw *h2cStreamWriter) Flush() error {
+	return sw.rc.Flush()
+}
+
+// bufferedConn reads through the connection's bufio.Reader, which already
+// holds the preface and maybe the first frames
+type bufferedConn struct {
+	net.Conn
+	mu     sync.Mutex
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.reader == nil {
+		return 0, net.ErrClosed
+	}
+	return c.reader.Read(p)
+}
+
+// detach closes the connection and waits out any read still in progress. The
+// HTTP/2 frame reader can outlive Serve, and the bufio.Reader goes back to the
+// pool once serveH2C returns.
+func (c *bufferedConn) detach() {
+	c.Conn.Close()
+	c.mu.Lock()
+	c.reader = nil
+	c.mu.Unlock()
+}
+
+// oneConnListener hands out a single connection, then blocks Accept until closed
+type oneConnListener struct {
+	conns  chan net.Conn
+	closed chan struct{}
+	once   sync.Once
+	addr   net.Addr
+}
+
+func newOneConnListener(conn net.Conn) *oneConnListener {
+	l := &oneConnListener{conns: make(chan net.Conn, 1), closed: make(chan struct{}), addr: conn.LocalAddr()}
+	l.conns <- conn
+	return l
+}
+
+func (l *oneConnListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *oneConnListener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *oneConnListener) Addr() net.Addr {
+	return l.addr
+}
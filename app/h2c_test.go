@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// h2cClient speaks HTTP/2 with prior knowledge, the way curl --http2-prior-knowledge does
+func h2cClient(t *testing.T) *http.Client {
+	protocols := new(http.Protocols)
+	protocols.SetUnencryptedHTTP2(true)
+	transport := &http.Transport{Protocols: protocols}
+	t.Cleanup(transport.CloseIdleConnections)
+	return &http.Client{Transport: transport}
+}
+
+func TestH2C(t *testing.T) {
+	config := testConfig()
+	config.EnableH2C = true
+	s, _ := startTestServer(t, config)
+	client := h2cClient(t)
+	base := "http://" + s.Addr().String()
+
+	for target, want := range map[string]string{"/": "", "/echo/over-h2": "over-h2"} {
+		resp, err := client.Get(base + target)
+		if err != nil {
+			t.Fatalf("%s: %v", target, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.ProtoMajor != 2 || resp.StatusCode != http.StatusOK || string(body) != want {
+			t.Errorf("%s: got %s %d %q", target, resp.Proto, resp.StatusCode, body)
+		}
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, base+"/user-agent", nil)
+	req.Header.Set("User-Agent", "h2-probe")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "h2-probe" {
+		t.Errorf("/user-agent over h2c: got %q", body)
+	}
+
+	// HTTP/1.1 on the same port is untouched
+	if resp, body := get(t, s, http.MethodGet, "/echo/one"); resp.Proto != "HTTP/1.1" || body != "one" {
+		t.Errorf("HTTP/1.1 next to h2c: got %s %q", resp.Proto, body)
+	}
+}
+
+func TestIsH2Preface(t *testing.T) {
+	for input, want := range map[string]bool{
+		h2Preface:                      true,
+		h2Preface + "\x00\x00\x12\x04": true,
+		"GET / HTTP/1.1\r\n\r\n":       false,
+		"PRI * HTTP/1.1\r\n\r\n":       false,
+		"PRI":                          false, // the client gave up halfway
+	} {
+		reader := bufio.NewReader(strings.NewReader(input))
+		if got := isH2Preface(reader); got != want {
+			t.Errorf("%q: got %v", input, got)
+		}
+		// Nothing is consumed, whoever serves the connection reads it from the start
+		if rest, _ := io.ReadAll(reader); string(rest) != input {
+			t.Errorf("%q: %q left to read", input, rest)
+		}
+	}
+}
+
+func TestH2CDisabled(t *testing.T) {
+	s, _ := startTestServer(t, testConfig())
+	if resp, err := h2cClient(t).Get("http://" + s.Addr().String() + "/"); err == nil {
+		resp.Body.Close()
+		t.Errorf("HTTP/2 served without EnableH2C: %s %d", resp.Proto, resp.StatusCode)
+	}
+}
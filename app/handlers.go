@@ -1,12 +1,30 @@
 package main
 
 import (
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"maps"
+	"math/rand/v2"
+	"mime"
 	"net/http"
+	"net/textproto"
+	"net/url"
 	"os"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
 )
 
+// Files above this size are streamed from disk instead of being read into memory
+const streamFileThreshold = 1 << 20 // 1 MB
+
+// fileMethods are the methods handleFiles implements
+var fileMethods = []string{http.MethodGet, http.MethodHead, http.MethodPut, http.MethodPatch, http.MethodPost}
+
 const (
 	echoPrefix      = "/echo/"
 	userAgentPrefix = "/user-agent"
@@ -23,8 +41,18 @@ func handleRoot(r *Request) *Response {
 
 func handleEcho(r *Request) *Response {
 	content := r.Path[len(echoPrefix):]
+	// Plain text unless the client prefers JSON, the body then depends on Accept
+	if negotiate(r, "text/plain", "application/json") == "application/json" {
+		resp, err := NewJSONResponse(http.StatusOK, map[string]string{"echo": content})
+		if err != nil {
+			return NewResponse(http.StatusInternalServerError, "Internal Server Error", []byte(err.Error()))
+		}
+		resp.AddVary("Accept")
+		return resp
+	}
 	resp := NewResponse(http.StatusOK, "OK", []byte(content))
 	resp.SetHeader("Content-Type", "text/plain")
+	resp.AddVary("Accept")
 	return resp
 }
 
@@ -38,12 +66,115 @@ func handleUserAgent(r *Request) *Response {
 	return resp
 }
 
-func handleFiles(r *Request) *Response {
-	fileName := r.Path[len(filesPrefix):]
+// unroutedHandler returns the handler for requests about the request itself
+// (TRACE) or the whole server (OPTIONS *) rather than a resource, which
+// bypass routing; nil for everything else.
+func (s *Server) unroutedHandler(r *Request) HandleFunc {
+	switch {
+	case r.Method == http.MethodTrace:
+		return s.handleTrace
+	case r.Method == http.MethodOptions && r.Path == "*":
+		return s.handleServerOptions
+	}
+	return nil
+}
+
+/*
+   OPTIONS * (RFC 9110 §9.3.7) asks about the server, not any one resource:
+
+     OPTIONS * HTTP/1.1
+
+     HTTP/1.1 204 No Content
+     Allow: GET, HEAD, OPTIONS, PATCH, POST, PUT
+     Accept-Ranges: bytes
+
+   Allow is every method some route declares with WithMethods, as all the
+   built-in routes do. A route without WithMethods lets any method through
+   to its handler, but that says nothing about which ones it implements,
+   so it contributes none.
+*/
+
+// handleServerOptions answers OPTIONS * with the methods of all hosts' routes
+func (s *Server) handleServerOptions(r *Request) *Response {
+	methods := map[string]bool{http.MethodOptions: true}
+	routers := []*Router{s.router}
+	for _, router := range s.vhosts {
+		routers = append(routers, router)
+	}
+	for _, router := range routers {
+		for _, route := range router.Routes() {
+			for _, method := range route.Methods {
+				methods[method] = true
+			}
+		}
+	}
+	if s.config.Load().EnableTrace {
+		methods[http.MethodTrace] = true
+	}
+
+	resp := NewResponse(http.StatusNoContent, "No Content", nil)
+	resp.SetHeader("Allow", strings.Join(slices.Sorted(maps.Keys(methods)), ", "))
+	// Files can be fetched in parts, see serveRange
+	resp.SetHeader("Accept-Ranges", "bytes")
+	return resp
+}
+
+// traceExcludedHeaders are credentials a TRACE response must not reflect (RFC 9110 §9.3.8)
+var traceExcludedHeaders = map[string]bool{
+	"authorization":       true,
+	"proxy-authorization": true,
+	"cookie":              true,
+}
+
+// handleTrace echoes the request line and headers back as message/http,
+// so a client can see what reached the server after every intermediary.
+func (s *Server) handleTrace(r *Request) *Response {
+	if !s.config.Load().EnableTrace {
+		return NewResponse(http.StatusMethodNotAllowed, "Method Not Allowed", nil)
+	}
+
+	// Headers were lowercased on parse, send them back canonical and sorted
+	var b strings.Builder
+	target := r.Path
+	if r.RawQuery != "" {
+		target += "?" + r.RawQuery
+	}
+	fmt.Fprintf(&b, "%s %s %s\r\n", r.Method, target, r.Version)
+	for _, name := range slices.Sorted(maps.Keys(r.Headers)) {
+		if traceExcludedHeaders[name] {
+			continue
+		}
+		fmt.Fprintf(&b, "%s: %s\r\n", textproto.CanonicalMIMEHeaderKey(name), r.Headers[name])
+	}
+	b.WriteString("\r\n")
+
+	resp := NewResponse(http.StatusOK, "OK", []byte(b.String()))
+	resp.SetHeader("Content-Type", "message/http")
+	return resp
+}
+
+// fileHandler serves the files below root under the URL prefix, e.g. "/files/" → "/srv/files".
+// Every mount has its own root, so traversal checks never cross between mounts.
+func (s *Server) fileHandler(prefix, root string) HandleFunc {
+	return func(r *Request) *Response {
+		return s.handleFiles(r, prefix, root)
+	}
+}
 
-	// if fileName is empty, return 400 Bad Request
+func (s *Server) handleFiles(r *Request, prefix, root string) *Response {
+	fileName := r.Path[len(prefix):]
+	// HEAD is answered like GET, processCommonHeaders drops the body
+	get := r.Method == http.MethodGet || r.Method == http.MethodHead
+	listing := s.config.Load().EnableDirListing && get
+	// Directories can be served by GET as their index file or as a listing
+	dirGet := get && (listing || s.config.Load().directoryIndex() != "")
+
+	// if fileName is empty, return 400 Bad Request (unless the root directory is served)
 	if fileName == "" {
-		return NewResponse(http.StatusBadRequest, "Bad Request", []byte("File name is required"))
+		if !dirGet {
+			return NewResponse(http.StatusBadRequest, "Bad Request", []byte("File name is required"))
+		}
+		fileName = "."
 	}
 
 	/*
@@ -81,29 +212,91 @@ func handleFiles(r *Request) *Response {
 			     4. Final absolute path verification ensures file is within allowed directory
 	*/
 	fileName = filepath.Clean(fileName)
-	if strings.Contains(fileName, "..") || strings.HasPrefix(fileName, ".") {
+	// "." is the served directory itself, only reachable when listing is enabled
+	isRoot := fileName == "." && dirGet
+	if !isRoot && (strings.Contains(fileName, "..") || strings.HasPrefix(fileName, ".")) {
 		return NewResponse(http.StatusBadRequest, "Bad Request", []byte("Invalid file name"))
 	}
 
 	// Join with base directory
-	fullPath := filepath.Join(dirPath, fileName)
+	fullPath := filepath.Join(root, fileName)
 
 	// Additional security: verify the resolved path is still within directory
-	absFullPath, err := filepath.Abs(fullPath)
-	if err != nil {
-		return NewResponse(http.StatusInternalServerError, "Internal Server Error", []byte(err.Error()))
-	}
-	absDir, err := filepath.Abs(dirPath)
-	if err != nil {
-		return NewResponse(http.StatusInternalServerError, "Internal Server Error", []byte(err.Error()))
-	}
-	if !strings.HasPrefix(absFullPath, absDir) {
-		return NewResponse(http.StatusBadRequest, "Bad Request", []byte("path traversal detected"))
+	if resp := checkInsideDir(fullPath, root); resp != nil {
+		return resp
 	}
 
 	switch r.Method {
-	case http.MethodGet:
-		fileContent, err := os.ReadFile(fullPath)
+	case http.MethodGet, http.MethodHead:
+		contentType := "" // settled once fullPath is known to be a file
+
+		if dirGet {
+			if info, err := os.Stat(fullPath); err == nil && info.IsDir() {
+				indexPath := ""
+				if index := s.config.Load().directoryIndex(); index != "" {
+					indexPath = filepath.Join(fullPath, index)
+				}
+				if info, err := os.Stat(indexPath); indexPath != "" && err == nil && !info.IsDir() {
+					// The index name comes from config, but it may still be a "../" or a symlink
+					if resp := checkInsideDir(indexPath, root); resp != nil {
+						return resp
+					}
+					fullPath = indexPath
+					contentType = "text/html; charset=utf-8"
+				} else if listing {
+					return listDirectory(prefix+strings.TrimPrefix(filepath.ToSlash(fileName), "."), fullPath)
+				} else {
+					return NewResponse(http.StatusBadRequest, "Bad Request", []byte("File name is required"))
+				}
+			}
+		}
+
+		info, err := os.Stat(fullPath)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return NewResponse(http.StatusNotFound, "Not Found", []byte("File not found"))
+			}
+			return NewResponse(http.StatusInternalServerError, "Internal Server Error", []byte(err.Error()))
+		}
+		if contentType == "" {
+			// Before any range slicing: a sniffed range would describe a part, not the file
+			contentType = s.fileContentType(fullPath)
+		}
+
+		// Ranges always address the file itself, never its compressed sidecar
+		if _, ranged := r.GetHeader("Range"); !ranged {
+			if resp := s.serveGzipSidecar(r, fullPath, root, contentType); resp != nil {
+				setDisposition(r, resp, fullPath)
+				return resp
+			}
+		}
+
+		// Partial content, unless If-Range says the client's copy is outdated
+		if rangeHeader, ok := r.GetHeader("Range"); ok && ifRangeMatches(r, info) {
+			if resp := s.serveRange(fullPath, info, contentType, rangeHeader); resp != nil {
+				setDisposition(r, resp, fullPath)
+				return resp
+			}
+		}
+
+		if info.Size() > streamFileThreshold {
+			// A 1 GB download would otherwise hold 1 GB in memory per request
+			file, err := os.Open(fullPath)
+			if err != nil {
+				return NewResponse(http.StatusInternalServerError, "Internal Server Error", []byte(err.Error()))
+			}
+			resp := NewResponse(http.StatusOK, "OK", nil)
+			resp.BodyReader = file
+			resp.SetHeader("Content-Type", contentType)
+			resp.SetHeader("Content-Length", strconv.FormatInt(info.Size(), 10))
+			resp.SetHeader("ETag", fileETag(info))
+			resp.SetHeader("Accept-Ranges", "bytes")
+			s.setCacheHeaders(resp)
+			setDisposition(r, resp, fullPath)
+			return resp
+		}
+
+		fileContent, err := s.readFile(fullPath)
 		if err != nil {
 			if os.IsNotExist(err) {
 				return NewResponse(http.StatusNotFound, "Not Found", []byte("File not found"))
@@ -111,15 +304,474 @@ func handleFiles(r *Request) *Response {
 			return NewResponse(http.StatusInternalServerError, "Internal Server Error", []byte(err.Error()))
 		}
 		resp := NewResponse(http.StatusOK, "OK", fileContent)
-		resp.SetHeader("Content-Type", "application/octet-stream")
+		resp.SetHeader("Content-Type", contentType)
+		resp.SetHeader("ETag", fileETag(info))
+		// Only file responses can be resumed with Range (see serveRange), other
+		// handlers leave Accept-Ranges out or send "none" to say they can't
+		resp.SetHeader("Accept-Ranges", "bytes")
+		s.setCacheHeaders(resp)
+		setDisposition(r, resp, fullPath)
 		return resp
+	case http.MethodPut:
+		return s.putFile(r, fullPath, fileURL(prefix, fileName))
+	case http.MethodPatch:
+		return s.appendFile(r, fullPath)
 	case http.MethodPost:
-		err := os.WriteFile(fullPath, r.Body, 0644)
+		if resp := checkUnmodifiedSince(r, fullPath); resp != nil {
+			return resp
+		}
+		if r.Query().Get("mode") == "append" {
+			return s.appendFile(r, fullPath)
+		}
+		_, statErr := os.Stat(fullPath)
+		existed := statErr == nil
+
+		if err := s.makeParentDirs(fullPath); err != nil {
+			return NewResponse(http.StatusInternalServerError, "Internal Server Error", []byte(err.Error()))
+		}
+		err := writeFileAtomic(fullPath, r.Body, s.config.Load().fileMode())
 		if err != nil {
 			return NewResponse(http.StatusInternalServerError, "Internal Server Error", []byte(err.Error()))
 		}
-		return NewResponse(http.StatusCreated, "Created", nil)
+		// Overwriting is not creating, REST clients only expect a Location for new resources
+		if existed {
+			return NewResponse(http.StatusOK, "OK", nil)
+		}
+		resp := NewResponse(http.StatusCreated, "Created", nil)
+		resp.SetHeader("Location", fileURL(prefix, fileName))
+		return resp
 	default:
 		return NewResponse(http.StatusMethodNotAllowed, "Method Not Allowed", nil)
 	}
 }
+
+/*
+   PUT with preconditions (optimistic concurrency):
+
+     If-None-Match: *        → only create, 412 if the file already exists
+     If-Match: "<etag>"      → only overwrite the version the client has seen,
+                               412 if someone else changed the file meanwhile
+
+   Client flow:
+     GET  /files/a.txt                      ← ETag: "5-17a3f..."
+     PUT  /files/a.txt  If-Match: "5-17a3f..."
+          → 200 OK if unchanged, 412 Precondition Failed if modified
+*/
+func (s *Server) putFile(r *Request, fullPath, location string) *Response {
+	info, statErr := os.Stat(fullPath)
+	exists := statErr == nil
+	if statErr != nil && !os.IsNotExist(statErr) {
+		return NewResponse(http.StatusInternalServerError, "Internal Server Error", []byte(statErr.Error()))
+	}
+	if exists && info.IsDir() {
+		return NewResponse(http.StatusConflict, "Conflict", []byte("Target is a directory"))
+	}
+
+	if match, ok := r.GetHeader("If-None-Match"); ok && exists {
+		if match == "*" || etagListContains(match, fileETag(info)) {
+			return NewResponse(http.StatusPreconditionFailed, "Precondition Failed", []byte("File already exists"))
+		}
+	}
+	if match, ok := r.GetHeader("If-Match"); ok {
+		if !exists || (match != "*" && !etagListContains(match, fileETag(info))) {
+			return NewResponse(http.StatusPreconditionFailed, "Precondition Failed", []byte("File has been modified"))
+		}
+	}
+
+	if resp := checkUnmodifiedSince(r, fullPath); resp != nil {
+		return resp
+	}
+
+	if err := s.makeParentDirs(fullPath); err != nil {
+		return NewResponse(http.StatusInternalServerError, "Internal Server Error", []byte(err.Error()))
+	}
+	if err := writeFileAtomic(fullPath, r.Body, s.config.Load().fileMode()); err != nil {
+		return NewResponse(http.StatusInternalServerError, "Internal Server Error", []byte(err.Error()))
+	}
+
+	resp := NewResponse(http.StatusOK, "OK", nil)
+	if !exists {
+		resp = NewResponse(http.StatusCreated, "Created", nil)
+		resp.SetHeader("Location", location)
+	}
+	if info, err := os.Stat(fullPath); err == nil {
+		resp.SetHeader("ETag", fileETag(info))
+	}
+	return resp
+}
+
+/*
+   If-Unmodified-Since, the date flavour of If-Match:
+
+     GET  /files/a.txt                       ← Last-Modified / mtime 10:00:00
+     PUT  /files/a.txt  If-Unmodified-Since: Wed, 14 Oct 2026 10:00:00 GMT
+          → written if nobody touched the file since, 412 if it changed at 10:00:05
+
+   If-Match is the stronger check, when both are sent If-Unmodified-Since is
+   ignored (RFC 9110 §13.2.2), and so is a date that doesn't parse.
+*/
+
+// checkUnmodifiedSince returns a 412 response if the file at fullPath changed
+// after the request's If-Unmodified-Since date, nil if the write may go ahead
+func checkUnmodifiedSince(r *Request, fullPath string) *Response {
+	header, ok := r.GetHeader("If-Unmodified-Since")
+	if !ok {
+		return nil
+	}
+	if _, hasMatch := r.GetHeader("If-Match"); hasMatch {
+		return nil
+	}
+	date, err := http.ParseTime(header)
+	if err != nil {
+		return nil
+	}
+	info, err := os.Stat(fullPath)
+	if err != nil {
+		return nil // nothing there yet that could have changed
+	}
+	// HTTP dates have second precision
+	if info.ModTime().Truncate(time.Second).After(date) {
+		return NewResponse(http.StatusPreconditionFailed, "Precondition Failed", []byte("File has been modified"))
+	}
+	return nil
+}
+
+// makeParentDirs creates the missing directories of an upload target, "/files/a/b/c.txt" → a/b.
+// fullPath has already passed the traversal checks, so its parents are inside the root too.
+func (s *Server) makeParentDirs(fullPath string) error {
+	return os.MkdirAll(filepath.Dir(fullPath), s.config.Load().dirMode())
+}
+
+/*
+   Uploads replace the target in one step:
+
+     write  /files/.a.txt.tmp-51d9...   ← same directory, so same filesystem
+     fsync                              ← the data is on disk before the name is
+     rename .a.txt.tmp-51d9... → a.txt  ← atomic, readers see old or new, never half
+
+   A GET racing a 50 MB upload gets the previous file, and a crash mid-write
+   leaves at most a stray temp file, never a truncated a.txt.
+*/
+
+// writeFileAtomic is os.WriteFile through a temp file renamed into place.
+// The temp file is removed if anything fails.
+func writeFileAtomic(path string, data []byte, mode os.FileMode) (err error) {
+	tmpPath := filepath.Join(filepath.Dir(path), fmt.Sprintf(".%s.tmp-%x", filepath.Base(path), rand.Uint64()))
+	// O_EXCL: never write through a file (or symlink) someone else put there
+	file, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			file.Close()
+			os.Remove(tmpPath)
+		}
+	}()
+
+	if _, err = file.Write(data); err != nil {
+		return err
+	}
+	if err = file.Sync(); err != nil {
+		return err
+	}
+	if err = file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// fileURL is the URL a cleaned file name is served under, e.g. "/files/a/b.txt".
+// Request paths are used undecoded, so the name is already in URL form.
+func fileURL(prefix, fileName string) string {
+	return prefix + filepath.ToSlash(fileName)
+}
+
+// appendFile adds the request body to the end of the file, creating it if needed
+func (s *Server) appendFile(r *Request, fullPath string) *Response {
+	if err := s.makeParentDirs(fullPath); err != nil {
+		return NewResponse(http.StatusInternalServerError, "Internal Server Error", []byte(err.Error()))
+	}
+
+	// O_APPEND makes every write land at the current end of file, even
+	// when several requests append to the same file concurrently
+	file, err := os.OpenFile(fullPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, s.config.Load().fileMode())
+	if err != nil {
+		return NewResponse(http.StatusInternalServerError, "Internal Server Error", []byte(err.Error()))
+	}
+	defer file.Close()
+
+	if _, err := file.Write(r.Body); err != nil {
+		return NewResponse(http.StatusInternalServerError, "Internal Server Error", []byte(err.Error()))
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return NewResponse(http.StatusInternalServerError, "Internal Server Error", []byte(err.Error()))
+	}
+
+	resp := NewResponse(http.StatusOK, "OK", nil)
+	resp.SetHeader("X-File-Size", strconv.FormatInt(info.Size(), 10))
+	return resp
+}
+
+// setCacheHeaders lets clients reuse a served file for Config.StaticMaxAge.
+// Expires says the same as max-age for HTTP/1.0 caches, which only know Expires.
+func (s *Server) setCacheHeaders(resp *Response) {
+	if s.config.Load().StaticMaxAge <= 0 {
+		return
+	}
+	resp.SetHeader("Cache-Control", fmt.Sprintf("public, max-age=%d", int64(s.config.Load().StaticMaxAge.Seconds())))
+	resp.SetHeader("Expires", time.Now().Add(s.config.Load().StaticMaxAge).UTC().Format(http.TimeFormat))
+}
+
+// fileContentType picks the Content-Type of a served file from its extension,
+// "notes.txt" → "text/plain; charset=utf-8". Without a known extension the
+// content is sniffed if Config.SniffContentType is set, otherwise (or if the
+// file can't be read) Config.DefaultFileContentType is used.
+func (s *Server) fileContentType(path string) string {
+	if contentType := mime.TypeByExtension(filepath.Ext(path)); contentType != "" {
+		return contentType
+	}
+	if s.config.Load().SniffContentType {
+		if contentType, err := sniffContentType(path); err == nil {
+			return contentType
+		}
+	}
+	return s.config.Load().defaultFileContentType()
+}
+
+// sniffContentType guesses the type from the first 512 bytes the way browsers
+// do (http.DetectContentType), e.g. "<!DOCTYPE html>..." → "text/html; charset=utf-8"
+func sniffContentType(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	buf := make([]byte, 512)
+	n, err := io.ReadFull(file, buf)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return "", err
+	}
+	return http.DetectContentType(buf[:n]), nil
+}
+
+/*
+   Pre-compressed sidecars:
+
+     /files/app.js       300 KB
+     /files/app.js.gz     80 KB   ← gzip -k app.js, done once at deploy time
+
+     GET /files/app.js  Accept-Encoding: gzip
+     → the bytes of app.js.gz, Content-Encoding: gzip, Content-Type of app.js
+
+   The best gzip level costs nothing per request this way, and large assets
+   aren't compressed over and over by processCommonHeaders.
+*/
+
+// serveGzipSidecar answers with fullPath+".gz" when the client accepts gzip
+// and the sidecar exists, nil otherwise
+func (s *Server) serveGzipSidecar(r *Request, fullPath, root, contentType string) *Response {
+	// With gzip out of CompressionPreference, nothing is sent compressed
+	if !slices.Contains(s.config.Load().compressionPreference(), "gzip") {
+		return nil
+	}
+	accept, ok := r.GetHeader("Accept-Encoding")
+	if !ok || acceptEncodingWeight(accept, "gzip") == 0 {
+		return nil
+	}
+	gzPath := fullPath + ".gz"
+	info, err := os.Stat(gzPath)
+	if err != nil || info.IsDir() || checkInsideDir(gzPath, root) != nil {
+		return nil
+	}
+
+	resp := NewResponse(http.StatusOK, "OK", nil)
+	if info.Size() > streamFileThreshold {
+		file, err := os.Open(gzPath)
+		if err != nil {
+			return nil
+		}
+		resp.BodyReader = file
+		resp.SetHeader("Content-Length", strconv.FormatInt(info.Size(), 10))
+	} else {
+		body, err := s.readFile(gzPath)
+		if err != nil {
+			return nil
+		}
+		resp.Body = body
+	}
+	resp.SetHeader("Content-Type", contentType)
+	resp.SetHeader("Content-Encoding", "gzip")
+	resp.AddVary("Accept-Encoding")
+	// The sidecar's own validator: the gzip bytes are a different representation than the file's
+	resp.SetHeader("ETag", fileETag(info))
+	s.setCacheHeaders(resp)
+	return resp
+}
+
+/*
+   Downloads: GET /files/report.pdf?download=1
+
+     Content-Disposition: attachment; filename="report.pdf"
+
+   makes the browser save the file instead of showing it. A non-ASCII name
+   can't go in the quoted filename, so it also gets the RFC 5987 form,
+   which browsers prefer; older ones fall back to the ASCII approximation:
+
+     Content-Disposition: attachment; filename="r_sum_.pdf"; filename*=UTF-8''r%C3%A9sum%C3%A9.pdf
+*/
+
+// setDisposition marks resp as a download of the file at path when the client asked for one
+func setDisposition(r *Request, resp *Response, path string) {
+	if r.Query().Get("download") != "1" {
+		return
+	}
+	resp.SetHeader("Content-Disposition", attachmentDisposition(filepath.Base(path)))
+}
+
+// attachmentDisposition builds the Content-Disposition value for a download named name
+func attachmentDisposition(name string) string {
+	var ascii strings.Builder
+	plain := true
+	for _, c := range name {
+		switch {
+		case c >= 0x80 || c < 0x20 || c == 0x7f:
+			ascii.WriteByte('_')
+			plain = false
+		case c == '"' || c == '\\':
+			ascii.WriteString("\\" + string(c))
+		default:
+			ascii.WriteRune(c)
+		}
+	}
+
+	value := `attachment; filename="` + ascii.String() + `"`
+	if !plain {
+		value += "; filename*=UTF-8''" + url.PathEscape(name)
+	}
+	return value
+}
+
+// fileETag derives a validator from size and modification time, like nginx does.
+// It changes whenever the file is rewritten without having to hash its content.
+func fileETag(info os.FileInfo) string {
+	return fmt.Sprintf("\"%x-%x\"", info.Size(), info.ModTime().UnixNano())
+}
+
+// etagListContains reports whether a header like `"a", W/"b"` lists etag
+func etagListContains(header, etag string) bool {
+	for candidate := range strings.SplitSeq(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// readFile goes through the file cache when Config.FileCacheBytes enables it
+func (s *Server) readFile(path string) ([]byte, error) {
+	if s.fileCache != nil {
+		return s.fileCache.ReadFile(path)
+	}
+	return os.ReadFile(path)
+}
+
+/*
+   checkInsideDir returns a 400 response if path resolves outside of dir, nil if it is safe
+
+   Why not strings.HasPrefix(absFullPath, absDir)?
+     absDir      = "/data"
+     absFullPath = "/data-secret/passwords.txt"
+     HasPrefix → true ✗ (a sibling directory sharing the name prefix)
+
+   filepath.Rel("/data", "/data-secret/passwords.txt") → "../data-secret/passwords.txt"
+     Anything starting with ".." lives outside the root ✓
+
+   Symlinks:
+     /data/link → /etc, request "link/passwd"
+     The lexical path "/data/link/passwd" looks fine, so both paths are
+     resolved with EvalSymlinks first and the check runs on the real locations.
+*/
+func checkInsideDir(path, dir string) *Response {
+	realDir, err := resolvePath(dir)
+	if err != nil {
+		return NewResponse(http.StatusInternalServerError, "Internal Server Error", []byte(err.Error()))
+	}
+	realPath, err := resolvePath(path)
+	if err != nil {
+		return NewResponse(http.StatusInternalServerError, "Internal Server Error", []byte(err.Error()))
+	}
+
+	rel, err := filepath.Rel(realDir, realPath)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(os.PathSeparator)) {
+		return NewResponse(http.StatusBadRequest, "Bad Request", []byte("path traversal detected"))
+	}
+	return nil
+}
+
+// resolvePath returns the absolute, symlink-free form of path.
+// Upload targets may not exist yet, so only the longest existing prefix is resolved
+// and the missing tail is appended unchanged.
+func resolvePath(path string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+
+	existing, missing := abs, ""
+	for {
+		resolved, err := filepath.EvalSymlinks(existing)
+		if err == nil {
+			return filepath.Join(resolved, missing), nil
+		}
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+		parent := filepath.Dir(existing)
+		if parent == existing {
+			return abs, nil // Nothing exists, not even the root
+		}
+		missing = filepath.Join(filepath.Base(existing), missing)
+		existing = parent
+	}
+}
+
+// listDirectory renders the entries of dir as an HTML page of links.
+// urlPath is the URL the directory is served under, e.g. "/files/sub".
+func listDirectory(urlPath, dir string) *Response {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return NewResponse(http.StatusInternalServerError, "Internal Server Error", []byte(err.Error()))
+	}
+
+	// Same "no dot-files" rule as for file requests
+	entries = slices.DeleteFunc(entries, func(e os.DirEntry) bool {
+		return strings.HasPrefix(e.Name(), ".")
+	})
+	// ReadDir already sorts by name, directories are only marked, not grouped
+
+	urlPath = strings.TrimSuffix(urlPath, "/") + "/"
+	var b strings.Builder
+	title := html.EscapeString(urlPath)
+	fmt.Fprintf(&b, "<!DOCTYPE html>\n<html><head><title>Index of %s</title></head><body>\n<h1>Index of %s</h1>\n<ul>\n", title, title)
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() {
+			name += "/"
+		}
+		// Absolute links work for "/files/sub" and "/files/sub/" alike
+		href := urlPath + url.PathEscape(entry.Name())
+		if entry.IsDir() {
+			href += "/"
+		}
+		fmt.Fprintf(&b, "<li><a href=\"%s\">%s</a></li>\n", html.EscapeString(href), html.EscapeString(name))
+	}
+	b.WriteString("</ul>\n</body></html>\n")
+
+	resp := NewResponse(http.StatusOK, "OK", []byte(b.String()))
+	resp.SetHeader("Content-Type", "text/html; charset=utf-8")
+	return resp
+}
@@ -0,0 +1,808 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// filesServer serves a temporary directory under /files/, seeded with files
+func filesServer(t *testing.T, config Config, files map[string]string) (*Server, string) {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		writeTestFile(t, dir, name, content)
+	}
+	config.Directory = dir
+	s, _ := startTestServer(t, config)
+	return s, dir
+}
+
+// writeTestFile creates dir/name, and the directories above it
+func writeTestFile(t *testing.T, dir, name, content string) {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHeadFile(t *testing.T) {
+	s, _ := filesServer(t, testConfig(), map[string]string{"a.txt": "hello world"})
+
+	conn, r := dial(t, s)
+	io.WriteString(conn, "HEAD /files/a.txt HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	resp, body := readResponse(t, r, http.MethodHead)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("HEAD: got %d, want 200", resp.StatusCode)
+	}
+	if body != "" {
+		t.Errorf("HEAD: got body %q", body)
+	}
+	if resp.ContentLength != int64(len("hello world")) {
+		t.Errorf("HEAD Content-Length: got %d, want %d", resp.ContentLength, len("hello world"))
+	}
+	for _, name := range []string{"ETag", "Accept-Ranges", "Content-Type"} {
+		if resp.Header.Get(name) == "" {
+			t.Errorf("HEAD: missing %s", name)
+		}
+	}
+
+	// No body was sent, so the next response starts right after the headers
+	io.WriteString(conn, "GET /files/a.txt HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	resp, body = readResponse(t, r, http.MethodGet)
+	if resp.StatusCode != http.StatusOK || body != "hello world" {
+		t.Errorf("GET after HEAD: got %d %q", resp.StatusCode, body)
+	}
+}
+
+func TestHeadMissingFile(t *testing.T) {
+	s, _ := filesServer(t, testConfig(), nil)
+	if resp, _ := get(t, s, http.MethodHead, "/files/missing.txt"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("HEAD missing file: got %d, want 404", resp.StatusCode)
+	}
+}
+
+func TestServerOptions(t *testing.T) {
+	s, _ := newTestServer(t, testConfig())
+	s.router.RegisterExactRoute("/any", okHandler)
+	start(t, s)
+
+	resp, _ := roundTrip(t, s, "OPTIONS * HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("OPTIONS *: got %d, want 204", resp.StatusCode)
+	}
+	// /any lets DELETE through, but doesn't declare that it implements it
+	if got, want := resp.Header.Get("Allow"), "GET, HEAD, OPTIONS, PATCH, POST, PUT"; got != want {
+		t.Errorf("Allow: got %q, want %q", got, want)
+	}
+	if got := resp.Header.Get("Accept-Ranges"); got != "bytes" {
+		t.Errorf("Accept-Ranges: got %q, want the bytes capability hint", got)
+	}
+
+	// Only the asterisk form is server-wide, OPTIONS on a path goes to its route
+	if resp, body := roundTrip(t, s, "OPTIONS /any HTTP/1.1\r\nHost: localhost\r\n\r\n"); resp.StatusCode != http.StatusOK || body != "ok" {
+		t.Errorf("OPTIONS /any: got %d %q, want the route's answer", resp.StatusCode, body)
+	}
+	if resp, _ := roundTrip(t, s, "GET * HTTP/1.1\r\nHost: localhost\r\n\r\n"); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("GET *: got %d, want 400", resp.StatusCode)
+	}
+}
+
+func TestServerOptionsDeclaredMethods(t *testing.T) {
+	config := testConfig()
+	config.EnableTrace = true
+	s, _ := newTestServer(t, config)
+	s.VirtualHost("api.example.com").RegisterExactRoute("/items", okHandler, WithMethods(http.MethodDelete))
+	start(t, s)
+
+	resp, _ := roundTrip(t, s, "OPTIONS * HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	if got, want := resp.Header.Get("Allow"), "DELETE, GET, HEAD, OPTIONS, PATCH, POST, PUT, TRACE"; got != want {
+		t.Errorf("Allow: got %q, want %q", got, want)
+	}
+}
+
+func TestDirListing(t *testing.T) {
+	config := testConfig()
+	config.EnableDirListing = true
+	s, _ := filesServer(t, config, map[string]string{
+		"b.txt":          "b",
+		"a.txt":          "a",
+		".secret":        "hidden",
+		"sub/nested.txt": "n",
+		"sub/.env":       "hidden",
+	})
+
+	resp, body := get(t, s, http.MethodGet, "/files/")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /files/: got %d", resp.StatusCode)
+	}
+	if got := resp.Header.Get("Content-Type"); got != "text/html; charset=utf-8" {
+		t.Errorf("Content-Type: got %q", got)
+	}
+	a := strings.Index(body, `<a href="/files/a.txt">a.txt</a>`)
+	b := strings.Index(body, `<a href="/files/b.txt">b.txt</a>`)
+	sub := strings.Index(body, `<a href="/files/sub/">sub/</a>`)
+	if a < 0 || b < 0 || sub < 0 || !(a < b && b < sub) {
+		t.Errorf("root listing not sorted by name with sub/ marked:\n%s", body)
+	}
+	if strings.Contains(body, ".secret") {
+		t.Errorf("root listing shows a dot-file:\n%s", body)
+	}
+
+	// With or without the trailing slash
+	for _, target := range []string{"/files/sub/", "/files/sub"} {
+		resp, body := get(t, s, http.MethodGet, target)
+		if resp.StatusCode != http.StatusOK || !strings.Contains(body, `<a href="/files/sub/nested.txt">nested.txt</a>`) {
+			t.Errorf("GET %s: got %d\n%s", target, resp.StatusCode, body)
+		}
+		if strings.Contains(body, ".env") {
+			t.Errorf("GET %s shows a dot-file:\n%s", target, body)
+		}
+	}
+
+	for _, target := range []string{"/files/sub/../..", "/files/../", "/files/.git/"} {
+		if resp, _ := get(t, s, http.MethodGet, target); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("GET %s: got %d, want 400", target, resp.StatusCode)
+		}
+	}
+}
+
+func TestDirListingDisabled(t *testing.T) {
+	s, _ := filesServer(t, testConfig(), map[string]string{"sub/a.txt": "a"})
+	if resp, _ := get(t, s, http.MethodGet, "/files/"); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("GET /files/ by default: got %d, want 400", resp.StatusCode)
+	}
+}
+
+func TestDirectoryIndex(t *testing.T) {
+	// index.html is the default, testConfig leaves DirectoryIndex unset
+	s, _ := filesServer(t, testConfig(), map[string]string{
+		"site/index.html": "<h1>home</h1>",
+		"empty/a.txt":     "a",
+	})
+
+	for _, target := range []string{"/files/site/", "/files/site"} {
+		resp, body := get(t, s, http.MethodGet, target)
+		if resp.StatusCode != http.StatusOK || body != "<h1>home</h1>" {
+			t.Errorf("GET %s: got %d %q, want the index file", target, resp.StatusCode, body)
+		}
+		if got := resp.Header.Get("Content-Type"); got != "text/html; charset=utf-8" {
+			t.Errorf("GET %s: Content-Type %q", target, got)
+		}
+	}
+	// No index and no listing, as before index files
+	if resp, _ := get(t, s, http.MethodGet, "/files/empty/"); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("GET a directory without index: got %d, want 400", resp.StatusCode)
+	}
+}
+
+func TestDirectoryIndexDisabled(t *testing.T) {
+	config := testConfig()
+	config.DirectoryIndex = new(string)
+	s, _ := filesServer(t, config, map[string]string{"site/index.html": "<h1>home</h1>"})
+	if resp, body := get(t, s, http.MethodGet, "/files/site/"); resp.StatusCode == http.StatusOK {
+		t.Errorf("GET a directory with index files disabled: got 200 %q", body)
+	}
+	if resp, _ := get(t, s, http.MethodGet, "/files/"); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("GET /files/ with index files disabled: got %d, want 400", resp.StatusCode)
+	}
+}
+
+func TestDirectoryIndexOutsideRoot(t *testing.T) {
+	outside := t.TempDir()
+	writeTestFile(t, outside, "index.html", "secret")
+	s, dir := filesServer(t, testConfig(), nil)
+	if err := os.Mkdir(filepath.Join(dir, "site"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	// The index resolves outside the served directory through a symlink
+	if err := os.Symlink(filepath.Join(outside, "index.html"), filepath.Join(dir, "site", "index.html")); err != nil {
+		t.Skip(err)
+	}
+	if resp, body := get(t, s, http.MethodGet, "/files/site/"); resp.StatusCode == http.StatusOK || body == "secret" {
+		t.Errorf("symlinked index: got %d %q", resp.StatusCode, body)
+	}
+}
+
+func TestMountDir(t *testing.T) {
+	data, public := t.TempDir(), t.TempDir()
+	writeTestFile(t, data, "app.css", "from data")
+	writeTestFile(t, public, "app.css", "from public")
+	writeTestFile(t, data, "only-data.txt", "x")
+
+	config := testConfig()
+	config.Directory = data
+	s, _ := newTestServer(t, config)
+	s.MountDir("/static/", public)
+	start(t, s)
+
+	for target, want := range map[string]string{"/files/app.css": "from data", "/static/app.css": "from public"} {
+		if resp, body := get(t, s, http.MethodGet, target); resp.StatusCode != http.StatusOK || body != want {
+			t.Errorf("GET %s: got %d %q, want %q", target, resp.StatusCode, body, want)
+		}
+	}
+	// Each mount is confined to its own root
+	if resp, _ := get(t, s, http.MethodGet, "/static/only-data.txt"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("a data file through /static/: got %d, want 404", resp.StatusCode)
+	}
+	if resp, _ := get(t, s, http.MethodGet, "/static/../files/app.css"); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("traversal out of /static/: got %d, want 400", resp.StatusCode)
+	}
+}
+
+func TestLargeFileStreams(t *testing.T) {
+	const size = 8 << 20
+	content := bytes.Repeat([]byte("0123456789abcdef"), size/16)
+	s, _ := filesServer(t, testConfig(), map[string]string{"big.bin": string(content)})
+
+	// Over streamFileThreshold the handler hands out the open file, not its content
+	resp := s.handleFiles(newTestRequest(http.MethodGet, "/files/big.bin", nil, ""), "/files/", s.config.Load().Directory)
+	if _, ok := resp.BodyReader.(*os.File); !ok || resp.Body != nil {
+		t.Fatalf("BodyReader %T with a %d byte Body, want an *os.File and no Body", resp.BodyReader, len(resp.Body))
+	}
+	dropBody(resp)
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+
+	conn, r := dial(t, s)
+	io.WriteString(conn, "GET /files/big.bin HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	httpResp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.New()
+	n, err := io.Copy(sum, httpResp.Body)
+	httpResp.Body.Close()
+
+	runtime.ReadMemStats(&after)
+	if err != nil || n != size || httpResp.ContentLength != size {
+		t.Fatalf("download: %d of %d bytes (Content-Length %d), %v", n, size, httpResp.ContentLength, err)
+	}
+	if want := sha256.Sum256(content); !bytes.Equal(sum.Sum(nil), want[:]) {
+		t.Error("downloaded content differs from the file")
+	}
+	// Reading the file into memory would allocate at least its size
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > size/4 {
+		t.Errorf("serving %d bytes allocated %d bytes", size, allocated)
+	}
+}
+
+func TestPutFileConditional(t *testing.T) {
+	s, dir := filesServer(t, testConfig(), nil)
+
+	// Create-only
+	resp, _ := sendBody(t, s, http.MethodPut, "/files/a.txt", []byte("v1"), "If-None-Match: *")
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("create: got %d, want 201", resp.StatusCode)
+	}
+	etag := resp.Header.Get("ETag")
+	if etag == "" {
+		t.Fatal("create: no ETag")
+	}
+	if resp, _ := sendBody(t, s, http.MethodPut, "/files/a.txt", []byte("v2"), "If-None-Match: *"); resp.StatusCode != http.StatusPreconditionFailed {
+		t.Errorf("create-only over an existing file: got %d, want 412", resp.StatusCode)
+	}
+
+	// Overwrite guarded by the ETag
+	if resp, _ := sendBody(t, s, http.MethodPut, "/files/a.txt", []byte("v2"), `If-Match: "stale"`); resp.StatusCode != http.StatusPreconditionFailed {
+		t.Errorf("If-Match with a stale ETag: got %d, want 412", resp.StatusCode)
+	}
+	if resp, _ := sendBody(t, s, http.MethodPut, "/files/new.txt", []byte("v1"), "If-Match: *"); resp.StatusCode != http.StatusPreconditionFailed {
+		t.Errorf("If-Match on a missing file: got %d, want 412", resp.StatusCode)
+	}
+	if content, _ := os.ReadFile(filepath.Join(dir, "a.txt")); string(content) != "v1" {
+		t.Fatalf("a failed precondition wrote the file: %q", content)
+	}
+
+	resp, _ = sendBody(t, s, http.MethodPut, "/files/a.txt", []byte("version 2"), "If-Match: "+etag)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("conditional update: got %d, want 200", resp.StatusCode)
+	}
+	if got := resp.Header.Get("ETag"); got == "" || got == etag {
+		t.Errorf("conditional update: ETag %q, want a new one", got)
+	}
+	if content, _ := os.ReadFile(filepath.Join(dir, "a.txt")); string(content) != "version 2" {
+		t.Errorf("after update: %q", content)
+	}
+}
+
+func TestAppendFile(t *testing.T) {
+	s, dir := filesServer(t, testConfig(), nil)
+
+	resp, _ := sendBody(t, s, http.MethodPatch, "/files/logs/app.log", []byte("line 1\n"))
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("X-File-Size") != "7" {
+		t.Fatalf("PATCH: got %d, X-File-Size %q", resp.StatusCode, resp.Header.Get("X-File-Size"))
+	}
+	resp, _ = postBody(t, s, "/files/logs/app.log?mode=append", []byte("line 2\n"))
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("X-File-Size") != "14" {
+		t.Fatalf("POST ?mode=append: got %d, X-File-Size %q", resp.StatusCode, resp.Header.Get("X-File-Size"))
+	}
+	if content, _ := os.ReadFile(filepath.Join(dir, "logs", "app.log")); string(content) != "line 1\nline 2\n" {
+		t.Errorf("appended file: %q", content)
+	}
+
+	if resp, _ := sendBody(t, s, http.MethodPatch, "/files/../escape.log", []byte("x")); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("PATCH outside the directory: got %d, want 400", resp.StatusCode)
+	}
+	if resp, _ := roundTrip(t, s, "PATCH /files/big.log HTTP/1.1\r\nHost: localhost\r\nContent-Length: 99999999999\r\n\r\n"); resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("PATCH over the size limit: got %d, want 413", resp.StatusCode)
+	}
+}
+
+func TestPostFileCreateOrOverwrite(t *testing.T) {
+	s, _ := filesServer(t, testConfig(), nil)
+
+	resp, _ := postBody(t, s, "/files/report.txt", []byte("first"))
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("first POST: got %d, want 201", resp.StatusCode)
+	}
+	if got := resp.Header.Get("Location"); got != "/files/report.txt" {
+		t.Errorf("first POST: Location %q, want /files/report.txt", got)
+	}
+
+	resp, _ = postBody(t, s, "/files/report.txt", []byte("second"))
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("overwrite: got %d, want 200", resp.StatusCode)
+	}
+	if got := resp.Header.Get("Location"); got != "" {
+		t.Errorf("overwrite: Location %q, want none", got)
+	}
+	if _, body := get(t, s, http.MethodGet, "/files/report.txt"); body != "second" {
+		t.Errorf("after overwrite: %q", body)
+	}
+}
+
+func TestPostFileNestedPath(t *testing.T) {
+	s, dir := filesServer(t, testConfig(), nil)
+
+	resp, _ := postBody(t, s, "/files/a/b/c.txt", []byte("deep"))
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("POST /files/a/b/c.txt: got %d, want 201", resp.StatusCode)
+	}
+	if info, err := os.Stat(filepath.Join(dir, "a", "b")); err != nil || !info.IsDir() {
+		t.Fatalf("a/b was not created: %v", err)
+	}
+	if content, _ := os.ReadFile(filepath.Join(dir, "a", "b", "c.txt")); string(content) != "deep" {
+		t.Errorf("a/b/c.txt: %q", content)
+	}
+
+	// The directory components can't climb out either, not even through a symlinked directory
+	outside := t.TempDir()
+	if err := os.Symlink(outside, filepath.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+	for _, target := range []string{"/files/a/../../x/y.txt", "/files/link/new/y.txt"} {
+		if resp, _ := postBody(t, s, target, []byte("x")); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("POST %s: got %d, want 400", target, resp.StatusCode)
+		}
+	}
+	if entries, _ := os.ReadDir(outside); len(entries) != 0 {
+		t.Errorf("directories were created outside the root: %v", entries)
+	}
+}
+
+func TestCheckInsideDir(t *testing.T) {
+	base := t.TempDir()
+	dir := filepath.Join(base, "data")
+	writeTestFile(t, dir, "ok.txt", "ok")
+	writeTestFile(t, base, "data-secret/key", "secret")
+
+	for _, tc := range []struct {
+		path   string
+		inside bool
+	}{
+		{filepath.Join(dir, "ok.txt"), true},
+		{filepath.Join(dir, "not/yet/created.txt"), true},
+		{dir, true},
+		{filepath.Join(base, "data-secret", "key"), false}, // shares the "data" prefix
+		{filepath.Join(base, "data-secret"), false},
+		{base, false},
+	} {
+		if got := checkInsideDir(tc.path, dir) == nil; got != tc.inside {
+			t.Errorf("checkInsideDir(%s): inside %v, want %v", tc.path, got, tc.inside)
+		}
+	}
+}
+
+func TestSymlinkEscape(t *testing.T) {
+	outside := t.TempDir()
+	writeTestFile(t, outside, "secret.txt", "secret")
+	s, dir := filesServer(t, testConfig(), map[string]string{"real.txt": "real"})
+	if err := os.Symlink(filepath.Join(outside, "secret.txt"), filepath.Join(dir, "link.txt")); err != nil {
+		t.Fatal(err)
+	}
+	// A symlink that stays inside is fine
+	if err := os.Symlink(filepath.Join(dir, "real.txt"), filepath.Join(dir, "alias.txt")); err != nil {
+		t.Fatal(err)
+	}
+
+	if resp, body := get(t, s, http.MethodGet, "/files/link.txt"); resp.StatusCode != http.StatusBadRequest || body == "secret" {
+		t.Errorf("symlink out of the root: got %d %q, want 400", resp.StatusCode, body)
+	}
+	if resp, body := get(t, s, http.MethodGet, "/files/alias.txt"); resp.StatusCode != http.StatusOK || body != "real" {
+		t.Errorf("symlink inside the root: got %d %q", resp.StatusCode, body)
+	}
+}
+
+func TestTrace(t *testing.T) {
+	config := testConfig()
+	config.EnableTrace = true
+	s, _ := startTestServer(t, config)
+
+	resp, body := get(t, s, http.MethodTrace, "/anything?x=1", "X-Custom: 42", "Authorization: Bearer secret", "Cookie: session=abc")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("TRACE: got %d, want 200", resp.StatusCode)
+	}
+	if got := resp.Header.Get("Content-Type"); got != "message/http" {
+		t.Errorf("Content-Type: got %q", got)
+	}
+	want := "TRACE /anything?x=1 HTTP/1.1\r\nHost: localhost\r\nX-Custom: 42\r\n\r\n"
+	if body != want {
+		t.Errorf("body:\ngot  %q\nwant %q (credentials left out)", body, want)
+	}
+}
+
+func TestTraceDisabled(t *testing.T) {
+	s, _ := startTestServer(t, testConfig())
+	if resp, body := get(t, s, http.MethodTrace, "/echo/x", "X-Custom: 42"); resp.StatusCode != http.StatusMethodNotAllowed || strings.Contains(body, "X-Custom") {
+		t.Errorf("TRACE by default: got %d %q, want 405", resp.StatusCode, body)
+	}
+}
+
+func TestStaticMaxAge(t *testing.T) {
+	config := testConfig()
+	config.StaticMaxAge = time.Hour
+	s, _ := filesServer(t, config, map[string]string{"app.css": "body{}"})
+
+	resp, _ := get(t, s, http.MethodGet, "/files/app.css")
+	if got := resp.Header.Get("Cache-Control"); got != "public, max-age=3600" {
+		t.Errorf("Cache-Control: got %q", got)
+	}
+	expires, err := http.ParseTime(resp.Header.Get("Expires"))
+	if err != nil {
+		t.Fatalf("Expires %q: %v", resp.Header.Get("Expires"), err)
+	}
+	if d := time.Until(expires); d < 59*time.Minute || d > time.Hour+time.Second {
+		t.Errorf("Expires is %v away, want an hour", d)
+	}
+
+	// Only files, never the dynamic routes
+	resp, _ = get(t, s, http.MethodGet, "/echo/x")
+	if resp.Header.Get("Cache-Control") != "" || resp.Header.Get("Expires") != "" {
+		t.Errorf("echo: Cache-Control %q, Expires %q", resp.Header.Get("Cache-Control"), resp.Header.Get("Expires"))
+	}
+}
+
+func TestStaticMaxAgeDisabled(t *testing.T) {
+	s, _ := filesServer(t, testConfig(), map[string]string{"app.css": "body{}"})
+	resp, _ := get(t, s, http.MethodGet, "/files/app.css")
+	if resp.Header.Get("Cache-Control") != "" || resp.Header.Get("Expires") != "" {
+		t.Errorf("by default: Cache-Control %q, Expires %q", resp.Header.Get("Cache-Control"), resp.Header.Get("Expires"))
+	}
+}
+
+func TestAcceptRanges(t *testing.T) {
+	config := testConfig()
+	config.Directory = t.TempDir()
+	writeTestFile(t, config.Directory, "a.txt", "hello world")
+	s, _ := newTestServer(t, config)
+	s.router.RegisterExactRoute("/live", func(r *Request) *Response {
+		resp := NewResponse(http.StatusOK, "OK", []byte("generated"))
+		resp.SetHeader("Accept-Ranges", "none")
+		return resp
+	})
+	start(t, s)
+
+	for _, tc := range []struct{ target, want string }{
+		{"/files/a.txt", "bytes"},
+		{"/echo/hi", ""},
+		{"/user-agent", ""},
+		{"/", ""},
+		{"/live", "none"}, // a handler's own answer is left alone
+	} {
+		resp, _ := get(t, s, http.MethodGet, tc.target, "User-Agent: probe")
+		if got := resp.Header.Get("Accept-Ranges"); got != tc.want {
+			t.Errorf("%s: Accept-Ranges %q, want %q", tc.target, got, tc.want)
+		}
+	}
+}
+
+func TestPostFileContentLengthCasing(t *testing.T) {
+	s, dir := filesServer(t, testConfig(), nil)
+
+	for i, name := range []string{"Content-Length", "content-length", "CONTENT-LENGTH", "cOnTeNt-LeNgTh"} {
+		file := fmt.Sprintf("f%d.txt", i)
+		resp, _ := roundTrip(t, s, "POST /files/"+file+" HTTP/1.1\r\nHost: localhost\r\n"+name+": 5\r\n\r\nhello")
+		if resp.StatusCode != http.StatusCreated {
+			t.Errorf("%s: got %d, want 201", name, resp.StatusCode)
+		}
+		if content, _ := os.ReadFile(filepath.Join(dir, file)); string(content) != "hello" {
+			t.Errorf("%s: file holds %q, want the body", name, content)
+		}
+	}
+
+	// Two lengths in different casing are still two lengths
+	resp, _ := roundTrip(t, s, "POST /files/dup.txt HTTP/1.1\r\nHost: localhost\r\nContent-Length: 5\r\ncontent-length: 6\r\n\r\nhello!")
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("conflicting Content-Length headers: got %d, want 400", resp.StatusCode)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "dup.txt")); err == nil {
+		t.Error("dup.txt was written")
+	}
+}
+
+func TestDefaultFileContentType(t *testing.T) {
+	files := map[string]string{"README": "plain words", "notes.txt": "more words"}
+
+	s, _ := filesServer(t, testConfig(), files)
+	if resp, _ := get(t, s, http.MethodGet, "/files/README"); resp.Header.Get("Content-Type") != "application/octet-stream" {
+		t.Errorf("extensionless by default: got %q", resp.Header.Get("Content-Type"))
+	}
+
+	config := testConfig()
+	config.DefaultFileContentType = "text/plain"
+	s, _ = filesServer(t, config, files)
+	for target, want := range map[string]string{
+		"/files/README":    "text/plain",
+		"/files/notes.txt": "text/plain; charset=utf-8", // a known extension still wins
+	} {
+		if resp, _ := get(t, s, http.MethodGet, target); resp.Header.Get("Content-Type") != want {
+			t.Errorf("%s: got %q, want %q", target, resp.Header.Get("Content-Type"), want)
+		}
+	}
+}
+
+func TestSniffContentType(t *testing.T) {
+	page := "<!DOCTYPE html><html><body>" + strings.Repeat("x", 1000) + "</body></html>"
+	files := map[string]string{"page": page, "data.bin2": "\x00\x01\x02"}
+
+	config := testConfig()
+	config.SniffContentType = true
+	s, _ := filesServer(t, config, files)
+	for target, want := range map[string]string{
+		"/files/page":      "text/html; charset=utf-8",
+		"/files/data.bin2": "application/octet-stream",
+	} {
+		if resp, _ := get(t, s, http.MethodGet, target); resp.Header.Get("Content-Type") != want {
+			t.Errorf("%s: got %q, want %q", target, resp.Header.Get("Content-Type"), want)
+		}
+	}
+
+	// The type comes from the start of the file, not the requested slice
+	resp, body := get(t, s, http.MethodGet, "/files/page", "Range: bytes=500-509")
+	if resp.StatusCode != http.StatusPartialContent || body != "xxxxxxxxxx" {
+		t.Fatalf("range: got %d %q", resp.StatusCode, body)
+	}
+	if got := resp.Header.Get("Content-Type"); got != "text/html; charset=utf-8" {
+		t.Errorf("range: Content-Type %q, want the whole file's", got)
+	}
+
+	s, _ = filesServer(t, testConfig(), files)
+	if resp, _ := get(t, s, http.MethodGet, "/files/page"); resp.Header.Get("Content-Type") != "application/octet-stream" {
+		t.Errorf("without SniffContentType: got %q", resp.Header.Get("Content-Type"))
+	}
+}
+
+func TestDownloadDisposition(t *testing.T) {
+	s, _ := filesServer(t, testConfig(), map[string]string{"report.pdf": "%PDF"})
+
+	resp, body := get(t, s, http.MethodGet, "/files/report.pdf?download=1")
+	if got := resp.Header.Get("Content-Disposition"); got != `attachment; filename="report.pdf"` || body != "%PDF" {
+		t.Errorf("?download=1: got %q with body %q", got, body)
+	}
+	for _, target := range []string{"/files/report.pdf", "/files/report.pdf?download=0"} {
+		if resp, _ := get(t, s, http.MethodGet, target); resp.Header.Get("Content-Disposition") != "" {
+			t.Errorf("%s: Content-Disposition %q, want the file served inline", target, resp.Header.Get("Content-Disposition"))
+		}
+	}
+}
+
+func TestAttachmentDisposition(t *testing.T) {
+	for name, want := range map[string]string{
+		"report.pdf":   `attachment; filename="report.pdf"`,
+		"résumé.pdf":   `attachment; filename="r_sum_.pdf"; filename*=UTF-8''r%C3%A9sum%C3%A9.pdf`,
+		"日本.txt":       `attachment; filename="__.txt"; filename*=UTF-8''%E6%97%A5%E6%9C%AC.txt`,
+		`say "hi".txt`: `attachment; filename="say \"hi\".txt"`,
+		"a b.txt":      `attachment; filename="a b.txt"`,
+	} {
+		if got := attachmentDisposition(name); got != want {
+			t.Errorf("%s:\ngot  %s\nwant %s", name, got, want)
+		}
+	}
+}
+
+func TestUploadPermissions(t *testing.T) {
+	config := testConfig()
+	// Modes the usual umask 022 leaves alone
+	config.FileMode, config.DirMode = 0600, 0700
+	s, dir := filesServer(t, config, nil)
+
+	for _, target := range []string{"/files/a.txt", "/files/sub/b.txt", "/files/c.log?mode=append"} {
+		if resp, _ := postBody(t, s, target, []byte("data")); resp.StatusCode >= 300 {
+			t.Fatalf("POST %s: got %d", target, resp.StatusCode)
+		}
+	}
+	for name, want := range map[string]os.FileMode{"a.txt": 0600, "sub/b.txt": 0600, "c.log": 0600, "sub": 0700 | os.ModeDir} {
+		info, err := os.Stat(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode() != want {
+			t.Errorf("%s: mode %v, want %v", name, info.Mode(), want)
+		}
+	}
+}
+
+func TestUploadPermissionsValidation(t *testing.T) {
+	for _, config := range []Config{
+		{FileMode: os.ModeSetuid | 0644},
+		{FileMode: os.ModeDir | 0755},
+		{DirMode: 0644}, // the server couldn't write into it
+		{DirMode: os.ModeSticky | 0755},
+	} {
+		if err := config.validate(); err == nil {
+			t.Errorf("FileMode %v, DirMode %v accepted", config.FileMode, config.DirMode)
+		}
+	}
+	if err := (Config{FileMode: 0660, DirMode: 0770}).validate(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAtomicUpload(t *testing.T) {
+	const size = 4 << 20
+	versions := []string{strings.Repeat("a", size), strings.Repeat("b", size)}
+	s, dir := filesServer(t, testConfig(), map[string]string{"big.bin": versions[0]})
+
+	// A reader polling the file while uploads replace it must only ever see a whole version
+	stop := make(chan struct{})
+	partial := make(chan string, 1)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			content, err := os.ReadFile(filepath.Join(dir, "big.bin"))
+			if err == nil && string(content) != versions[0] && string(content) != versions[1] {
+				select {
+				case partial <- fmt.Sprintf("%d bytes", len(content)):
+				default:
+				}
+			}
+		}
+	}()
+	for i := range 6 {
+		if resp, _ := postBody(t, s, "/files/big.bin", []byte(versions[(i+1)%2])); resp.StatusCode != http.StatusOK {
+			t.Fatalf("upload %d: got %d", i, resp.StatusCode)
+		}
+	}
+	close(stop)
+	<-done
+	select {
+	case seen := <-partial:
+		t.Errorf("a reader saw a partial file: %s", seen)
+	default:
+	}
+
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Errorf("left behind next to big.bin: %v", entries)
+	}
+}
+
+func TestWriteFileAtomicCleansUp(t *testing.T) {
+	dir := t.TempDir()
+	// Renaming a file over a non-empty directory fails after the data is written
+	target := filepath.Join(dir, "taken")
+	writeTestFile(t, target, "inside", "x")
+
+	if err := writeFileAtomic(target, []byte("data"), 0644); err == nil {
+		t.Fatal("replaced a directory")
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("temp file left behind: %v", entries)
+	}
+}
+
+func TestGzipSidecar(t *testing.T) {
+	original := string(compressibleText(500))
+	s, _ := filesServer(t, testConfig(), map[string]string{
+		"app.js":    original,
+		"app.js.gz": string(gzipBytes(t, []byte("// precompressed at deploy time"))),
+		"style.css": original, // no sidecar
+	})
+
+	resp, body := get(t, s, http.MethodGet, "/files/app.js", "Accept-Encoding: gzip")
+	if resp.Header.Get("Content-Encoding") != "gzip" {
+		t.Fatalf("with a sidecar: Content-Encoding %q", resp.Header.Get("Content-Encoding"))
+	}
+	if got := string(gunzip(t, []byte(body))); got != "// precompressed at deploy time" {
+		t.Errorf("with a sidecar: got %q, want the sidecar's content", got)
+	}
+	if got := resp.Header.Get("Content-Type"); got != "text/javascript; charset=utf-8" {
+		t.Errorf("with a sidecar: Content-Type %q, want app.js's", got)
+	}
+	if !headerHasToken(resp.Header.Get("Vary"), "Accept-Encoding") {
+		t.Errorf("with a sidecar: Vary %q", resp.Header.Get("Vary"))
+	}
+
+	// Without a sidecar the file is compressed on the fly
+	resp, body = get(t, s, http.MethodGet, "/files/style.css", "Accept-Encoding: gzip")
+	if resp.Header.Get("Content-Encoding") != "gzip" || string(gunzip(t, []byte(body))) != original {
+		t.Errorf("without a sidecar: Content-Encoding %q, %d bytes", resp.Header.Get("Content-Encoding"), len(body))
+	}
+
+	for name, headers := range map[string][]string{
+		"no Accept-Encoding": nil,
+		"gzip;q=0":           {"Accept-Encoding: gzip;q=0"},
+		"a range":            {"Accept-Encoding: gzip", "Range: bytes=0-"},
+	} {
+		resp, body := get(t, s, http.MethodGet, "/files/app.js", headers...)
+		if resp.Header.Get("Content-Encoding") != "" || body != original {
+			t.Errorf("%s: got Content-Encoding %q, want app.js itself", name, resp.Header.Get("Content-Encoding"))
+		}
+	}
+}
+
+func TestIfUnmodifiedSince(t *testing.T) {
+	s, dir := filesServer(t, testConfig(), map[string]string{"a.txt": "v1"})
+	path := filepath.Join(dir, "a.txt")
+	modified := time.Date(2026, 10, 14, 10, 0, 0, 0, time.UTC)
+	if err := os.Chtimes(path, modified, modified); err != nil {
+		t.Fatal(err)
+	}
+	since := func(d time.Time) string { return "If-Unmodified-Since: " + d.Format(http.TimeFormat) }
+
+	// Changed after the client's copy was taken
+	for _, method := range []string{http.MethodPut, http.MethodPost} {
+		resp, _ := sendBody(t, s, method, "/files/a.txt", []byte("lost update"), since(modified.Add(-time.Second)))
+		if resp.StatusCode != http.StatusPreconditionFailed {
+			t.Errorf("%s with a stale date: got %d, want 412", method, resp.StatusCode)
+		}
+	}
+	if content, _ := os.ReadFile(path); string(content) != "v1" {
+		t.Fatalf("a failed precondition still wrote %q", content)
+	}
+
+	// Exactly the mtime, sub-second precision aside, is unmodified
+	if err := os.Chtimes(path, modified.Add(300*time.Millisecond), modified.Add(300*time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	if resp, _ := sendBody(t, s, http.MethodPut, "/files/a.txt", []byte("v2"), since(modified)); resp.StatusCode >= 300 {
+		t.Errorf("PUT with the current date: got %d", resp.StatusCode)
+	}
+	if content, _ := os.ReadFile(path); string(content) != "v2" {
+		t.Errorf("after a valid precondition: %q", content)
+	}
+
+	// Ignored: a date that doesn't parse, a file that isn't there yet, and next to If-Match
+	past := since(time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC))
+	if resp, _ := sendBody(t, s, http.MethodPost, "/files/a.txt", []byte("v3"), "If-Unmodified-Since: yesterday"); resp.StatusCode >= 300 {
+		t.Errorf("unparseable date: got %d", resp.StatusCode)
+	}
+	if resp, _ := sendBody(t, s, http.MethodPost, "/files/new.txt", []byte("new"), past); resp.StatusCode != http.StatusCreated {
+		t.Errorf("new file: got %d, want 201", resp.StatusCode)
+	}
+	resp, _ := get(t, s, http.MethodGet, "/files/a.txt")
+	if resp, _ := sendBody(t, s, http.MethodPut, "/files/a.txt", []byte("v4"), past, "If-Match: "+resp.Header.Get("ETag")); resp.StatusCode >= 300 {
+		t.Errorf("with a matching If-Match: got %d", resp.StatusCode)
+	}
+}
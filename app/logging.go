@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"math/rand/v2"
+	"slices"
+	"strings"
+	"time"
+)
+
+// LogLevel is the minimum severity the server logs, see Config.LogLevel.
+// The zero value is LevelInfo.
+type LogLevel int
+
+const (
+	LevelDebug LogLevel = iota - 1 // per-request detail: requests, responses, connection lifecycle
+	LevelInfo                      // server lifecycle, rejected requests
+	LevelWarn                      // client misbehaviour worth a look
+	LevelError                     // failures on our side
+)
+
+func (l LogLevel) String() string {
+	switch l {
+	case LevelDebug:
+		return "DEBUG"
+	case LevelInfo:
+		return "INFO"
+	case LevelWarn:
+		return "WARN"
+	case LevelError:
+		return "ERROR"
+	}
+	return fmt.Sprintf("LEVEL(%d)", int(l))
+}
+
+// Log formats, see Config.LogFormat
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+func (s *Server) debugf(format string, args ...interface{}) { s.logf(LevelDebug, format, args...) }
+func (s *Server) infof(format string, args ...interface{})  { s.logf(LevelInfo, format, args...) }
+func (s *Server) warnf(format string, args ...interface{})  { s.logf(LevelWarn, format, args...) }
+func (s *Server) errorf(format string, args ...interface{}) { s.logf(LevelError, format, args...) }
+
+// logf writes one line if level reaches Config.LogLevel.
+func (s *Server) logf(level LogLevel, format string, args ...interface{}) {
+	if level < s.config.Load().LogLevel {
+		return
+	}
+	s.output(4, level, fmt.Sprintf(format, args...), nil)
+}
+
+// accessLog records one served request at info level, or a sample of them
+// (Config.AccessLogSampleRate). Server errors are never sampled out.
+func (s *Server) accessLog(req *Request, resp *Response, start time.Time) {
+	config := s.config.Load()
+	if LevelInfo < config.LogLevel {
+		return
+	}
+	// rand.Float64 is in [0, 1): a rate of 1 keeps every line, 0 none
+	if resp.StatusCode < 500 && rand.Float64() >= config.accessLogSampleRate() {
+		return
+	}
+	s.output(3, LevelInfo, "request", map[string]interface{}{
+		"method":      req.Method,
+		"path":        req.Path,
+		"status":      resp.StatusCode,
+		"remote_addr": req.RemoteAddr,
+		"duration_ms": float64(time.Since(start).Microseconds()) / 1000,
+	})
+}
+
+/*
+   Output formats:
+
+     text  [http-server]2026/10/14 04:03:07 /root/module/app/main.go:393: INFO request duration_ms=0.21 method=GET path=/echo/hi ...
+     json  {"duration_ms":0.21,"level":"info","method":"GET","msg":"request","path":"/echo/hi",...,"time":"2026-10-14T04:03:07.123Z"}
+
+   JSON lines bypass the logger's prefix and flags, a log pipeline wants
+   nothing but the object on each line.
+*/
+
+// output writes msg and its fields in the configured format.
+// depth counts the frames up to the line that logged (output, logf, debugf → 4),
+// so log.Llongfile points there and not at this file.
+func (s *Server) output(depth int, level LogLevel, msg string, fields map[string]interface{}) {
+	if s.config.Load().LogFormat == LogFormatJSON {
+		entry := make(map[string]interface{}, len(fields)+3)
+		maps.Copy(entry, fields)
+		entry["level"] = strings.ToLower(level.String())
+		entry["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+		entry["msg"] = msg
+		line, err := json.Marshal(entry)
+		if err != nil {
+			line, _ = json.Marshal(map[string]string{"level": "error", "msg": "unloggable entry: " + err.Error()})
+		}
+		s.logger.Writer().Write(append(line, '\n'))
+		return
+	}
+
+	var b strings.Builder
+	b.WriteString(level.String() + " " + msg)
+	for _, name := range slices.Sorted(maps.Keys(fields)) {
+		fmt.Fprintf(&b, " %s=%v", name, fields[name])
+	}
+	s.logger.Output(depth, b.String())
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sampleRate is a Config.AccessLogSampleRate
+func sampleRate(rate float64) *float64 {
+	return &rate
+}
+
+// accessLogLines counts the access-log lines n requests with status leave behind
+func accessLogLines(t *testing.T, config Config, status, n int) int {
+	t.Helper()
+	s, logs := newTestServer(t, config)
+	req := newTestRequest(http.MethodGet, "/echo/hi", nil, "")
+	for range n {
+		s.accessLog(req, NewResponse(status, http.StatusText(status), nil), time.Now())
+	}
+	return strings.Count(logs.String(), "INFO request")
+}
+
+func TestAccessLogSampling(t *testing.T) {
+	// An embedder's zero Config keeps every line
+	if got := accessLogLines(t, Config{}, http.StatusOK, 50); got != 50 {
+		t.Errorf("default rate: got %d lines for 50 requests", got)
+	}
+
+	errorsOnly := Config{AccessLogSampleRate: sampleRate(0)}
+	if got := accessLogLines(t, errorsOnly, http.StatusOK, 50); got != 0 {
+		t.Errorf("rate 0: got %d lines for 200s, want 0", got)
+	}
+	if got := accessLogLines(t, errorsOnly, http.StatusServiceUnavailable, 5); got != 5 {
+		t.Errorf("rate 0: got %d lines for 5 503s, want 5", got)
+	}
+
+	sampled := Config{AccessLogSampleRate: sampleRate(0.1)}
+	if got := accessLogLines(t, sampled, http.StatusOK, 2000); got < 100 || got > 300 {
+		t.Errorf("rate 0.1: got %d lines for 2000 requests, want about 200", got)
+	}
+	if got := accessLogLines(t, sampled, http.StatusInternalServerError, 20); got != 20 {
+		t.Errorf("rate 0.1: got %d lines for 20 500s, want all of them", got)
+	}
+}
+
+func TestAccessLogSampleRateValidation(t *testing.T) {
+	for _, rate := range []float64{-0.1, 1.5, math.NaN()} {
+		if err := (Config{AccessLogSampleRate: sampleRate(rate)}).validate(); err == nil {
+			t.Errorf("AccessLogSampleRate %v accepted", rate)
+		}
+	}
+}
+
+func TestLogLevels(t *testing.T) {
+	for _, tc := range []struct {
+		level         LogLevel
+		dropped, kept []string
+	}{
+		{LevelInfo, []string{"debug line"}, []string{"INFO info line", "WARN warn line", "ERROR error line"}},
+		{LevelWarn, []string{"debug line", "info line"}, []string{"WARN warn line", "ERROR error line"}},
+		{LevelDebug, nil, []string{"DEBUG debug line", "ERROR error line"}},
+	} {
+		s, logs := newTestServer(t, Config{LogLevel: tc.level})
+		s.debugf("debug line")
+		s.infof("info line")
+		s.warnf("warn line")
+		s.errorf("error line")
+
+		out := logs.String()
+		for _, dropped := range tc.dropped {
+			if strings.Contains(out, dropped) {
+				t.Errorf("%q logged at %v", dropped, tc.level)
+			}
+		}
+		for _, kept := range tc.kept {
+			if !strings.Contains(out, kept) {
+				t.Errorf("%v: %q missing from:\n%s", tc.level, kept, out)
+			}
+		}
+	}
+}
+
+func TestRequestDumpsAreDebug(t *testing.T) {
+	config := testConfig()
+	config.LogLevel = LevelDebug
+	s, logs := startTestServer(t, config)
+	get(t, s, http.MethodGet, "/echo/hi")
+	if out := logs.String(); !strings.Contains(out, "DEBUG Received request") {
+		t.Errorf("no request dump at debug level:\n%s", out)
+	}
+}
+
+func TestJSONLog(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := testConfig()
+	config.LogFormat = LogFormatJSON
+	logs := &logBuffer{}
+	// The text format's prefix and flags must not end up in front of the object
+	s, err := NewServerWithListener(config, log.New(logs, "[http-server]", log.LstdFlags|log.Llongfile), l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start(t, s)
+
+	get(t, s, http.MethodGet, "/echo/hi")
+	s.errorf("disk %s", "full")
+
+	var entries []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		var entry map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("not a JSON line: %q: %v", line, err)
+		}
+		if _, err := time.Parse(time.RFC3339Nano, entry["time"].(string)); err != nil {
+			t.Errorf("time: %v", err)
+		}
+		entries = append(entries, entry)
+	}
+
+	i := slices.IndexFunc(entries, func(e map[string]interface{}) bool { return e["msg"] == "request" })
+	if i < 0 {
+		t.Fatalf("no access log entry in:\n%s", logs.String())
+	}
+	request := entries[i]
+	for field, want := range map[string]interface{}{"level": "info", "method": "GET", "path": "/echo/hi", "status": 200.0} {
+		if request[field] != want {
+			t.Errorf("%s: got %v, want %v", field, request[field], want)
+		}
+	}
+	if addr, _ := request["remote_addr"].(string); !strings.HasPrefix(addr, "127.0.0.1:") {
+		t.Errorf("remote_addr: got %v", request["remote_addr"])
+	}
+	if d, ok := request["duration_ms"].(float64); !ok || d < 0 {
+		t.Errorf("duration_ms: got %v, want a number", request["duration_ms"])
+	}
+
+	last := entries[len(entries)-1]
+	if last["level"] != "error" || last["msg"] != "disk full" {
+		t.Errorf("errorf entry: got %v", last)
+	}
+}
+
+func TestAccessLogErrorsOnlyServer(t *testing.T) {
+	config := testConfig()
+	config.AccessLogSampleRate = sampleRate(0)
+	s, logs := newTestServer(t, config)
+	s.router.RegisterExactRoute("/fail", func(r *Request) *Response {
+		return NewResponse(http.StatusInternalServerError, "Internal Server Error", nil)
+	})
+	start(t, s)
+
+	get(t, s, http.MethodGet, "/echo/fine")
+	get(t, s, http.MethodGet, "/missing")
+	get(t, s, http.MethodGet, "/fail")
+	out := logs.String()
+	if strings.Count(out, "INFO request") != 1 || !strings.Contains(out, "path=/fail") || !strings.Contains(out, "status=500") {
+		t.Errorf("want only the 500 logged, got:\n%s", out)
+	}
+}
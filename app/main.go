@@ -1,49 +1,110 @@
 package main
 
 import (
+	"bufio"
 	"context"
+	"crypto/tls"
 	"errors"
+	"fmt"
 	"io"
 	"log"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
 
-type Config struct {
-	Port         string
-	Host         string
-	Protocol     string
-	ReadTimeout  time.Duration
-	WriteTimeout time.Duration
-}
 type Server struct {
 	listener net.Listener
-	config   Config
+	config   atomic.Pointer[Config] // swapped whole by Reload
 	logger   *log.Logger
 	wg       sync.WaitGroup
 	router   *Router
-}
 
-var dirPath string
+	fileCache *fileCache // nil unless Config.FileCacheBytes > 0
 
-func main() {
-	if len(os.Args) > 2 && os.Args[1] == "--directory" {
-		dirPath = os.Args[2]
-		if info, err := os.Stat(dirPath); err != nil || !info.IsDir() {
-			log.Fatalf("Invalid directory: %s", dirPath)
-		}
-	}
+	// vhosts maps a lowercased host name (without port) to its own router.
+	// Requests for any other host are served by router.
+	vhosts map[string]*Router
+
+	// draining is set by Shutdown, open connections close after their current request
+	draining atomic.Bool
+
+	// Counters behind Stats
+	activeConns   atomic.Int64
+	totalConns    atomic.Int64
+	shedConns     atomic.Int64
+	totalRequests atomic.Int64
+}
 
+// loadConfig builds the configuration from the command line and the
+// environment, at startup and again on SIGHUP. The environment is how a
+// running server gets new settings: edit the unit's environment, send SIGHUP.
+//
+//	READ_TIMEOUT, WRITE_TIMEOUT   durations, e.g. "10s"
+//	DIRECTORY                     overrides --directory
+func loadConfig() (Config, error) {
 	config := Config{
 		Port:         "4221",
 		Host:         "0.0.0.0",
 		Protocol:     "tcp",
 		ReadTimeout:  5 * time.Second,
 		WriteTimeout: 5 * time.Second,
+
+		SocketActivation: true,
+		EnableH2C:        true,
+	}
+
+	if len(os.Args) > 2 && os.Args[1] == "--directory" {
+		config.Directory = os.Args[2]
+	}
+	if dir := os.Getenv("DIRECTORY"); dir != "" {
+		config.Directory = dir
+	}
+	for name, timeout := range map[string]*time.Duration{"READ_TIMEOUT": &config.ReadTimeout, "WRITE_TIMEOUT": &config.WriteTimeout} {
+		value := os.Getenv(name)
+		if value == "" {
+			continue
+		}
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			return Config{}, fmt.Errorf("invalid %s: %q", name, value)
+		}
+		*timeout = d
+	}
+
+	if config.Directory != "" {
+		if info, err := os.Stat(config.Directory); err != nil || !info.IsDir() {
+			return Config{}, fmt.Errorf("invalid directory: %s", config.Directory)
+		}
+	}
+	return config, nil
+}
+
+// reloadOnSignal re-reads the configuration for every signal received, until
+// signals is closed. A bad configuration is logged and the current one kept.
+func reloadOnSignal(s *Server, signals <-chan os.Signal) {
+	for range signals {
+		config, err := loadConfig()
+		if err == nil {
+			err = s.Reload(config)
+		}
+		if err != nil {
+			s.errorf("Reload failed, keeping the current configuration: %v", err)
+		}
+	}
+}
+
+func main() {
+	config, err := loadConfig()
+	if err != nil {
+		log.Fatal(err)
 	}
 
 	logger := log.New(os.Stdout, "[http-server]", log.LstdFlags|log.Llongfile)
@@ -58,30 +119,69 @@ func main() {
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
 
+	// SIGHUP re-reads the configuration, the listener and open connections stay up
+	hupChan := make(chan os.Signal, 1)
+	signal.Notify(hupChan, syscall.SIGHUP)
+	go reloadOnSignal(server, hupChan)
+
+	stopped := make(chan struct{})
 	go func() {
 		<-sigChan
 		logger.Println("Shutdown signal received, gracefully stopping.")
 		cancel()
 		server.Shutdown()
+		close(stopped)
 	}()
 
 	if err := server.Start(ctx); err != nil {
 		logger.Fatalf("Error starting server: %v", err)
 	}
+	// Start returns as soon as the listener is closed, let open connections drain
+	<-stopped
 }
 
 func NewServer(config Config, logger *log.Logger) (*Server, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+
+	if config.SocketActivation {
+		l, err := inheritedListener()
+		if err != nil {
+			return nil, err
+		}
+		if l != nil {
+			logger.Printf("Using socket-activated listener on %s", l.Addr())
+			return NewServerWithListener(config, logger, l)
+		}
+	}
+
 	addr := net.JoinHostPort(config.Host, config.Port)
 	l, lErr := net.Listen(config.Protocol, addr)
 	if lErr != nil {
 		return nil, lErr
 	}
+	return NewServerWithListener(config, logger, l)
+}
+
+// NewServerWithListener serves on an existing listener (TLS, an inherited
+// socket, 127.0.0.1:0 in tests) instead of listening on Host:Port itself.
+// Host, Port and Protocol are ignored; Shutdown closes l.
+func NewServerWithListener(config Config, logger *log.Logger, l net.Listener) (*Server, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
 
 	server := Server{
 		listener: l,
-		config:   config,
 		logger:   logger,
-		router:   NewRouter(),
+		vhosts:   make(map[string]*Router),
+	}
+	server.config.Store(&config)
+	server.router = server.newRouter()
+
+	if config.FileCacheBytes > 0 {
+		server.fileCache = newFileCache(config.FileCacheBytes)
 	}
 
 	server.RegisterRoutes()
@@ -89,11 +189,105 @@ func NewServer(config Config, logger *log.Logger) (*Server, error) {
 	return &server, nil
 }
 
+// newRouter creates a router that follows the server's routing options
+func (s *Server) newRouter() *Router {
+	router := NewRouter()
+	router.RedirectTrailingSlash = s.config.Load().RedirectTrailingSlash
+	router.CaseInsensitivePaths = s.config.Load().CaseInsensitivePaths
+	return router
+}
+
+// VirtualHost returns the router for requests addressed to host, creating it on first use.
+// Hosts without their own router fall back to the server's default routes.
+// Register routes before calling Start, the map is not guarded against concurrent writes.
+func (s *Server) VirtualHost(host string) *Router {
+	host = normalizeHost(host)
+	router, ok := s.vhosts[host]
+	if !ok {
+		router = s.newRouter()
+		s.vhosts[host] = router
+	}
+	return router
+}
+
+// tcpConnOptions are the socket options tuneConn sets, implemented by *net.TCPConn
+type tcpConnOptions interface {
+	SetNoDelay(noDelay bool) error
+	SetKeepAliveConfig(config net.KeepAliveConfig) error
+}
+
+// tuneConn applies the TCP options of Config to an accepted connection.
+// NoDelay is set either way, Go's default is made explicit for sockets
+// inherited through socket activation too.
+func (s *Server) tuneConn(conn net.Conn) {
+	tcp, ok := conn.(tcpConnOptions)
+	if !ok {
+		return
+	}
+	config := s.config.Load()
+	if err := tcp.SetNoDelay(!config.DisableTCPNoDelay); err != nil {
+		s.warnf("Error setting TCP_NODELAY: %v", err)
+	}
+	if period := config.TCPKeepAlive; period != 0 {
+		keepAlive := net.KeepAliveConfig{Enable: period > 0, Idle: period, Interval: period}
+		if err := tcp.SetKeepAliveConfig(keepAlive); err != nil {
+			s.warnf("Error setting TCP keep-alive: %v", err)
+		}
+	}
+}
+
+// checkPathDepth rejects paths with more segments than Config.MaxPathSegments.
+// "/files/a/a/a/..." a thousand levels deep is no real file, only work for
+// the router's trie walk and filepath.Clean.
+func (s *Server) checkPathDepth(path string) error {
+	if limit := s.config.Load().maxPathSegments(); strings.Count(path, "/") > limit {
+		return newRequestError(http.StatusBadRequest, "path has more than %d segments", limit)
+	}
+	return nil
+}
+
+// routerFor picks the router for a request's Host header
+func (s *Server) routerFor(host string) *Router {
+	if router, ok := s.vhosts[normalizeHost(host)]; ok {
+		return router
+	}
+	return s.router
+}
+
+// normalizeHost turns "Example.COM:4221" into "example.com"
+func normalizeHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
 func (s *Server) RegisterRoutes() {
-	s.router.RegisterExactRoute("/", handleRoot)
-	s.router.RegisterPrefixRoute(echoPrefix, handleEcho)
-	s.router.RegisterExactRoute(userAgentPrefix, handleUserAgent)
-	s.router.RegisterPrefixRoute(filesPrefix, handleFiles)
+	// The methods each handler implements, they also make up OPTIONS *'s Allow
+	s.router.RegisterExactRoute("/", handleRoot, WithMethods(http.MethodGet, http.MethodHead))
+	s.router.RegisterPrefixRoute(echoPrefix, handleEcho, WithMethods(http.MethodGet, http.MethodHead))
+	s.router.RegisterExactRoute(userAgentPrefix, handleUserAgent, WithMethods(http.MethodGet, http.MethodHead))
+	// Not MountDir: Config.Directory can change on Reload, so the root is looked up per request
+	s.router.RegisterPrefixRoute(filesPrefix, func(r *Request) *Response {
+		return s.handleFiles(r, filesPrefix, s.config.Load().Directory)
+	}, WithMethods(fileMethods...))
+	if s.config.Load().EnablePprof {
+		s.registerPprof()
+	}
+	if s.config.Load().EnableStats {
+		s.router.RegisterExactRoute("/stats", s.handleStats, WithMethods(http.MethodGet))
+	}
+}
+
+// MountDir serves the files in dir under the URL prefix, e.g. MountDir("/static/", "./public").
+func (s *Server) MountDir(prefix, dir string) {
+	s.router.RegisterPrefixRoute(prefix, s.fileHandler(prefix, dir), WithMethods(fileMethods...))
+}
+
+// Addr is the address the server listens on. With Config.Port "0" it
+// carries the port the OS picked.
+func (s *Server) Addr() net.Addr {
+	return s.listener.Addr()
 }
 
 func (s *Server) Start(ctx context.Context) error {
@@ -112,36 +306,47 @@ func (s *Server) Start(ctx context.Context) error {
 			case <-ctx.Done():
 				return nil
 			default:
-				s.logger.Printf("Error accepting connection: %v", connErr)
+				s.errorf("Error accepting connection: %v", connErr)
 				continue
 			}
 		}
 		s.wg.Add(1)
-		go s.handleConnection(conn)
+		if shed := s.config.Load().LoadShedFunc; shed != nil && shed() {
+			go s.shedConnection(conn)
+			continue
+		}
+		go s.handleConnection(ctx, conn)
 	}
 }
 
 func (s *Server) Shutdown() {
-	s.logger.Println("Shutdown Initiated")
+	s.infof("Shutdown Initiated")
+	s.draining.Store(true)
 
 	if err := s.listener.Close(); err != nil {
-		s.logger.Printf("Error closing listener: %v", err)
+		s.errorf("Error closing listener: %v", err)
 	}
 
-	s.logger.Println("Waiting for connection to finish")
+	s.infof("Waiting for connection to finish")
 	s.wg.Wait()
-	s.logger.Println("Server Stopped")
+	s.infof("Server Stopped")
 }
 
-func (s *Server) handleConnection(conn net.Conn) {
+func (s *Server) handleConnection(ctx context.Context, conn net.Conn) {
 	defer s.wg.Done()
+	s.totalConns.Add(1)
+	s.activeConns.Add(1)
+	defer s.activeConns.Add(-1)
 	defer func() {
-		s.logger.Printf("Closing connection from %s", conn.RemoteAddr().String())
-		if err := conn.Close(); err != nil {
-			s.logger.Printf("Error closing connection: %v", err)
+		s.debugf("Closing connection from %s", conn.RemoteAddr().String())
+		// A hijacker or the h2c server may have closed it already
+		if err := conn.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+			s.warnf("Error closing connection: %v", err)
 		}
 	}()
 
+	s.tuneConn(conn)
+
 	/*
 		   HTTP/1.1 Keep-Alive (Persistent Connections):
 
@@ -166,6 +371,7 @@ func (s *Server) handleConnection(conn net.Conn) {
 
 		   We loop to handle multiple requests on the same connection until:
 		     1. Client sends "Connection: close" header
+		        (or is an HTTP/1.0 client that did not ask for keep-alive)
 		     2. Read timeout occurs (no more data)
 		     3. Parse error (malformed request)
 		     4. Client closes connection
@@ -198,47 +404,307 @@ func (s *Server) handleConnection(conn net.Conn) {
 		                  [Hangs up]
 	*/
 
+	// One reader and one writer for the whole connection, recycled afterwards.
+	// The reader must outlive each request: whatever it buffered past the end of
+	// one request (a pipelined follow-up) is the start of the next, and a fresh
+	// reader per request would silently drop those bytes.
+	reader := getBufioReader(conn)
+	defer putBufioReader(reader)
+	writer := getBufioWriter(conn, s.config.Load().writeBufferSize())
+	defer putBufioWriter(writer)
+
+	peerAddr := conn.RemoteAddr().String()
+	if s.config.Load().ProxyProtocol {
+		if err := conn.SetReadDeadline(time.Now().Add(s.config.Load().ReadTimeout)); err != nil {
+			s.errorf("Error setting read deadline: %v", err)
+			return
+		}
+		addr, err := readProxyHeader(reader)
+		if err != nil {
+			// Not from our load balancer (or broken), nothing on this connection can be trusted
+			s.warnf("Error reading PROXY header: %v", err)
+			return
+		}
+		if addr != "" {
+			peerAddr = addr
+		}
+	}
+
+	if s.config.Load().EnableH2C {
+		if err := conn.SetReadDeadline(time.Now().Add(s.config.Load().ReadTimeout)); err != nil {
+			s.errorf("Error setting read deadline: %v", err)
+			return
+		}
+		if isH2Preface(reader) {
+			s.serveH2C(ctx, conn, reader, peerAddr)
+			return
+		}
+	}
+
 	for {
-		setReadDeadlineErr := conn.SetReadDeadline(time.Now().Add(s.config.ReadTimeout))
+		setReadDeadlineErr := conn.SetReadDeadline(time.Now().Add(s.config.Load().ReadTimeout))
 		if setReadDeadlineErr != nil {
-			s.logger.Printf("Error setting read deadline: %v", setReadDeadlineErr)
+			s.errorf("Error setting read deadline: %v", setReadDeadlineErr)
 			return
 		}
-		setWriteDeadlineErr := conn.SetWriteDeadline(time.Now().Add(s.config.WriteTimeout))
+		setWriteDeadlineErr := conn.SetWriteDeadline(time.Now().Add(s.config.Load().WriteTimeout))
 		if setWriteDeadlineErr != nil {
-			s.logger.Printf("Error setting write deadline: %v", setWriteDeadlineErr)
+			s.errorf("Error setting write deadline: %v", setWriteDeadlineErr)
 			return
 		}
 
-		req, parseErr := parseRequest(conn)
+		// Routing happens as soon as the headers are in, a route's own read
+		// timeout (WithTimeouts) must already cover the body
+		var handler HandleFunc
+		var params map[string]string
+		var route RouteInfo
+		var rejected *Response // the route's Precheck answer, if it refused the request
+		req, parseErr := parseRequest(reader, writer, s.config.Load().maxHeaderCount(), func(req *Request) (bool, error) {
+			// Before anything looks at the request, a Precheck may go by client address or TLS
+			req.ctx = ctx
+			req.RemoteAddr = s.clientAddr(peerAddr, req)
+			if tlsConn, ok := conn.(*tls.Conn); ok {
+				state := tlsConn.ConnectionState()
+				req.TLS = &state
+			}
+			if err := s.checkPathDepth(req.Path); err != nil {
+				return false, err
+			}
+			if s.unroutedHandler(req) != nil {
+				return false, nil
+			}
+			handler, params, route = s.routerFor(req.Host).Match(req.Path)
+			if route.ReadTimeout > 0 {
+				if err := conn.SetReadDeadline(time.Now().Add(route.ReadTimeout)); err != nil {
+					return false, err
+				}
+			}
+			if route.Precheck != nil {
+				req.Params = params
+				if rejected = route.Precheck(req); rejected != nil {
+					// Left unread like a lazy body: no 100 Continue, no size limit,
+					// drain below skips it or gives up the connection
+					return true, nil
+				}
+			}
+			return route.LazyBody, nil
+		})
 		if parseErr != nil {
+			var reqErr *requestError
 			if errors.Is(parseErr, io.EOF) {
-				s.logger.Println("Client closed connection")
+				s.debugf("Client closed connection")
+			} else if errors.As(parseErr, &reqErr) {
+				s.infof("Rejecting request: %v", parseErr)
+				s.writeErrorResponse(writer, reqErr)
+			} else if errors.Is(parseErr, io.ErrUnexpectedEOF) {
+				s.infof("Client closed connection mid-request: %v", parseErr)
 			} else {
-				s.logger.Printf("Error parsing request: %v", parseErr)
+				s.warnf("Error parsing request: %v", parseErr)
 			}
 			return
 		}
-		s.logger.Printf("Received request: %+v", req)
+		start := time.Now()
+		s.totalRequests.Add(1)
+		// The dumps sort and format every header, only worth it if they are logged
+		debug := s.config.Load().LogLevel <= LevelDebug
+		if debug {
+			s.debugf("Received request:\n%s", req.dump(s.config.Load().redactHeaders()))
+		}
+
+		var resp *Response
+		if unrouted := s.unroutedHandler(req); unrouted != nil {
+			resp = unrouted(req)
+		} else if rejected != nil {
+			resp = rejected
+		} else {
+			if route.ReadTimeout > 0 || route.WriteTimeout > 0 {
+				// Counted from here, a long upload must not use up the write deadline
+				writeTimeout := s.config.Load().WriteTimeout
+				if route.WriteTimeout > 0 {
+					writeTimeout = route.WriteTimeout
+				}
+				if err := conn.SetWriteDeadline(time.Now().Add(writeTimeout)); err != nil {
+					s.errorf("Error setting write deadline: %v", err)
+					return
+				}
+			}
+			req.Params = params
+			resp = handler(req)
+		}
+		if debug {
+			s.debugf("Response of the request:\n%s", resp.dump(s.config.Load().redactHeaders()))
+		}
 
-		handler := s.router.Match(req.Path)
-		resp := handler(req)
-		s.logger.Printf("Response of the request: %+v", resp)
+		if err := s.processCommonHeaders(req, resp); err != nil {
+			s.errorf("Error processing common headers: %v", err)
+			return
+		}
+		if debug {
+			s.debugf("Response of the request after processing common headers:\n%s", resp.dump(s.config.Load().redactHeaders()))
+		}
+
+		// Once Shutdown has begun, finish this request but don't take another one
+		// on this connection: it could be cut off halfway. Connection: close tells
+		// the client to send its next request elsewhere (or after the restart).
+		keepAlive := req.IsKeepAlive() && !headerHasToken(resp.Headers["Connection"], "close")
+		if s.draining.Load() && keepAlive && resp.Hijack == nil {
+			resp.SetHeader("Connection", "close")
+			keepAlive = false
+		}
+		// A lazy body the handler left unread is still on the connection, in
+		// front of the next request: skip it, or give up the connection if
+		// that would mean reading a large upload nobody wants
+		if keepAlive && !req.body.drain() {
+			resp.SetHeader("Connection", "close")
+			keepAlive = false
+		}
+
+		if resp.Stream != nil {
+			// A stream (e.g. Server-Sent Events) may legitimately run far longer than
+			// WriteTimeout; it ends when the handler returns, a write to a gone client
+			// fails, or the server context is cancelled
+			if err := conn.SetWriteDeadline(time.Time{}); err != nil {
+				s.errorf("Error clearing write deadline: %v", err)
+				return
+			}
+		}
 
-		if err := processCommonHeaders(req, resp); err != nil {
-			s.logger.Printf("Error processing common headers: %v", err)
+		// No new request is parsed until this returns, so a stream owns the connection
+		if err := writeResponse(writer, resp); err != nil {
+			// A half-written response (e.g. a failed stream) leaves the connection unusable
+			s.errorf("Error writing response: %v", err)
+			return
+		}
+		s.accessLog(req, resp, start)
+		if resp.Stream != nil && ctx.Err() != nil {
+			// The stream ended because the server is stopping, its Connection
+			// header went out long ago. Closing is all that is left to tell the client.
+			if err := writer.Flush(); err != nil {
+				s.errorf("Error writing response: %v", err)
+			}
 			return
 		}
-		s.logger.Printf("Response of the request after processing common headers: %+v", resp)
 
-		if err := writeResponse(conn, resp); err != nil {
-			s.logger.Printf("Error writing response: %v", err)
+		/*
+		   HTTP pipelining:
+
+		   A client may send several requests without waiting for the responses:
+
+		     Client → GET /a GET /b GET /c          (one TCP write)
+		     Server ← 200 /a 200 /b 200 /c          (same order, RFC 9112 §9.3.2)
+
+		   Requests are handled strictly one after another on this goroutine, so
+		   responses can never interleave or overtake each other. If the reader
+		   already holds the next request there is no point sending this response
+		   on its own: it stays in the writer and goes out together with the next
+		   one, one syscall for the whole batch. The writer still flushes by itself
+		   when its buffer fills up.
+		*/
+		if reader.Buffered() == 0 || resp.Hijack != nil || !keepAlive {
+			if err := writer.Flush(); err != nil {
+				s.errorf("Error writing response: %v", err)
+				return
+			}
 		}
 
-		if val, ok := req.GetHeader("Connection"); ok && val == "close" {
-			s.logger.Println("Connection: close header found, closing connection.")
+		if resp.Hijack != nil {
+			// The connection now speaks another protocol (e.g. WebSocket), stop the HTTP loop
+			s.debugf("Connection from %s hijacked", conn.RemoteAddr().String())
+			// Unblock the hijacker's reads on shutdown, otherwise Shutdown waits forever
+			stop := context.AfterFunc(ctx, func() { conn.Close() })
+			defer stop()
+			resp.Hijack(conn, req.reader)
 			return
 		}
+
+		if !keepAlive {
+			s.debugf("%s request without keep-alive, closing connection.", req.Version)
+			return
+		}
+	}
+}
+
+// clientAddr is the address of the peer, or of the client behind a trusted proxy
+func (s *Server) clientAddr(addr string, req *Request) string {
+	if !s.config.Load().TrustProxy {
+		return addr
+	}
+
+	/*
+	   X-Forwarded-For: <client>, <proxy1>, <proxy2>
+
+	   Every proxy appends the address it received the request from, so only
+	   the last entry was written by our (trusted) proxy. Anything to the left
+	   came from the client and may be made up.
+	*/
+	forwarded, ok := req.GetHeader("X-Forwarded-For")
+	if !ok {
+		return addr
+	}
+	parts := strings.Split(forwarded, ",")
+	if ip := net.ParseIP(strings.TrimSpace(parts[len(parts)-1])); ip != nil {
+		return ip.String()
+	}
+	return addr
+}
+
+// writeErrorResponse tells the client why its request was rejected.
+// The connection is closed afterwards, so the response says so.
+func (s *Server) writeErrorResponse(w *bufio.Writer, reqErr *requestError) {
+	resp := NewResponse(reqErr.StatusCode, http.StatusText(reqErr.StatusCode), []byte(reqErr.Error()))
+	resp.SetHeader("Content-Type", "text/plain")
+	resp.SetHeader("Content-Length", strconv.Itoa(len(resp.Body)))
+	resp.SetHeader("Connection", "close")
+	err := writeResponse(w, resp)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		s.errorf("Error writing response: %v", err)
+	}
+}
+
+/*
+   Load shedding (Config.LoadShedFunc):
+
+     overloaded → accept, 503 + Retry-After, close   (no goroutine per request,
+                                                      no parsing, no handler)
+
+   Refusing to accept at all would leave clients waiting in the listen
+   backlog until they time out; a 503 tells them right away to come back
+   later, or a load balancer to try another instance.
+*/
+
+// loadShedRetryAfter is the Retry-After of a shed connection, in seconds
+const loadShedRetryAfter = "1"
+
+// shedConnection answers a connection accepted while overloaded with 503 and closes it
+func (s *Server) shedConnection(conn net.Conn) {
+	defer s.wg.Done()
+	defer conn.Close()
+	s.shedConns.Add(1)
+	s.debugf("Shedding connection from %s", conn.RemoteAddr().String())
+
+	// A client that doesn't read its response must not be able to hold the goroutine
+	if err := conn.SetDeadline(time.Now().Add(time.Second)); err != nil {
+		return
+	}
+	resp := NewResponse(http.StatusServiceUnavailable, "Service Unavailable", []byte("server overloaded, retry later"))
+	resp.SetHeader("Content-Type", "text/plain")
+	resp.SetHeader("Content-Length", strconv.Itoa(len(resp.Body)))
+	resp.SetHeader("Retry-After", loadShedRetryAfter)
+	resp.SetHeader("Connection", "close")
+	w := bufio.NewWriter(conn)
+	if err := writeResponse(w, resp); err != nil || w.Flush() != nil {
+		return
+	}
+
+	// Closing with the unread request still in the socket buffer would send a
+	// RST, which can make the client drop our response before reading it.
+	// Shut our side instead and let the client finish sending.
+	if tcp, ok := conn.(interface{ CloseWrite() error }); ok {
+		tcp.CloseWrite()
+		io.Copy(io.Discard, io.LimitReader(conn, maxDrainBytes))
 	}
 }
 
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// recordingConn records the socket options tuneConn sets
+type recordingConn struct {
+	net.Conn
+	noDelay   []bool
+	keepAlive []net.KeepAliveConfig
+}
+
+func (c *recordingConn) SetNoDelay(noDelay bool) error {
+	c.noDelay = append(c.noDelay, noDelay)
+	return nil
+}
+
+func (c *recordingConn) SetKeepAliveConfig(config net.KeepAliveConfig) error {
+	c.keepAlive = append(c.keepAlive, config)
+	return nil
+}
+
+func TestTuneConn(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		config      Config
+		noDelay     bool
+		keepAlive   bool
+		keepAliveOn bool
+	}{
+		{name: "defaults", config: Config{}, noDelay: true},
+		{name: "nagle", config: Config{DisableTCPNoDelay: true}, noDelay: false},
+		{name: "keep-alive", config: Config{TCPKeepAlive: 30 * time.Second}, noDelay: true, keepAlive: true, keepAliveOn: true},
+		{name: "no keep-alive", config: Config{TCPKeepAlive: -1}, noDelay: true, keepAlive: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s, _ := newTestServer(t, tc.config)
+			conn := &recordingConn{}
+			s.tuneConn(conn)
+
+			if len(conn.noDelay) != 1 || conn.noDelay[0] != tc.noDelay {
+				t.Errorf("SetNoDelay calls: got %v, want [%v]", conn.noDelay, tc.noDelay)
+			}
+			if !tc.keepAlive {
+				if len(conn.keepAlive) != 0 {
+					t.Errorf("SetKeepAliveConfig called with %+v, want Go's default kept", conn.keepAlive)
+				}
+				return
+			}
+			if len(conn.keepAlive) != 1 {
+				t.Fatalf("SetKeepAliveConfig calls: got %d, want 1", len(conn.keepAlive))
+			}
+			got := conn.keepAlive[0]
+			if got.Enable != tc.keepAliveOn {
+				t.Errorf("keep-alive Enable: got %v, want %v", got.Enable, tc.keepAliveOn)
+			}
+			if tc.keepAliveOn && (got.Idle != tc.config.TCPKeepAlive || got.Interval != tc.config.TCPKeepAlive) {
+				t.Errorf("keep-alive periods: got %+v, want %v", got, tc.config.TCPKeepAlive)
+			}
+		})
+	}
+}
+
+func TestTuneConnNotTCP(t *testing.T) {
+	s, _ := newTestServer(t, Config{})
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	s.tuneConn(server) // must not panic on a connection without socket options
+}
+
+func TestHTTP10ClosesByDefault(t *testing.T) {
+	s, _ := startTestServer(t, testConfig())
+
+	// Only one response, then the server closes
+	out := rawResponse(t, s, "GET /echo/a HTTP/1.0\r\n\r\nGET /echo/b HTTP/1.0\r\n\r\n")
+	if !strings.HasPrefix(out, "HTTP/1.0 200 OK\r\n") {
+		t.Errorf("status line: got %q, want the request's version", out)
+	}
+	if strings.Count(out, "HTTP/1.0 ") != 1 || !strings.HasSuffix(out, "\r\n\r\na") {
+		t.Errorf("HTTP/1.0 without keep-alive: got %q, want a single response", out)
+	}
+}
+
+func TestHTTP10KeepAlive(t *testing.T) {
+	s, _ := startTestServer(t, testConfig())
+
+	conn, r := dial(t, s)
+	for _, word := range []string{"a", "b"} {
+		io.WriteString(conn, "GET /echo/"+word+" HTTP/1.0\r\nConnection: keep-alive\r\n\r\n")
+		resp, body := readResponse(t, r, http.MethodGet)
+		if resp.Proto != "HTTP/1.0" || body != word {
+			t.Fatalf("request %s: got %s %q", word, resp.Proto, body)
+		}
+		if got := resp.Header.Get("Connection"); got != "keep-alive" {
+			t.Errorf("request %s: Connection %q, want keep-alive", word, got)
+		}
+	}
+}
+
+func TestHTTP11ConnectionClose(t *testing.T) {
+	s, _ := startTestServer(t, testConfig())
+
+	// Kept alive unless the client says otherwise
+	conn, r := dial(t, s)
+	for _, word := range []string{"a", "b"} {
+		io.WriteString(conn, "GET /echo/"+word+" HTTP/1.1\r\nHost: localhost\r\n\r\n")
+		if resp, body := readResponse(t, r, http.MethodGet); resp.Proto != "HTTP/1.1" || body != word {
+			t.Fatalf("request %s: got %s %q", word, resp.Proto, body)
+		}
+	}
+
+	out := rawResponse(t, s, "GET /echo/a HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\nGET /echo/b HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	if strings.Count(out, "HTTP/1.1 ") != 1 || !strings.Contains(out, "Connection: close\r\n") {
+		t.Errorf("HTTP/1.1 with Connection: close: got %q", out)
+	}
+}
+
+func TestVirtualHosts(t *testing.T) {
+	s, _ := newTestServer(t, testConfig())
+	s.VirtualHost("a.example").RegisterExactRoute("/site", named("a"))
+	s.VirtualHost("B.example").RegisterExactRoute("/site", named("b"))
+	start(t, s)
+	// get always sends Host: localhost
+	getHost := func(target, host string) (*http.Response, string) {
+		return roundTrip(t, s, "GET "+target+" HTTP/1.1\r\nHost: "+host+"\r\n\r\n")
+	}
+
+	for host, want := range map[string]string{"a.example": "a", "b.example": "b", "A.EXAMPLE:4221": "a", "b.example.": "b"} {
+		if resp, body := getHost("/site", host); resp.StatusCode != http.StatusOK || body != want {
+			t.Errorf("Host %s: got %d %q, want %q", host, resp.StatusCode, body, want)
+		}
+	}
+	// Other hosts get the default routes, which have no /site
+	if resp, _ := getHost("/site", "c.example"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unknown host: got %d, want 404", resp.StatusCode)
+	}
+	if resp, body := getHost("/echo/hi", "c.example"); resp.StatusCode != http.StatusOK || body != "hi" {
+		t.Errorf("unknown host on a default route: got %d %q", resp.StatusCode, body)
+	}
+}
+
+func remoteAddrServer(t *testing.T, config Config) *Server {
+	t.Helper()
+	s, _ := newTestServer(t, config)
+	s.router.RegisterExactRoute("/addr", func(r *Request) *Response {
+		return NewResponse(http.StatusOK, "OK", []byte(r.RemoteAddr))
+	})
+	start(t, s)
+	return s
+}
+
+func TestRemoteAddr(t *testing.T) {
+	s := remoteAddrServer(t, testConfig())
+	if _, body := get(t, s, http.MethodGet, "/addr"); !strings.HasPrefix(body, "127.0.0.1:") {
+		t.Errorf("direct: got %q, want the peer address", body)
+	}
+	// Without TrustProxy anyone could claim any address
+	if _, body := get(t, s, http.MethodGet, "/addr", "X-Forwarded-For: 198.51.100.1"); !strings.HasPrefix(body, "127.0.0.1:") {
+		t.Errorf("untrusted X-Forwarded-For: got %q", body)
+	}
+}
+
+func TestRemoteAddrTrustProxy(t *testing.T) {
+	config := testConfig()
+	config.TrustProxy = true
+	s := remoteAddrServer(t, config)
+
+	for _, tc := range []struct{ forwarded, want string }{
+		{"198.51.100.1", "198.51.100.1"},
+		{"10.0.0.1, 198.51.100.1", "198.51.100.1"}, // only the last hop was added by our proxy
+		{"2001:db8::1", "2001:db8::1"},
+	} {
+		if _, body := get(t, s, http.MethodGet, "/addr", "X-Forwarded-For: "+tc.forwarded); body != tc.want {
+			t.Errorf("X-Forwarded-For %q: got %q, want %q", tc.forwarded, body, tc.want)
+		}
+	}
+	for _, header := range []string{"X-Forwarded-For: not an ip", "Accept: */*"} {
+		if _, body := get(t, s, http.MethodGet, "/addr", header); !strings.HasPrefix(body, "127.0.0.1:") {
+			t.Errorf("%s: got %q, want the peer address", header, body)
+		}
+	}
+}
+
+func TestTwoRequestsInOneWrite(t *testing.T) {
+	s, _ := startTestServer(t, testConfig())
+	conn, r := dial(t, s)
+	// The second request arrives in the buffer of the first read
+	io.WriteString(conn, "POST /echo/a HTTP/1.1\r\nHost: localhost\r\nContent-Length: 3\r\n\r\nxyzGET /echo/b HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	if resp, _ := readResponse(t, r, http.MethodPost); resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("first request: got %d, want 405", resp.StatusCode)
+	}
+	if resp, body := readResponse(t, r, http.MethodGet); resp.StatusCode != http.StatusOK || body != "b" {
+		t.Errorf("second request: got %d %q", resp.StatusCode, body)
+	}
+}
+
+func TestPipelining(t *testing.T) {
+	s, _ := startTestServer(t, testConfig())
+	conn, r := dial(t, s)
+	var pipeline strings.Builder
+	for _, word := range []string{"one", "two", "three"} {
+		pipeline.WriteString("GET /echo/" + word + " HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	}
+	io.WriteString(conn, pipeline.String())
+
+	for _, want := range []string{"one", "two", "three"} {
+		if resp, body := readResponse(t, r, http.MethodGet); resp.StatusCode != http.StatusOK || body != want {
+			t.Errorf("got %d %q, want %q next", resp.StatusCode, body, want)
+		}
+	}
+	if r.Buffered() != 0 {
+		t.Errorf("%d bytes after the third response", r.Buffered())
+	}
+}
+
+func TestShutdownDrainsKeepAlive(t *testing.T) {
+	s, _ := startTestServer(t, testConfig())
+	conn, r := dial(t, s)
+	io.WriteString(conn, "GET /echo/a HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	if resp, _ := readResponse(t, r, http.MethodGet); resp.Close {
+		t.Fatal("first response already closes the connection")
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		s.Shutdown()
+		close(stopped)
+	}()
+	for !s.draining.Load() {
+		time.Sleep(time.Millisecond)
+	}
+
+	// The connection was idle in its keep-alive loop, the next request is still served
+	io.WriteString(conn, "GET /echo/b HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	resp, body := readResponse(t, r, http.MethodGet)
+	// ReadResponse turns Connection: close into resp.Close
+	if body != "b" || !resp.Close {
+		t.Errorf("request during shutdown: got %q without Connection: close", body)
+	}
+	if _, err := r.ReadByte(); err != io.EOF {
+		t.Errorf("after the last response: got %v, want the connection closed", err)
+	}
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Error("Shutdown still waiting after the connection closed")
+	}
+}
+
+func TestAddrEphemeralPort(t *testing.T) {
+	config := testConfig()
+	config.Protocol, config.Host, config.Port = "tcp", "127.0.0.1", "0"
+	s, err := NewServer(config, log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	start(t, s)
+
+	addr, ok := s.Addr().(*net.TCPAddr)
+	if !ok || addr.Port == 0 {
+		t.Fatalf("Addr: got %v, want the port the OS picked", s.Addr())
+	}
+	// get dials s.Addr()
+	if resp, body := get(t, s, http.MethodGet, "/echo/port"); resp.StatusCode != http.StatusOK || body != "port" {
+		t.Errorf("request to %v: got %d %q", addr, resp.StatusCode, body)
+	}
+}
+
+func TestNewServerWithListener(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := testConfig()
+	config.Host, config.Port = "never.invalid", "bogus" // ignored with a listener
+	s, err := NewServerWithListener(config, log.New(io.Discard, "", 0), l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Addr() != l.Addr() {
+		t.Errorf("Addr: got %v, want the injected listener's %v", s.Addr(), l.Addr())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- s.Start(ctx) }()
+	// Closing lets Shutdown return without waiting for this connection to idle out
+	resp, body := roundTrip(t, s, "GET /echo/injected HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+	if resp.StatusCode != http.StatusOK || body != "injected" {
+		t.Errorf("got %d %q", resp.StatusCode, body)
+	}
+
+	cancel()
+	s.Shutdown()
+	<-done
+	if _, err := l.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Accept after Shutdown: got %v, want the listener closed", err)
+	}
+}
+
+func TestConnectionCloseTokens(t *testing.T) {
+	s, _ := startTestServer(t, testConfig())
+	for value, closes := range map[string]bool{
+		"close":             true,
+		"Keep-Alive, close": true,
+		"CLOSE":             true,
+		"  close  ":         true,
+		"upgrade,close":     true,
+		"keep-alive":        false,
+		"closed":            false, // a token, not a substring
+		"x-close, Upgrade":  false,
+	} {
+		req := newTestRequest(http.MethodGet, "/", map[string]string{"Connection": value}, "")
+		if req.IsKeepAlive() == closes {
+			t.Errorf("Connection: %q: IsKeepAlive %v", value, req.IsKeepAlive())
+		}
+
+		// A second request behind it is only answered if the connection stays open
+		out := rawResponse(t, s, "GET /echo/a HTTP/1.1\r\nHost: localhost\r\nConnection: "+value+"\r\n\r\nGET /echo/b HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+		want := 2
+		if closes {
+			want = 1
+		}
+		if got := strings.Count(out, "HTTP/1.1 200"); got != want {
+			t.Errorf("Connection: %q: got %d responses, want %d", value, got, want)
+		}
+	}
+}
+
+func TestLoadShedding(t *testing.T) {
+	var overloaded atomic.Bool
+	config := testConfig()
+	config.LoadShedFunc = overloaded.Load
+	s, _ := newTestServer(t, config)
+	var handled atomic.Int32
+	s.router.RegisterExactRoute("/work", func(r *Request) *Response {
+		handled.Add(1)
+		return NewResponse(http.StatusOK, "OK", []byte("done"))
+	})
+	start(t, s)
+
+	overloaded.Store(true)
+	for range 3 {
+		resp, body := roundTrip(t, s, "POST /work HTTP/1.1\r\nHost: localhost\r\nContent-Length: 4\r\n\r\nbody")
+		if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") != loadShedRetryAfter {
+			t.Fatalf("overloaded: got %d, Retry-After %q", resp.StatusCode, resp.Header.Get("Retry-After"))
+		}
+		if !resp.Close || body == "" {
+			t.Errorf("overloaded: Close %v, body %q", resp.Close, body)
+		}
+	}
+	if handled.Load() != 0 {
+		t.Errorf("the handler ran %d times for shed connections", handled.Load())
+	}
+	if got := s.Stats().ShedConnections; got != 3 {
+		t.Errorf("ShedConnections: got %d, want 3", got)
+	}
+
+	overloaded.Store(false)
+	if resp, body := get(t, s, http.MethodGet, "/work"); resp.StatusCode != http.StatusOK || body != "done" {
+		t.Errorf("after recovering: got %d %q", resp.StatusCode, body)
+	}
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Middleware wraps a handler to run code before and/or after it
+type Middleware func(next HandleFunc) HandleFunc
+
+/*
+   Middleware chain:
+
+     router.Use(Logging, CORS(opts))
+
+     request → Logging → CORS → handler
+     response ← Logging ← CORS ← handler
+
+   The first middleware registered is the outermost, so it sees the request
+   first and the response last.
+*/
+
+func chain(handler HandleFunc, middlewares []Middleware) HandleFunc {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+	return handler
+}
+
+type CORSOptions struct {
+	// AllowedOrigins lists origins like "https://app.example"; "*" allows any origin
+	AllowedOrigins []string
+	// AllowedMethods defaults to GET, HEAD, POST
+	AllowedMethods []string
+	// AllowedHeaders defaults to echoing the preflight's Access-Control-Request-Headers
+	AllowedHeaders []string
+	// AllowCredentials lets browsers send cookies; the origin is then always echoed, never "*"
+	AllowCredentials bool
+	// MaxAge is how long browsers may cache a preflight result, 0 omits the header
+	MaxAge time.Duration
+}
+
+// CORS adds Cross-Origin Resource Sharing headers for allowed origins and answers preflights.
+func CORS(opts CORSOptions) Middleware {
+	methods := opts.AllowedMethods
+	if len(methods) == 0 {
+		methods = []string{http.MethodGet, http.MethodHead, http.MethodPost}
+	}
+	allowAny := slices.Contains(opts.AllowedOrigins, "*")
+
+	return func(next HandleFunc) HandleFunc {
+		return func(r *Request) *Response {
+			origin, ok := r.GetHeader("Origin")
+			if !ok || !(allowAny || slices.Contains(opts.AllowedOrigins, origin)) {
+				// Same-origin or disallowed: no CORS headers, the browser enforces the block
+				return next(r)
+			}
+
+			/*
+			   Preflight:
+			     Before a "non-simple" request (PUT, custom headers, JSON body...)
+			     the browser asks first:
+
+			       OPTIONS /files/a.txt
+			       Origin: https://app.example
+			       Access-Control-Request-Method: PUT
+
+			     and only sends the real request if the answer allows it.
+			*/
+			var resp *Response
+			if _, ok := r.GetHeader("Access-Control-Request-Method"); ok && r.Method == http.MethodOptions {
+				resp = NewResponse(http.StatusNoContent, "No Content", nil)
+				resp.SetHeader("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+				if len(opts.AllowedHeaders) > 0 {
+					resp.SetHeader("Access-Control-Allow-Headers", strings.Join(opts.AllowedHeaders, ", "))
+				} else if requested, ok := r.GetHeader("Access-Control-Request-Headers"); ok {
+					resp.SetHeader("Access-Control-Allow-Headers", requested)
+				}
+				if opts.MaxAge > 0 {
+					resp.SetHeader("Access-Control-Max-Age", strconv.Itoa(int(opts.MaxAge.Seconds())))
+				}
+			} else {
+				resp = next(r)
+			}
+
+			if allowAny && !opts.AllowCredentials {
+				resp.SetHeader("Access-Control-Allow-Origin", "*")
+			} else {
+				resp.SetHeader("Access-Control-Allow-Origin", origin)
+				// The answer depends on the Origin, shared caches must keep them apart
+				resp.AddVary("Origin")
+			}
+			if opts.AllowCredentials {
+				resp.SetHeader("Access-Control-Allow-Credentials", "true")
+			}
+			return resp
+		}
+	}
+}
+
+type SecurityHeadersOptions struct {
+	// FrameOptions is X-Frame-Options, e.g. "DENY" or "SAMEORIGIN"
+	FrameOptions string
+	// HSTSMaxAge is the Strict-Transport-Security max-age, 0 omits the header.
+	// It is only sent over TLS: browsers ignore it on plain HTTP anyway, and a
+	// server reachable both ways must not pin clients to a port without TLS.
+	HSTSMaxAge time.Duration
+	// HSTSIncludeSubdomains adds includeSubDomains to Strict-Transport-Security
+	HSTSIncludeSubdomains bool
+	// ReferrerPolicy is Referrer-Policy, e.g. "strict-origin-when-cross-origin"
+	ReferrerPolicy string
+	// ContentSecurityPolicy is Content-Security-Policy, e.g. "default-src 'self'"
+	ContentSecurityPolicy string
+}
+
+// SecurityHeaders adds the configured browser security headers to every response.
+// Empty options are omitted, and a header the handler already set is kept.
+func SecurityHeaders(opts SecurityHeadersOptions) Middleware {
+	hsts := ""
+	if opts.HSTSMaxAge > 0 {
+		hsts = fmt.Sprintf("max-age=%d", int64(opts.HSTSMaxAge.Seconds()))
+		if opts.HSTSIncludeSubdomains {
+			hsts += "; includeSubDomains"
+		}
+	}
+	headers := map[string]string{
+		"X-Frame-Options":         opts.FrameOptions,
+		"Referrer-Policy":         opts.ReferrerPolicy,
+		"Content-Security-Policy": opts.ContentSecurityPolicy,
+	}
+
+	return func(next HandleFunc) HandleFunc {
+		return func(r *Request) *Response {
+			resp := next(r)
+			for name, value := range headers {
+				if _, set := resp.Headers[name]; value != "" && !set {
+					resp.SetHeader(name, value)
+				}
+			}
+			if _, set := resp.Headers["Strict-Transport-Security"]; hsts != "" && r.TLS != nil && !set {
+				resp.SetHeader("Strict-Transport-Security", hsts)
+			}
+			return resp
+		}
+	}
+}
+
+// BasicAuth rejects requests without valid "Authorization: Basic" credentials
+// with 401 and a challenge for realm. check decides whether user/pass are valid;
+// StaticCredentials builds a timing-safe check for a single account.
+func BasicAuth(realm string, check func(user, pass string) bool) Middleware {
+	challenge := fmt.Sprintf("Basic realm=%q, charset=\"UTF-8\"", realm)
+
+	return func(next HandleFunc) HandleFunc {
+		return func(r *Request) *Response {
+			// Authorization: Basic base64("user:pass")
+			if user, pass, ok := parseBasicAuth(r); ok && check(user, pass) {
+				return next(r)
+			}
+			resp := NewResponse(http.StatusUnauthorized, "Unauthorized", []byte("Unauthorized"))
+			resp.SetHeader("WWW-Authenticate", challenge)
+			return resp
+		}
+	}
+}
+
+func parseBasicAuth(r *Request) (user, pass string, ok bool) {
+	header, ok := r.GetHeader("Authorization")
+	if !ok {
+		return "", "", false
+	}
+	scheme, encoded, ok := strings.Cut(header, " ")
+	if !ok || !strings.EqualFold(scheme, "Basic") {
+		return "", "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return "", "", false
+	}
+	// The password may contain ':' but the user name may not
+	return strings.Cut(string(decoded), ":")
+}
+
+// StaticCredentials returns a BasicAuth check accepting exactly one user/password.
+func StaticCredentials(user, pass string) func(string, string) bool {
+	/*
+	   Why constant time?
+	     A plain == returns at the first differing byte, so an attacker can
+	     measure response times and guess the secret byte by byte.
+	     Hashing first gives both sides the same length (ConstantTimeCompare
+	     leaks length mismatches), and ConstantTimeCompare always looks at
+	     every byte. Both comparisons run even if the first one fails.
+	*/
+	wantUser := sha256.Sum256([]byte(user))
+	wantPass := sha256.Sum256([]byte(pass))
+	return func(u, p string) bool {
+		gotUser := sha256.Sum256([]byte(u))
+		gotPass := sha256.Sum256([]byte(p))
+		userOK := subtle.ConstantTimeCompare(gotUser[:], wantUser[:])
+		passOK := subtle.ConstantTimeCompare(gotPass[:], wantPass[:])
+		return userOK&passOK == 1
+	}
+}
+
+type tokenBucket struct {
+	tokens   float64
+	lastSeen time.Time
+}
+
+/*
+   Token bucket:
+     Every IP has a bucket holding up to `burst` tokens, refilled at `rps`
+     tokens per second. A request takes one token; an empty bucket means
+     "too many requests" until enough time has passed to refill one.
+
+       burst=3, rps=1:  t=0.0 ●●● → 3 requests pass → ○○○
+                        t=0.1 ○○○ → 429, Retry-After: 1
+                        t=1.0 ●○○ → 1 request passes
+*/
+
+// RateLimit allows each client IP rps requests per second on average,
+// with bursts of up to burst requests. Excess requests get 429 with Retry-After.
+// It panics unless rps > 0 and burst >= 1, a limit that would let nothing
+// through, or everything, is a mistake at the call site.
+func RateLimit(rps float64, burst int) Middleware {
+	if !(rps > 0) || math.IsInf(rps, 1) || burst < 1 {
+		panic(fmt.Sprintf("RateLimit: need a finite rps > 0 and burst >= 1, got rps=%v burst=%d", rps, burst))
+	}
+	var (
+		mu        sync.Mutex
+		buckets   = make(map[string]*tokenBucket)
+		lastSweep = time.Now()
+	)
+	// A bucket untouched this long has refilled completely and is identical to a new one
+	idleTTL := time.Duration(float64(burst)/rps*float64(time.Second)) + time.Minute
+
+	// take consumes a token for ip, or reports how long until one is available
+	take := func(ip string, now time.Time) (bool, time.Duration) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		// Forget idle clients so the map doesn't grow with every IP ever seen
+		if now.Sub(lastSweep) > idleTTL {
+			for key, b := range buckets {
+				if now.Sub(b.lastSeen) > idleTTL {
+					delete(buckets, key)
+				}
+			}
+			lastSweep = now
+		}
+
+		b, ok := buckets[ip]
+		if !ok {
+			b = &tokenBucket{tokens: float64(burst), lastSeen: now}
+			buckets[ip] = b
+		}
+		b.tokens = math.Min(float64(burst), b.tokens+now.Sub(b.lastSeen).Seconds()*rps)
+		b.lastSeen = now
+
+		if b.tokens < 1 {
+			return false, time.Duration((1 - b.tokens) / rps * float64(time.Second))
+		}
+		b.tokens--
+		return true, 0
+	}
+
+	return func(next HandleFunc) HandleFunc {
+		return func(r *Request) *Response {
+			ip := r.RemoteAddr
+			if host, _, err := net.SplitHostPort(ip); err == nil {
+				ip = host // Limit per IP, not per connection (ephemeral port)
+			}
+
+			allowed, wait := take(ip, time.Now())
+			if allowed {
+				return next(r)
+			}
+			resp := NewResponse(http.StatusTooManyRequests, "Too Many Requests", []byte("Too Many Requests"))
+			resp.SetHeader("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			return resp
+		}
+	}
+}
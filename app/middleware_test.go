@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"io"
+	"log"
+	"math"
+	"math/big"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func okHandler(r *Request) *Response {
+	return NewResponse(http.StatusOK, "OK", []byte("ok"))
+}
+
+func TestRateLimit(t *testing.T) {
+	handler := RateLimit(1, 2)(okHandler)
+	req := newTestRequest(http.MethodGet, "/", nil, "")
+	req.RemoteAddr = "203.0.113.7:50000"
+
+	for i := range 2 {
+		if resp := handler(req); resp.StatusCode != http.StatusOK {
+			t.Fatalf("request %d within burst: got %d", i+1, resp.StatusCode)
+		}
+	}
+	resp := handler(req)
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("request over burst: got %d, want 429", resp.StatusCode)
+	}
+	if got := resp.Headers["Retry-After"]; got != "1" {
+		t.Errorf("Retry-After: got %q, want 1", got)
+	}
+
+	// Another port is the same client, another IP is not
+	req.RemoteAddr = "203.0.113.7:50001"
+	if resp := handler(req); resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("same IP, new port: got %d, want 429", resp.StatusCode)
+	}
+	req.RemoteAddr = "203.0.113.8:50000"
+	if resp := handler(req); resp.StatusCode != http.StatusOK {
+		t.Errorf("other IP: got %d, want 200", resp.StatusCode)
+	}
+}
+
+func TestRateLimitInvalidArguments(t *testing.T) {
+	for _, tc := range []struct {
+		rps   float64
+		burst int
+	}{
+		{0, 1},
+		{-1, 1},
+		{math.NaN(), 1},
+		{math.Inf(1), 1},
+		{1, 0},
+		{1, -5},
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("RateLimit(%v, %d) did not panic", tc.rps, tc.burst)
+				}
+			}()
+			RateLimit(tc.rps, tc.burst)
+		}()
+	}
+}
+
+func TestCORS(t *testing.T) {
+	handler := CORS(CORSOptions{AllowedOrigins: []string{"https://app.example"}})(okHandler)
+
+	resp := handler(newTestRequest(http.MethodGet, "/", map[string]string{"Origin": "https://app.example"}, ""))
+	if resp.StatusCode != http.StatusOK || resp.Headers["Access-Control-Allow-Origin"] != "https://app.example" {
+		t.Errorf("allowed origin: got %d, Allow-Origin %q", resp.StatusCode, resp.Headers["Access-Control-Allow-Origin"])
+	}
+	if resp.Headers["Vary"] != "Origin" {
+		t.Errorf("echoed origin without Vary: Origin: %q", resp.Headers["Vary"])
+	}
+
+	for name, headers := range map[string]map[string]string{
+		"disallowed origin": {"Origin": "https://evil.example"},
+		"no origin":         nil,
+	} {
+		resp := handler(newTestRequest(http.MethodGet, "/", headers, ""))
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("%s: got %d, the request itself still goes through", name, resp.StatusCode)
+		}
+		if _, ok := resp.Headers["Access-Control-Allow-Origin"]; ok {
+			t.Errorf("%s: got Access-Control-Allow-Origin", name)
+		}
+	}
+
+	wildcard := CORS(CORSOptions{AllowedOrigins: []string{"*"}})(okHandler)
+	resp = wildcard(newTestRequest(http.MethodGet, "/", map[string]string{"Origin": "https://any.example"}, ""))
+	if got := resp.Headers["Access-Control-Allow-Origin"]; got != "*" {
+		t.Errorf("wildcard: Allow-Origin %q, want *", got)
+	}
+
+	// Credentials can't be combined with "*", the origin is echoed instead
+	credentials := CORS(CORSOptions{AllowedOrigins: []string{"*"}, AllowCredentials: true})(okHandler)
+	resp = credentials(newTestRequest(http.MethodGet, "/", map[string]string{"Origin": "https://any.example"}, ""))
+	if resp.Headers["Access-Control-Allow-Origin"] != "https://any.example" || resp.Headers["Access-Control-Allow-Credentials"] != "true" {
+		t.Errorf("credentials: got %v", resp.Headers)
+	}
+}
+
+func TestCORSPreflight(t *testing.T) {
+	s, _ := newTestServer(t, testConfig())
+	s.router.Use(CORS(CORSOptions{
+		AllowedOrigins: []string{"https://app.example"},
+		AllowedMethods: []string{http.MethodGet, http.MethodPut},
+		AllowedHeaders: []string{"Content-Type", "X-Token"},
+		MaxAge:         10 * time.Minute,
+	}))
+	start(t, s)
+
+	// /echo/ only takes GET and HEAD, the preflight is answered before that check
+	resp, body := get(t, s, http.MethodOptions, "/echo/x", "Origin: https://app.example", "Access-Control-Request-Method: PUT")
+	if resp.StatusCode != http.StatusNoContent || body != "" {
+		t.Fatalf("preflight: got %d %q, want 204", resp.StatusCode, body)
+	}
+	for name, want := range map[string]string{
+		"Access-Control-Allow-Origin":  "https://app.example",
+		"Access-Control-Allow-Methods": "GET, PUT",
+		"Access-Control-Allow-Headers": "Content-Type, X-Token",
+		"Access-Control-Max-Age":       "600",
+	} {
+		if got := resp.Header.Get(name); got != want {
+			t.Errorf("%s: got %q, want %q", name, got, want)
+		}
+	}
+
+	// A preflight from elsewhere gets no permissions
+	resp, _ = get(t, s, http.MethodOptions, "/echo/x", "Origin: https://evil.example", "Access-Control-Request-Method: PUT")
+	if resp.Header.Get("Access-Control-Allow-Origin") != "" || resp.Header.Get("Access-Control-Allow-Methods") != "" {
+		t.Errorf("disallowed preflight: got %v", resp.Header)
+	}
+}
+
+func basicAuthHeader(user, pass string) map[string]string {
+	return map[string]string{"Authorization": "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+pass))}
+}
+
+func TestBasicAuth(t *testing.T) {
+	handler := BasicAuth("admin area", StaticCredentials("alice", "s3cret:with colon"))(okHandler)
+
+	if resp := handler(newTestRequest(http.MethodGet, "/", basicAuthHeader("alice", "s3cret:with colon"), "")); resp.StatusCode != http.StatusOK {
+		t.Errorf("valid credentials: got %d", resp.StatusCode)
+	}
+
+	for name, headers := range map[string]map[string]string{
+		"wrong password": basicAuthHeader("alice", "guess"),
+		"wrong user":     basicAuthHeader("bob", "s3cret:with colon"),
+		"missing header": nil,
+		"other scheme":   {"Authorization": "Bearer abc"},
+		"not base64":     {"Authorization": "Basic !!!"},
+		"no colon":       {"Authorization": "Basic " + base64.StdEncoding.EncodeToString([]byte("alice"))},
+	} {
+		resp := handler(newTestRequest(http.MethodGet, "/", headers, ""))
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("%s: got %d, want 401", name, resp.StatusCode)
+		}
+		if got, want := resp.Headers["Www-Authenticate"], `Basic realm="admin area", charset="UTF-8"`; got != want {
+			t.Errorf("%s: WWW-Authenticate %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestRateLimitRefill(t *testing.T) {
+	handler := RateLimit(50, 1)(okHandler)
+	req := newTestRequest(http.MethodGet, "/", nil, "")
+	req.RemoteAddr = "203.0.113.7:50000"
+
+	handler(req)
+	if resp := handler(req); resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("second request: got %d, want 429", resp.StatusCode)
+	}
+	time.Sleep(30 * time.Millisecond) // 1.5 tokens at 50 per second
+	if resp := handler(req); resp.StatusCode != http.StatusOK {
+		t.Errorf("after the refill: got %d, want 200", resp.StatusCode)
+	}
+}
+
+func TestRateLimitServer(t *testing.T) {
+	s, _ := newTestServer(t, testConfig())
+	s.router.Use(RateLimit(1, 3))
+	start(t, s)
+
+	// Every request comes from a new connection, and so a new port
+	for i := range 3 {
+		if resp, _ := get(t, s, http.MethodGet, "/echo/x"); resp.StatusCode != http.StatusOK {
+			t.Fatalf("request %d: got %d", i+1, resp.StatusCode)
+		}
+	}
+	resp, _ := get(t, s, http.MethodGet, "/echo/x")
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") == "" {
+		t.Errorf("over the burst: got %d, Retry-After %q", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+}
+
+var securityOptions = SecurityHeadersOptions{
+	FrameOptions:          "DENY",
+	HSTSMaxAge:            365 * 24 * time.Hour,
+	HSTSIncludeSubdomains: true,
+	ReferrerPolicy:        "strict-origin-when-cross-origin",
+	ContentSecurityPolicy: "default-src 'self'",
+}
+
+func TestSecurityHeaders(t *testing.T) {
+	handler := SecurityHeaders(securityOptions)(okHandler)
+	req := newTestRequest(http.MethodGet, "/", nil, "")
+	req.TLS = &tls.ConnectionState{}
+
+	resp := handler(req)
+	for name, want := range map[string]string{
+		"X-Frame-Options":           "DENY",
+		"Strict-Transport-Security": "max-age=31536000; includeSubDomains",
+		"Referrer-Policy":           "strict-origin-when-cross-origin",
+		"Content-Security-Policy":   "default-src 'self'",
+	} {
+		if got := resp.Headers[name]; got != want {
+			t.Errorf("%s: got %q, want %q", name, got, want)
+		}
+	}
+
+	// Over plain HTTP, HSTS would pin clients to a port that may not have TLS
+	resp = handler(newTestRequest(http.MethodGet, "/", nil, ""))
+	if _, set := resp.Headers["Strict-Transport-Security"]; set {
+		t.Error("Strict-Transport-Security sent over plaintext")
+	}
+	if resp.Headers["X-Frame-Options"] != "DENY" {
+		t.Error("the other headers don't depend on TLS")
+	}
+}
+
+func TestSecurityHeadersOmitted(t *testing.T) {
+	own := func(r *Request) *Response {
+		resp := NewResponse(http.StatusOK, "OK", nil)
+		resp.SetHeader("X-Frame-Options", "SAMEORIGIN")
+		return resp
+	}
+	req := newTestRequest(http.MethodGet, "/", nil, "")
+	req.TLS = &tls.ConnectionState{}
+	resp := SecurityHeaders(SecurityHeadersOptions{FrameOptions: "DENY"})(own)(req)
+	if resp.Headers["X-Frame-Options"] != "SAMEORIGIN" {
+		t.Errorf("the handler's X-Frame-Options was replaced with %q", resp.Headers["X-Frame-Options"])
+	}
+	for _, name := range []string{"Strict-Transport-Security", "Referrer-Policy", "Content-Security-Policy"} {
+		if _, set := resp.Headers[name]; set {
+			t.Errorf("%s sent without being configured", name)
+		}
+	}
+}
+
+// selfSignedCert is a throwaway certificate for 127.0.0.1
+func selfSignedCert(t *testing.T) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestSecurityHeadersOverTLS(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l = tls.NewListener(l, &tls.Config{Certificates: []tls.Certificate{selfSignedCert(t)}})
+	s, err := NewServerWithListener(testConfig(), log.New(io.Discard, "", 0), l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.router.Use(SecurityHeaders(securityOptions))
+	start(t, s)
+
+	conn, err := tls.Dial("tcp", s.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "GET /echo/hi HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got := resp.Header.Get("Strict-Transport-Security"); got != "max-age=31536000; includeSubDomains" {
+		t.Errorf("Strict-Transport-Security over TLS: got %q", got)
+	}
+
+	// The same middleware on a plaintext server
+	plain, _ := newTestServer(t, testConfig())
+	plain.router.Use(SecurityHeaders(securityOptions))
+	start(t, plain)
+	if resp, _ := get(t, plain, http.MethodGet, "/echo/hi"); resp.Header.Get("Strict-Transport-Security") != "" {
+		t.Error("Strict-Transport-Security sent over plaintext")
+	}
+}
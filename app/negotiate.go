@@ -0,0 +1,146 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Content negotiation (RFC 9110 §12.5.1):
+//
+//   Accept: text/html;q=0.9, application/json, */*;q=0.1
+//
+// Every media range carries a weight q (default 1). A range matches an
+// offer exactly ("application/json"), by type ("text/*") or always ("*/*"),
+// and the most specific matching range decides the offer's weight:
+//
+//   offer "application/json" → "application/json"  q=1
+//   offer "text/plain"       → "*/*"                q=0.1
+//
+// q=0 means "not acceptable". Equal weights are settled by the server's
+// own order of offers.
+
+type acceptRange struct {
+	mediaType string // "text/html", "text/*" or "*/*", lowercased
+	q         float64
+}
+
+// parseAccept turns an Accept header into its media ranges, highest weight first.
+// Malformed entries are skipped, a malformed q counts as 1.
+func parseAccept(header string) []acceptRange {
+	var ranges []acceptRange
+	for part := range strings.SplitSeq(header, ",") {
+		mediaType, params, _ := strings.Cut(part, ";")
+		mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+		if !strings.Contains(mediaType, "/") {
+			continue
+		}
+
+		q := 1.0
+		for param := range strings.SplitSeq(params, ";") {
+			name, value, _ := strings.Cut(param, "=")
+			if strings.EqualFold(strings.TrimSpace(name), "q") {
+				if v, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil && v >= 0 && v <= 1 {
+					q = v
+				}
+			}
+		}
+		ranges = append(ranges, acceptRange{mediaType: mediaType, q: q})
+	}
+
+	sort.SliceStable(ranges, func(i, j int) bool { return ranges[i].q > ranges[j].q })
+	return ranges
+}
+
+// negotiate picks the offer the client prefers according to its Accept header.
+// Without an Accept header any offer will do, so the first one is returned;
+// "" means the client accepts none of them.
+func negotiate(r *Request, offers ...string) string {
+	header, ok := r.GetHeader("Accept")
+	if !ok || strings.TrimSpace(header) == "" {
+		if len(offers) == 0 {
+			return ""
+		}
+		return offers[0]
+	}
+	ranges := parseAccept(header)
+
+	best, bestQ := "", 0.0
+	for _, offer := range offers {
+		if q := acceptWeight(ranges, strings.ToLower(offer)); q > bestQ {
+			best, bestQ = offer, q
+		}
+	}
+	return best
+}
+
+// acceptWeight is the q of the most specific range matching offer, 0 if none does
+func acceptWeight(ranges []acceptRange, offer string) float64 {
+	offerType, _, _ := strings.Cut(offer, "/")
+
+	q, specificity := 0.0, -1
+	for _, ar := range ranges {
+		var s int
+		switch {
+		case ar.mediaType == offer:
+			s = 2
+		case ar.mediaType == offerType+"/*":
+			s = 1
+		case ar.mediaType == "*/*":
+			s = 0
+		default:
+			continue
+		}
+		if s > specificity {
+			q, specificity = ar.q, s
+		}
+	}
+	return q
+}
+
+// acceptEncodingWeight is the q an Accept-Encoding header like
+// "br;q=1.0, gzip;q=0.8" gives coding: from its own entry, else from "*",
+// else 0. "gzip;q=0" rules gzip out even when "*" would allow it.
+func acceptEncodingWeight(header, coding string) float64 {
+	q, wildcard := -1.0, 0.0
+	for part := range strings.SplitSeq(header, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		name = strings.TrimSpace(name)
+
+		weight := 1.0
+		for param := range strings.SplitSeq(params, ";") {
+			key, value, _ := strings.Cut(param, "=")
+			if strings.EqualFold(strings.TrimSpace(key), "q") {
+				if v, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil && v >= 0 && v <= 1 {
+					weight = v
+				}
+			}
+		}
+		switch {
+		case strings.EqualFold(name, coding):
+			q = weight
+		case name == "*":
+			wildcard = weight
+		}
+	}
+	if q >= 0 {
+		return q
+	}
+	return wildcard
+}
+
+// chooseEncoding picks the content coding for a response from the server's
+// preference, most preferred first: the one the client weights highest, ties
+// going to the earlier one. "" means the client accepts none of them.
+//
+//	Accept-Encoding: deflate, gzip   preference [gzip deflate] → gzip
+//	Accept-Encoding: gzip;q=0.5, deflate   same preference     → deflate
+func chooseEncoding(header string, preference []string) string {
+	best, bestQ := "", 0.0
+	for _, coding := range preference {
+		if q := acceptEncodingWeight(header, coding); q > bestQ {
+			best, bestQ = coding, q
+		}
+	}
+	return best
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"compress/zlib"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestNegotiate(t *testing.T) {
+	offers := []string{"text/plain", "application/json"}
+	for _, tc := range []struct{ accept, want string }{
+		{"", "text/plain"}, // no preference, the first offer
+		{"application/json", "application/json"},
+		{"text/plain;q=0.5, application/json", "application/json"},
+		{"application/json;q=0.2, text/*;q=0.8", "text/plain"},
+		{"*/*", "text/plain"},
+		{"*/*;q=0.1, application/json;q=0.5", "application/json"},
+		{"APPLICATION/JSON", "application/json"},
+		{"application/json;q=0, */*", "text/plain"}, // the specific q=0 wins over */*
+		{"image/png", ""},
+		{"application/json;q=bogus, text/plain;q=0.9", "application/json"}, // malformed q counts as 1
+		{"garbage, application/json", "application/json"},
+	} {
+		var headers map[string]string
+		if tc.accept != "" {
+			headers = map[string]string{"Accept": tc.accept}
+		}
+		if got := negotiate(newTestRequest(http.MethodGet, "/", headers, ""), offers...); got != tc.want {
+			t.Errorf("Accept %q: got %q, want %q", tc.accept, got, tc.want)
+		}
+	}
+}
+
+func TestEchoNegotiation(t *testing.T) {
+	s, _ := startTestServer(t, testConfig())
+
+	for _, tc := range []struct {
+		accept      []string
+		contentType string
+		body        string
+	}{
+		{nil, "text/plain", "hi"},
+		{[]string{"Accept: application/json"}, "application/json", `{"echo":"hi"}`},
+		{[]string{"Accept: */*"}, "text/plain", "hi"},
+		{[]string{"Accept: text/plain;q=0.1, application/*"}, "application/json", `{"echo":"hi"}`},
+	} {
+		resp, body := get(t, s, http.MethodGet, "/echo/hi", tc.accept...)
+		if resp.Header.Get("Content-Type") != tc.contentType || body != tc.body {
+			t.Errorf("%v: got %q %q, want %q %q", tc.accept, resp.Header.Get("Content-Type"), body, tc.contentType, tc.body)
+		}
+		if resp.Header.Get("Vary") != "Accept" {
+			t.Errorf("%v: Vary %q, want Accept", tc.accept, resp.Header.Get("Vary"))
+		}
+	}
+}
+
+func TestChooseEncoding(t *testing.T) {
+	gzipFirst, deflateFirst := []string{"gzip", "deflate"}, []string{"deflate", "gzip"}
+	for _, tc := range []struct {
+		header     string
+		preference []string
+		want       string
+	}{
+		{"gzip, deflate", gzipFirst, "gzip"},
+		{"deflate, gzip", gzipFirst, "gzip"}, // client order doesn't break ties
+		{"gzip, deflate", deflateFirst, "deflate"},
+		{"gzip;q=0.5, deflate", gzipFirst, "deflate"}, // q-values outrank the preference
+		{"gzip;q=0, *", gzipFirst, "deflate"},
+		{"*", deflateFirst, "deflate"},
+		{"br", gzipFirst, ""},
+		{"gzip", []string{"deflate"}, ""},
+		{"gzip, deflate", []string{}, ""},
+		{"identity", gzipFirst, ""},
+	} {
+		if got := chooseEncoding(tc.header, tc.preference); got != tc.want {
+			t.Errorf("%q with %v: got %q, want %q", tc.header, tc.preference, got, tc.want)
+		}
+	}
+}
+
+func TestCompressionPreference(t *testing.T) {
+	body := string(compressibleText(500))
+	serve := func(preference []string, accept string) *http.Response {
+		t.Helper()
+		config := testConfig()
+		config.CompressionPreference = preference
+		s, _ := newTestServer(t, config)
+		s.router.RegisterExactRoute("/text", func(r *Request) *Response {
+			return NewResponse(http.StatusOK, "OK", []byte(body))
+		})
+		start(t, s)
+		resp, _ := get(t, s, http.MethodGet, "/text", "Accept-Encoding: "+accept)
+		return resp
+	}
+
+	for _, tc := range []struct {
+		preference []string
+		accept     string
+		want       string
+	}{
+		{nil, "deflate, gzip", "gzip"},
+		{[]string{"deflate", "gzip"}, "gzip, deflate", "deflate"},
+		{[]string{"deflate", "gzip"}, "gzip, deflate;q=0.9", "gzip"},
+		{[]string{}, "gzip, deflate", ""},
+	} {
+		if got := serve(tc.preference, tc.accept).Header.Get("Content-Encoding"); got != tc.want {
+			t.Errorf("%v, Accept-Encoding %q: got %q, want %q", tc.preference, tc.accept, got, tc.want)
+		}
+	}
+
+	// deflate is the zlib format (RFC 9110 §8.4.1.2), not raw DEFLATE
+	config := testConfig()
+	config.CompressionPreference = []string{"deflate"}
+	s, _ := newTestServer(t, config)
+	s.router.RegisterExactRoute("/text", func(r *Request) *Response {
+		return NewResponse(http.StatusOK, "OK", []byte(body))
+	})
+	start(t, s)
+	_, compressed := get(t, s, http.MethodGet, "/text", "Accept-Encoding: deflate")
+	zr, err := zlib.NewReader(strings.NewReader(compressed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := io.ReadAll(zr); string(got) != body {
+		t.Errorf("deflate body decodes to %d bytes, want %d", len(got), len(body))
+	}
+
+	if err := (Config{CompressionPreference: []string{"gzip", "br"}}).validate(); err == nil {
+		t.Error("an unsupported coding was accepted")
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/pprof"
+	"strconv"
+)
+
+/*
+   net/http/pprof on this server:
+
+     /debug/pprof/            index, and every named profile below it
+     /debug/pprof/heap        (goroutine, allocs, block, mutex, threadcreate...)
+     /debug/pprof/cmdline
+     /debug/pprof/symbol
+     /debug/pprof/profile     CPU profile, ?seconds=N (default 30)
+     /debug/pprof/trace       execution trace, ?seconds=N (default 1)
+
+   The stdlib handlers are http.Handlers. Most of them finish quickly, so
+   they are run against an in-memory http.ResponseWriter and the result is
+   copied into a Response. profile and trace block for "seconds" before
+   writing anything, longer than WriteTimeout allows: they are run as a
+   stream instead, which lifts the write deadline (see handleConnection).
+
+   Profiles expose the server's internals, only enable this on trusted networks.
+*/
+
+const pprofPrefix = "/debug/pprof/"
+
+// registerPprof serves the net/http/pprof profiles under /debug/pprof/
+func (s *Server) registerPprof() {
+	// The index serves named profiles itself: "/debug/pprof/heap" → pprof.Handler("heap")
+	get := WithMethods(http.MethodGet, http.MethodHead)
+	s.router.RegisterPrefixRoute(pprofPrefix, adaptHTTPHandler(http.HandlerFunc(pprof.Index)), get)
+	s.router.RegisterExactRoute(pprofPrefix+"cmdline", adaptHTTPHandler(http.HandlerFunc(pprof.Cmdline)), get)
+	// go tool pprof posts the addresses it wants symbolized
+	s.router.RegisterExactRoute(pprofPrefix+"symbol", adaptHTTPHandler(http.HandlerFunc(pprof.Symbol)),
+		WithMethods(http.MethodGet, http.MethodHead, http.MethodPost))
+	s.router.RegisterExactRoute(pprofPrefix+"profile", adaptStreamingHTTPHandler(http.HandlerFunc(pprof.Profile)), get)
+	s.router.RegisterExactRoute(pprofPrefix+"trace", adaptStreamingHTTPHandler(http.HandlerFunc(pprof.Trace)), get)
+}
+
+// adaptHTTPHandler runs a net/http handler to completion and turns what it wrote into a Response
+func adaptHTTPHandler(h http.Handler) HandleFunc {
+	return func(r *Request) *Response {
+		httpReq, err := toHTTPRequest(r)
+		if err != nil {
+			return NewResponse(http.StatusBadRequest, "Bad Request", []byte(err.Error()))
+		}
+
+		rw := &bufferedResponseWriter{header: make(http.Header), status: http.StatusOK}
+		h.ServeHTTP(rw, httpReq)
+
+		resp := NewResponse(rw.status, http.StatusText(rw.status), rw.body.Bytes())
+		for name, values := range rw.header {
+			if len(values) > 0 {
+				resp.SetHeader(name, values[0])
+			}
+		}
+		return resp
+	}
+}
+
+// adaptStreamingHTTPHandler runs a net/http handler as a chunked stream.
+// The status line goes out before the handler runs, so it is always 200 and
+// headers the handler sets are lost; only the body it writes reaches the client.
+// A bad "seconds" parameter is still rejected up front with a real 400.
+func adaptStreamingHTTPHandler(h http.Handler) HandleFunc {
+	return func(r *Request) *Response {
+		if seconds := r.Query().Get("seconds"); seconds != "" {
+			if n, err := strconv.Atoi(seconds); err != nil || n <= 0 {
+				return NewResponse(http.StatusBadRequest, "Bad Request", []byte("invalid seconds parameter"))
+			}
+		}
+		httpReq, err := toHTTPRequest(r)
+		if err != nil {
+			return NewResponse(http.StatusBadRequest, "Bad Request", []byte(err.Error()))
+		}
+
+		resp := NewStreamResponse(http.StatusOK, "OK", func(w io.Writer) error {
+			rw := &streamResponseWriter{w: w, header: make(http.Header)}
+			h.ServeHTTP(rw, httpReq)
+			return rw.err
+		})
+		resp.SetHeader("Content-Type", "application/octet-stream")
+		return resp
+	}
+}
+
+// toHTTPRequest rebuilds r as a *http.Request for a net/http handler
+func toHTTPRequest(r *Request) (*http.Request, error) {
+	target := r.Path
+	if r.RawQuery != "" {
+		target += "?" + r.RawQuery
+	}
+	httpReq, err := http.NewRequestWithContext(r.Context(), r.Method, target, bytes.NewReader(r.Body))
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range r.Headers {
+		httpReq.Header.Set(name, value)
+	}
+	httpReq.Host = r.Host
+	httpReq.RemoteAddr = r.RemoteAddr
+	httpReq.Proto, httpReq.ProtoMajor, httpReq.ProtoMinor = r.Version, r.ProtoMajor, r.ProtoMinor
+	return httpReq, nil
+}
+
+// bufferedResponseWriter collects a net/http handler's response in memory
+type bufferedResponseWriter struct {
+	header      http.Header
+	body        bytes.Buffer
+	status      int
+	wroteHeader bool
+}
+
+func (w *bufferedResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *bufferedResponseWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.status, w.wroteHeader = status, true
+}
+
+func (w *bufferedResponseWriter) Write(p []byte) (int, error) {
+	w.wroteHeader = true
+	return w.body.Write(p)
+}
+
+// streamResponseWriter passes a net/http handler's body through to a StreamFunc's writer
+type streamResponseWriter struct {
+	w      io.Writer
+	header http.Header // accepted and ignored, the headers are already sent
+	err    error       // first write error, the client is gone
+}
+
+func (w *streamResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *streamResponseWriter) WriteHeader(status int) {}
+
+func (w *streamResponseWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	n, err := w.w.Write(p)
+	w.err = err
+	return n, err
+}
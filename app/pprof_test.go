@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestPprof(t *testing.T) {
+	config := testConfig()
+	config.EnablePprof = true
+	s, _ := startTestServer(t, config)
+
+	resp, body := get(t, s, http.MethodGet, "/debug/pprof/heap")
+	if resp.StatusCode != http.StatusOK || len(body) == 0 {
+		t.Errorf("heap: got %d with %d bytes", resp.StatusCode, len(body))
+	}
+	if _, body := get(t, s, http.MethodGet, "/debug/pprof/heap?debug=1"); !strings.HasPrefix(body, "heap profile:") {
+		t.Errorf("heap?debug=1: got %.40q", body)
+	}
+	if resp, body := get(t, s, http.MethodGet, "/debug/pprof/"); resp.StatusCode != http.StatusOK || !strings.Contains(body, "goroutine") {
+		t.Errorf("index: got %d %.40q", resp.StatusCode, body)
+	}
+	// Checked before the stream starts, a 200 would be too late to take back
+	if resp, _ := get(t, s, http.MethodGet, "/debug/pprof/profile?seconds=abc"); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("profile?seconds=abc: got %d, want 400", resp.StatusCode)
+	}
+	if resp, _ := get(t, s, http.MethodPost, "/debug/pprof/heap"); resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("POST heap: got %d, want 405", resp.StatusCode)
+	}
+}
+
+func TestPprofDisabled(t *testing.T) {
+	s, _ := startTestServer(t, testConfig())
+	for _, target := range []string{"/debug/pprof/", "/debug/pprof/heap"} {
+		if resp, _ := get(t, s, http.MethodGet, target); resp.StatusCode != http.StatusNotFound {
+			t.Errorf("%s by default: got %d, want 404", target, resp.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// A v1 header is at most 107 bytes including CRLF
+const maxProxyHeaderLen = 107
+
+// readProxyHeader parses a PROXY protocol v1 preamble and returns the client address.
+func readProxyHeader(r io.Reader) (string, error) {
+	/*
+	   A load balancer in TCP mode can't add X-Forwarded-For, so it prefixes the
+	   connection with one line before any HTTP bytes:
+
+	     PROXY TCP4 203.0.113.7 10.0.0.1 51234 4221\r\n   ← src ip, dst ip, src port, dst port
+	     GET / HTTP/1.1\r\n
+	     ...
+
+	   "PROXY UNKNOWN\r\n" means the balancer doesn't know the source (e.g. health
+	   checks); the returned address is then empty and the peer address is kept.
+
+	   The line is read byte by byte so nothing after it gets consumed.
+	*/
+	var line []byte
+	buf := make([]byte, 1)
+	for {
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return "", err
+		}
+		line = append(line, buf[0])
+		if buf[0] == '\n' {
+			break
+		}
+		if len(line) >= maxProxyHeaderLen {
+			return "", errors.New("proxy protocol: header too long")
+		}
+	}
+
+	header, ok := strings.CutSuffix(string(line), "\r\n")
+	if !ok {
+		return "", errors.New("proxy protocol: header not terminated by CRLF")
+	}
+	fields := strings.Split(header, " ")
+	if fields[0] != "PROXY" || len(fields) < 2 {
+		return "", fmt.Errorf("proxy protocol: invalid header %q", header)
+	}
+
+	switch fields[1] {
+	case "UNKNOWN":
+		return "", nil
+	case "TCP4", "TCP6":
+	default:
+		return "", fmt.Errorf("proxy protocol: unsupported protocol %q", fields[1])
+	}
+	if len(fields) != 6 {
+		return "", fmt.Errorf("proxy protocol: invalid header %q", header)
+	}
+
+	srcIP, dstIP := net.ParseIP(fields[2]), net.ParseIP(fields[3])
+	if srcIP == nil || dstIP == nil || (fields[1] == "TCP4") != (srcIP.To4() != nil) {
+		return "", fmt.Errorf("proxy protocol: invalid address in %q", header)
+	}
+	for _, port := range fields[4:] {
+		if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+			return "", fmt.Errorf("proxy protocol: invalid port %q", port)
+		}
+	}
+	return net.JoinHostPort(srcIP.String(), fields[4]), nil
+}
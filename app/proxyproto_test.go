@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestReadProxyHeader(t *testing.T) {
+	for _, tc := range []struct{ line, want string }{
+		{"PROXY TCP4 203.0.113.7 10.0.0.1 51234 4221\r\n", "203.0.113.7:51234"},
+		{"PROXY TCP6 2001:db8::1 2001:db8::2 51234 4221\r\n", "[2001:db8::1]:51234"},
+		{"PROXY UNKNOWN\r\n", ""},
+	} {
+		r := strings.NewReader(tc.line + "GET / HTTP/1.1\r\n")
+		got, err := readProxyHeader(r)
+		if err != nil || got != tc.want {
+			t.Errorf("%q: got %q %v, want %q", tc.line, got, err, tc.want)
+		}
+		// Nothing past the preamble is consumed
+		if r.Len() != len("GET / HTTP/1.1\r\n") {
+			t.Errorf("%q: read %d bytes past the header", tc.line, len("GET / HTTP/1.1\r\n")-r.Len())
+		}
+	}
+
+	for _, line := range []string{
+		"GET / HTTP/1.1\r\n",
+		"PROXY TCP4 203.0.113.7 10.0.0.1 51234\r\n",
+		"PROXY TCP4 2001:db8::1 10.0.0.1 51234 4221\r\n", // family mismatch
+		"PROXY TCP4 203.0.113.7 10.0.0.1 99999 4221\r\n",
+		"PROXY TCP4 not-an-ip 10.0.0.1 51234 4221\r\n",
+		"PROXY UDP4 203.0.113.7 10.0.0.1 51234 4221\r\n",
+		"PROXY TCP4 203.0.113.7 10.0.0.1 51234 4221\n",
+		"PROXY " + strings.Repeat("x", maxProxyHeaderLen) + "\r\n",
+		"PROXY TCP4", // cut off
+	} {
+		if _, err := readProxyHeader(strings.NewReader(line)); err == nil {
+			t.Errorf("%q accepted", line)
+		}
+	}
+}
+
+func TestProxyProtocol(t *testing.T) {
+	config := testConfig()
+	config.ProxyProtocol = true
+	s := remoteAddrServer(t, config)
+
+	resp, body := roundTrip(t, s, "PROXY TCP4 203.0.113.7 10.0.0.1 51234 4221\r\nGET /addr HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	if resp.StatusCode != http.StatusOK || body != "203.0.113.7:51234" {
+		t.Errorf("valid PROXY line: got %d %q", resp.StatusCode, body)
+	}
+
+	// A malformed preamble gets no response at all, the connection is just closed
+	if out := rawResponse(t, s, "PROXY TCP4 bogus\r\nGET /addr HTTP/1.1\r\nHost: localhost\r\n\r\n"); out != "" {
+		t.Errorf("malformed PROXY line: got %q, want the connection closed", out)
+	}
+	if out := rawResponse(t, s, "GET /addr HTTP/1.1\r\nHost: localhost\r\n\r\n"); out != "" {
+		t.Errorf("missing PROXY line: got %q, want the connection closed", out)
+	}
+}
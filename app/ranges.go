@@ -0,0 +1,215 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+   Range requests (RFC 9110 §14):
+
+     GET /files/video.mp4
+     Range: bytes=1000-1999
+
+     HTTP/1.1 206 Partial Content
+     Content-Range: bytes 1000-1999/5000
+     Content-Length: 1000
+
+   A client resuming a download also sends If-Range with the validator of
+   the copy it already has. If the file changed since, the ranges would
+   splice two different versions together, so the whole file is sent (200):
+
+     If-Range: "1388-18de49272768f1b6"   ← ETag, must match exactly
+     If-Range: Wed, 14 Oct 2026 04:55:34 GMT   ← must equal the mtime
+*/
+
+// byteRange is one satisfiable range, already resolved against the file size
+type byteRange struct {
+	start, length int64
+}
+
+// errRangeNotSatisfiable means no range overlaps the file, answered with 416
+var errRangeNotSatisfiable = errors.New("range not satisfiable")
+
+// parseRange resolves a Range header like "bytes=0-99, 200-, -50" against size.
+// Ranges past the end are dropped; if none is left errRangeNotSatisfiable is returned.
+// Any other error means the header is malformed and should be ignored.
+func parseRange(header string, size int64) ([]byteRange, error) {
+	spec, ok := strings.CutPrefix(strings.TrimSpace(header), "bytes=")
+	if !ok {
+		return nil, fmt.Errorf("unsupported range unit: %s", header)
+	}
+
+	var ranges []byteRange
+	for part := range strings.SplitSeq(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		first, last, ok := strings.Cut(part, "-")
+		if !ok {
+			return nil, fmt.Errorf("invalid range: %s", part)
+		}
+
+		if first == "" {
+			// "-50" is the last 50 bytes
+			n, err := strconv.ParseInt(last, 10, 64)
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("invalid range: %s", part)
+			}
+			if n == 0 || size == 0 {
+				continue
+			}
+			n = min(n, size)
+			ranges = append(ranges, byteRange{start: size - n, length: n})
+			continue
+		}
+
+		start, err := strconv.ParseInt(first, 10, 64)
+		if err != nil || start < 0 {
+			return nil, fmt.Errorf("invalid range: %s", part)
+		}
+		end := size - 1 // "200-" runs to the end
+		if last != "" {
+			end, err = strconv.ParseInt(last, 10, 64)
+			if err != nil || end < start {
+				return nil, fmt.Errorf("invalid range: %s", part)
+			}
+			end = min(end, size-1)
+		}
+		if start >= size {
+			continue
+		}
+		ranges = append(ranges, byteRange{start: start, length: end - start + 1})
+	}
+
+	if len(ranges) == 0 {
+		return nil, errRangeNotSatisfiable
+	}
+	return ranges, nil
+}
+
+// ifRangeMatches reports whether the ranges may be served, i.e. If-Range is
+// absent or still describes the file. Weak ETags never match (RFC 9110 §13.1.5).
+func ifRangeMatches(r *Request, info os.FileInfo) bool {
+	ifRange, ok := r.GetHeader("If-Range")
+	if !ok {
+		return true
+	}
+	ifRange = strings.TrimSpace(ifRange)
+	if strings.HasPrefix(ifRange, `"`) || strings.HasPrefix(ifRange, "W/") {
+		return ifRange == fileETag(info)
+	}
+
+	date, err := http.ParseTime(ifRange)
+	if err != nil {
+		return false
+	}
+	// HTTP dates have second precision
+	return date.Equal(info.ModTime().Truncate(time.Second))
+}
+
+// contentRange formats the Content-Range value of rng, e.g. "bytes 0-99/5000"
+func (rng byteRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", rng.start, rng.start+rng.length-1, size)
+}
+
+// serveRange answers a Range request for the file at path with 206 or 416.
+// It returns nil when the full file should be sent instead: the header is
+// malformed, or its ranges add up to more than the file itself.
+func (s *Server) serveRange(path string, info os.FileInfo, contentType, header string) *Response {
+	ranges, err := parseRange(header, info.Size())
+	if errors.Is(err, errRangeNotSatisfiable) {
+		resp := NewResponse(http.StatusRequestedRangeNotSatisfiable, "Range Not Satisfiable", nil)
+		resp.SetHeader("Content-Range", fmt.Sprintf("bytes */%d", info.Size()))
+		resp.SetHeader("Accept-Ranges", "bytes")
+		return resp
+	}
+	if err != nil {
+		return nil
+	}
+
+	// "bytes=0-,0-,0-,..." would make us send the file many times over,
+	// overlapping ranges are only served while they stay cheaper than the whole file
+	var total int64
+	for _, rng := range ranges {
+		total += rng.length
+	}
+	if total > info.Size() {
+		return nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return NewResponse(http.StatusInternalServerError, "Internal Server Error", []byte(err.Error()))
+	}
+	resp := NewResponse(http.StatusPartialContent, "Partial Content", nil)
+	if len(ranges) == 1 {
+		rng := ranges[0]
+		resp.BodyReader = struct {
+			io.Reader
+			io.Closer
+		}{io.NewSectionReader(file, rng.start, rng.length), file}
+		resp.SetHeader("Content-Type", contentType)
+		resp.SetHeader("Content-Length", strconv.FormatInt(rng.length, 10))
+		resp.SetHeader("Content-Range", rng.contentRange(info.Size()))
+	} else {
+		body, length, boundary := multipartRanges(file, ranges, contentType, info.Size())
+		resp.BodyReader = struct {
+			io.Reader
+			io.Closer
+		}{body, file}
+		resp.SetHeader("Content-Type", "multipart/byteranges; boundary="+boundary)
+		resp.SetHeader("Content-Length", strconv.FormatInt(length, 10))
+	}
+	resp.SetHeader("ETag", fileETag(info))
+	resp.SetHeader("Accept-Ranges", "bytes")
+	s.setCacheHeaders(resp)
+	return resp
+}
+
+/*
+   multipart/byteranges (RFC 9110 §14.6), one part per range in request order:
+
+     --3d6b6a416f9b5\r\n
+     Content-Type: text/plain\r\n
+     Content-Range: bytes 0-10/5000\r\n
+     \r\n
+     <bytes 0-10>\r\n
+     --3d6b6a416f9b5\r\n
+     ...
+     <bytes 20-30>\r\n
+     --3d6b6a416f9b5--\r\n
+
+   The parts are read straight from the file, the framing is small enough to
+   be built up front, which also gives the exact Content-Length.
+*/
+
+// multipartRanges returns the multipart body for ranges of file, its length and its boundary
+func multipartRanges(file io.ReaderAt, ranges []byteRange, contentType string, size int64) (io.Reader, int64, string) {
+	boundary := multipart.NewWriter(io.Discard).Boundary()
+
+	var readers []io.Reader
+	var length int64
+	for i, rng := range ranges {
+		part := fmt.Sprintf("--%s\r\nContent-Type: %s\r\nContent-Range: %s\r\n\r\n",
+			boundary, contentType, rng.contentRange(size))
+		if i > 0 {
+			part = "\r\n" + part // ends the previous part's data
+		}
+		readers = append(readers, strings.NewReader(part), io.NewSectionReader(file, rng.start, rng.length))
+		length += int64(len(part)) + rng.length
+	}
+	closing := fmt.Sprintf("\r\n--%s--\r\n", boundary)
+	readers = append(readers, strings.NewReader(closing))
+	length += int64(len(closing))
+
+	return io.MultiReader(readers...), length, boundary
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIfRange(t *testing.T) {
+	s, dir := filesServer(t, testConfig(), map[string]string{"a.txt": "0123456789"})
+	info, err := os.Stat(filepath.Join(dir, "a.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	etag := fileETag(info)
+	modified := info.ModTime().UTC().Format(http.TimeFormat)
+	earlier := info.ModTime().Add(-time.Hour).UTC().Format(http.TimeFormat)
+
+	for _, tc := range []struct {
+		ifRange string
+		status  int
+		body    string
+	}{
+		{etag, http.StatusPartialContent, "234"},
+		{`"stale"`, http.StatusOK, "0123456789"},
+		{modified, http.StatusPartialContent, "234"},
+		{earlier, http.StatusOK, "0123456789"},
+		{"not a validator", http.StatusOK, "0123456789"},
+	} {
+		resp, body := get(t, s, http.MethodGet, "/files/a.txt", "Range: bytes=2-4", "If-Range: "+tc.ifRange)
+		if resp.StatusCode != tc.status || body != tc.body {
+			t.Errorf("If-Range %s: got %d %q, want %d %q", tc.ifRange, resp.StatusCode, body, tc.status, tc.body)
+		}
+	}
+}
+
+func TestMultipleRanges(t *testing.T) {
+	s, _ := filesServer(t, testConfig(), map[string]string{"a.txt": "0123456789abcdefghij"})
+
+	resp, body := get(t, s, http.MethodGet, "/files/a.txt", "Range: bytes=0-3,15-")
+	if resp.StatusCode != http.StatusPartialContent {
+		t.Fatalf("got %d, want 206", resp.StatusCode)
+	}
+	mediaType, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/byteranges" || params["boundary"] == "" {
+		t.Fatalf("Content-Type %q: %v", resp.Header.Get("Content-Type"), err)
+	}
+	if got := resp.Header.Get("Content-Length"); got != strconv.Itoa(len(body)) {
+		t.Errorf("Content-Length %s for %d bytes", got, len(body))
+	}
+
+	parts := multipart.NewReader(strings.NewReader(body), params["boundary"])
+	for _, want := range []struct{ contentRange, data string }{
+		{"bytes 0-3/20", "0123"},
+		{"bytes 15-19/20", "fghij"},
+	} {
+		part, err := parts.NextPart()
+		if err != nil {
+			t.Fatalf("part %s: %v", want.contentRange, err)
+		}
+		data, _ := io.ReadAll(part)
+		if got := part.Header.Get("Content-Range"); got != want.contentRange || string(data) != want.data {
+			t.Errorf("part: got %s %q, want %s %q", got, data, want.contentRange, want.data)
+		}
+		if got := part.Header.Get("Content-Type"); got != "text/plain; charset=utf-8" {
+			t.Errorf("part %s: Content-Type %q", want.contentRange, got)
+		}
+	}
+	if _, err := parts.NextPart(); err != io.EOF {
+		t.Errorf("after two parts: %v", err)
+	}
+}
+
+func TestMultipleRangesOverlapping(t *testing.T) {
+	s, _ := filesServer(t, testConfig(), map[string]string{"a.txt": "0123456789abcdefghij"})
+
+	// Out of order and overlapping, every part still has the right bytes
+	resp, body := get(t, s, http.MethodGet, "/files/a.txt", "Range: bytes=10-12,2-5,4-8")
+	_, params, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if resp.StatusCode != http.StatusPartialContent {
+		t.Fatalf("got %d, want 206", resp.StatusCode)
+	}
+	parts := multipart.NewReader(strings.NewReader(body), params["boundary"])
+	count := 0
+	for part, err := parts.NextPart(); err == nil; part, err = parts.NextPart() {
+		count++
+		var start, end int
+		fmt.Sscanf(part.Header.Get("Content-Range"), "bytes %d-%d/20", &start, &end)
+		data, _ := io.ReadAll(part)
+		if want := "0123456789abcdefghij"[start : end+1]; string(data) != want {
+			t.Errorf("%s: got %q, want %q", part.Header.Get("Content-Range"), data, want)
+		}
+	}
+	if count != 3 {
+		t.Errorf("got %d parts, want 3", count)
+	}
+
+	// Ranges adding up to more than the file get the whole file instead
+	if resp, body := get(t, s, http.MethodGet, "/files/a.txt", "Range: bytes=0-19,0-19"); resp.StatusCode != http.StatusOK || body != "0123456789abcdefghij" {
+		t.Errorf("ranges over the file size: got %d %q", resp.StatusCode, body)
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import "fmt"
+
+/*
+   Live reload (kill -HUP <pid>):
+
+   SIGHUP runs loadConfig again, which picks up READ_TIMEOUT, WRITE_TIMEOUT
+   and DIRECTORY from the environment, and hands the result to Reload.
+
+   Most settings are read per connection or per request, a new Config takes
+   effect with the next request. Open connections keep going, the next
+   request on them already sees the new config:
+
+     ReadTimeout, WriteTimeout, Directory, LogLevel, limits ...   live
+
+   A few are baked in when the server is built, changing them needs a restart:
+
+     Host, Port, Protocol, SocketActivation   the bound listener
+     FileCacheBytes                           the cache is sized once
+     EnablePprof, EnableStats                 routes are registered once
+     RedirectTrailingSlash,                   copied into every Router
+     CaseInsensitivePaths                     when it is created
+*/
+
+// Reload swaps in config for the requests that follow. Fields that need a
+// restart keep their current values, with a warning if config changes them.
+func (s *Server) Reload(config Config) error {
+	if err := config.validate(); err != nil {
+		return fmt.Errorf("invalid config: %w", err)
+	}
+
+	current := s.config.Load()
+	if config.Host != current.Host || config.Port != current.Port ||
+		config.Protocol != current.Protocol || config.SocketActivation != current.SocketActivation {
+		s.warnf("The listener can't change without a restart, staying on %s", s.Addr())
+		config.Host, config.Port = current.Host, current.Port
+		config.Protocol, config.SocketActivation = current.Protocol, current.SocketActivation
+	}
+	if config.FileCacheBytes != current.FileCacheBytes {
+		s.warnf("FileCacheBytes can't change without a restart, keeping %d", current.FileCacheBytes)
+		config.FileCacheBytes = current.FileCacheBytes
+	}
+	if config.EnablePprof != current.EnablePprof || config.EnableStats != current.EnableStats {
+		s.warnf("EnablePprof and EnableStats can't change without a restart")
+		config.EnablePprof, config.EnableStats = current.EnablePprof, current.EnableStats
+	}
+
+	if config.RedirectTrailingSlash != current.RedirectTrailingSlash || config.CaseInsensitivePaths != current.CaseInsensitivePaths {
+		s.warnf("RedirectTrailingSlash and CaseInsensitivePaths can't change without a restart")
+		config.RedirectTrailingSlash, config.CaseInsensitivePaths = current.RedirectTrailingSlash, current.CaseInsensitivePaths
+	}
+
+	s.config.Store(&config)
+	s.infof("Configuration reloaded: ReadTimeout=%v WriteTimeout=%v Directory=%q",
+		config.ReadTimeout, config.WriteTimeout, config.Directory)
+	return nil
+}
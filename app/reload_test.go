@@ -0,0 +1,116 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestReloadLive(t *testing.T) {
+	s, dir := filesServer(t, testConfig(), nil)
+	other := t.TempDir()
+	writeTestFile(t, other, "a.txt", "from the new directory")
+
+	if resp, _ := get(t, s, http.MethodGet, "/files/a.txt"); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("before reload: got %d, want 404 from %s", resp.StatusCode, dir)
+	}
+	config := *s.config.Load()
+	config.Directory = other
+	if err := s.Reload(config); err != nil {
+		t.Fatal(err)
+	}
+	if resp, body := get(t, s, http.MethodGet, "/files/a.txt"); resp.StatusCode != http.StatusOK || body != "from the new directory" {
+		t.Errorf("after reload: got %d %q", resp.StatusCode, body)
+	}
+}
+
+func TestReloadRestartOnly(t *testing.T) {
+	s, logs := newTestServer(t, testConfig())
+	config := *s.config.Load()
+	config.Port = "9999"
+	config.FileCacheBytes = 1 << 20
+	config.EnableStats = true
+	config.RedirectTrailingSlash = true
+	config.CaseInsensitivePaths = true
+	if err := s.Reload(config); err != nil {
+		t.Fatal(err)
+	}
+
+	got := s.config.Load()
+	if got.Port != "" || got.FileCacheBytes != 0 || got.EnableStats || got.RedirectTrailingSlash || got.CaseInsensitivePaths {
+		t.Errorf("restart-only settings changed on reload: %+v", got)
+	}
+	for _, want := range []string{"listener", "FileCacheBytes", "EnableStats", "RedirectTrailingSlash and CaseInsensitivePaths"} {
+		if !strings.Contains(logs.String(), want) {
+			t.Errorf("no warning about %s in:\n%s", want, logs)
+		}
+	}
+}
+
+func TestReloadInvalid(t *testing.T) {
+	s, _ := newTestServer(t, testConfig())
+	config := *s.config.Load()
+	config.CompressionLevel = 42
+	if err := s.Reload(config); err == nil {
+		t.Error("Reload accepted an invalid CompressionLevel")
+	}
+	if s.config.Load().CompressionLevel != 0 {
+		t.Error("an invalid config was stored")
+	}
+}
+
+func TestReloadReadTimeout(t *testing.T) {
+	s, _ := startTestServer(t, testConfig()) // 2s ReadTimeout
+	config := *s.config.Load()
+	config.ReadTimeout = 50 * time.Millisecond
+	if err := s.Reload(config); err != nil {
+		t.Fatal(err)
+	}
+
+	// A client that never finishes its request is cut off after the new timeout
+	conn, r := dial(t, s)
+	io.WriteString(conn, "GET /echo/slow HTTP/1.1\r\n")
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	began := time.Now()
+	if _, err := r.ReadByte(); err != io.EOF {
+		t.Fatalf("got %v, want the server to close the connection", err)
+	}
+	if elapsed := time.Since(began); elapsed > 500*time.Millisecond {
+		t.Errorf("closed after %v, the old 2s timeout still applies", elapsed)
+	}
+}
+
+// hangUp runs reloadOnSignal for a single SIGHUP
+func hangUp(s *Server) {
+	signals := make(chan os.Signal, 1)
+	signals <- syscall.SIGHUP
+	close(signals)
+	reloadOnSignal(s, signals)
+}
+
+func TestReloadOnSignal(t *testing.T) {
+	s, logs := newTestServer(t, testConfig())
+	dir := t.TempDir()
+	t.Setenv("READ_TIMEOUT", "250ms")
+	t.Setenv("DIRECTORY", dir)
+	hangUp(s)
+
+	got := s.config.Load()
+	if got.ReadTimeout != 250*time.Millisecond || got.Directory != dir {
+		t.Errorf("after SIGHUP: ReadTimeout=%v Directory=%q, want 250ms and %q", got.ReadTimeout, got.Directory, dir)
+	}
+
+	// A bad value is logged, the configuration from the first SIGHUP stays
+	t.Setenv("READ_TIMEOUT", "soon")
+	hangUp(s)
+	if got := s.config.Load(); got.ReadTimeout != 250*time.Millisecond {
+		t.Errorf("after a bad SIGHUP: ReadTimeout=%v, want 250ms kept", got.ReadTimeout)
+	}
+	if !strings.Contains(logs.String(), `Reload failed, keeping the current configuration: invalid READ_TIMEOUT: "soon"`) {
+		t.Errorf("no error for the bad READ_TIMEOUT in:\n%s", logs)
+	}
+}
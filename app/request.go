@@ -2,31 +2,256 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"net"
+	"mime"
+	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
 )
 
+// maxBodyBytes caps the request body, both as sent and after decompression
+const maxBodyBytes = 10 * 1024 * 1024 // 10 MB limit
+
+// requestError is a parse failure the client should hear about.
+// handleConnection answers it with StatusCode before closing the connection.
+type requestError struct {
+	StatusCode int
+	Err        error
+}
+
+func (e *requestError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *requestError) Unwrap() error {
+	return e.Err
+}
+
+func newRequestError(statusCode int, format string, args ...interface{}) *requestError {
+	return &requestError{StatusCode: statusCode, Err: fmt.Errorf(format, args...)}
+}
+
 type Request struct {
-	Method  string
-	Path    string
-	Version string
+	Method   string
+	Path     string
+	RawQuery string // everything after "?" in the request target, without the "?"
+	Version  string
+	Host     string // value of the Host header, e.g. "localhost:4221"
+
+	// ProtoMajor and ProtoMinor are Version as numbers, "HTTP/1.0" → 1, 0
+	ProtoMajor int
+	ProtoMinor int
+
+	// RemoteAddr is the client address, e.g. "203.0.113.7:51234"
+	RemoteAddr string
+
+	// Headers is keyed by lowercased name ("content-type"), look up through GetHeader
 	Headers map[string]string
 	Body    []byte
+
+	// BodyReader, on routes registered WithLazyBody, streams the body off
+	// the connection instead of Body, which stays nil. It is the body as
+	// sent: Content-Encoding is not undone. See ReadAllBody.
+	BodyReader io.ReadCloser
+
+	// TLS describes the connection's TLS session, nil over plain TCP
+	TLS *tls.ConnectionState
+
+	// Params holds the path segments captured by ":name", "*" and "*name" route patterns
+	Params map[string]string
+
+	cookies map[string]string // parsed lazily by Cookies()
+
+	ctx context.Context // server lifetime, see Context()
+
+	body *bodyReader // the body on the connection, read already unless lazy
+
+	// reader holds bytes the client may have sent past this request;
+	// a hijacking handler must keep reading from it rather than the raw conn
+	reader *bufio.Reader
 }
 
+/*
+IsKeepAlive reports whether the connection stays open after this request.
+
+The default flipped between protocol versions:
+
+	HTTP/1.0: close after every response, unless "Connection: keep-alive"
+	HTTP/1.1: persistent by default, unless "Connection: close"
+*/
+func (r *Request) IsKeepAlive() bool {
+	// Connection is a token list, any casing: "Keep-Alive, Upgrade", " CLOSE "
+	connection, _ := r.GetHeader("Connection")
+	if headerHasToken(connection, "close") {
+		return false
+	}
+	if r.ProtoMajor == 1 && r.ProtoMinor == 0 {
+		return headerHasToken(connection, "keep-alive")
+	}
+	return true
+}
+
+// IsWebSocketUpgrade reports whether the client asks to switch the
+// connection to WebSocket: "Upgrade: websocket" and "Connection: Upgrade",
+// which may come among other tokens ("keep-alive, Upgrade").
+func (r *Request) IsWebSocketUpgrade() bool {
+	upgrade, _ := r.GetHeader("Upgrade")
+	connection, _ := r.GetHeader("Connection")
+	return headerHasToken(upgrade, "websocket") && headerHasToken(connection, "upgrade")
+}
+
+// Context is cancelled when the server shuts down.
+// Long-running handlers (streams, event sources) should stop when it is done.
+func (r *Request) Context() context.Context {
+	if r.ctx == nil {
+		return context.Background()
+	}
+	return r.ctx
+}
+
+// Query parses the query string, e.g. "mode=append&x=1".
+// Malformed pairs are skipped.
+func (r *Request) Query() url.Values {
+	values, _ := url.ParseQuery(r.RawQuery)
+	return values
+}
+
+// Param returns the path segment captured for name, or "" if the route has no such param.
+func (r *Request) Param(name string) string {
+	return r.Params[name]
+}
+
+// GetHeader returns the value of the request header key in any casing,
+// GetHeader("Content-Type") finds "content-type".
 func (r *Request) GetHeader(key string) (string, bool) {
 	value, ok := r.Headers[strings.ToLower(key)]
 	return value, ok
 }
 
-func parseRequest(conn net.Conn) (*Request, error) {
-	reader := bufio.NewReader(conn)
+// Cookie returns the value of the named request cookie.
+func (r *Request) Cookie(name string) (string, bool) {
+	value, ok := r.Cookies()[name]
+	return value, ok
+}
+
+// Cookies parses the Cookie header on first use, e.g. `a=1; b="two"` → {a: 1, b: two}.
+// A missing header yields an empty map.
+func (r *Request) Cookies() map[string]string {
+	if r.cookies != nil {
+		return r.cookies
+	}
+
+	r.cookies = make(map[string]string)
+	header, ok := r.GetHeader("Cookie")
+	if !ok {
+		return r.cookies
+	}
+
+	for pair := range strings.SplitSeq(header, ";") {
+		name, value, found := strings.Cut(strings.TrimSpace(pair), "=")
+		name = strings.TrimSpace(name)
+		if !found || name == "" {
+			continue // Skip malformed pairs instead of failing the whole header
+		}
+		value = strings.TrimSpace(value)
+		// Quoted values are allowed by RFC 6265: name="value"
+		if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+			value = value[1 : len(value)-1]
+		}
+		r.cookies[name] = value
+	}
+	return r.cookies
+}
 
+// ContentType splits the Content-Type header into its media type and parameters:
+// "Text/HTML; charset=utf-8" → "text/html", {"charset": "utf-8"}.
+// Both are empty when the header is missing or unparsable.
+func (r *Request) ContentType() (mediaType string, params map[string]string) {
+	contentType, ok := r.GetHeader("Content-Type")
+	if !ok {
+		return "", nil
+	}
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil && !errors.Is(err, mime.ErrInvalidMediaParameter) {
+		return "", nil
+	}
+	// A broken parameter still leaves a usable media type (params is then empty)
+	return strings.ToLower(mediaType), params
+}
+
+// DecodeJSON decodes the JSON request body into v.
+// Unknown fields are ignored; use DecodeJSONStrict to reject them.
+func (r *Request) DecodeJSON(v interface{}) error {
+	return r.decodeJSON(v, false)
+}
+
+// DecodeJSONStrict is like DecodeJSON but fails on fields v does not declare.
+func (r *Request) DecodeJSONStrict(v interface{}) error {
+	return r.decodeJSON(v, true)
+}
+
+func (r *Request) decodeJSON(v interface{}, disallowUnknownFields bool) error {
+	contentType, ok := r.GetHeader("Content-Type")
+	if !ok {
+		return errors.New("missing Content-Type, expected application/json")
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return fmt.Errorf("invalid Content-Type %q: %w", contentType, err)
+	}
+	// Accept "application/json" as well as structured suffixes like "application/problem+json"
+	if mediaType != "application/json" && !strings.HasSuffix(mediaType, "+json") {
+		return fmt.Errorf("unsupported Content-Type %q, expected application/json", mediaType)
+	}
+
+	body, err := r.ReadAllBody()
+	if err != nil {
+		return err
+	}
+	if len(bytes.TrimSpace(body)) == 0 {
+		return errors.New("request body is empty")
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	if disallowUnknownFields {
+		decoder.DisallowUnknownFields()
+	}
+	if err := decoder.Decode(v); err != nil {
+		return fmt.Errorf("malformed JSON body: %w", err)
+	}
+
+	// Decode stops after the first JSON value, so `{"a":1} garbage` would pass silently.
+	// A second Decode must hit EOF, otherwise there is trailing data after the value.
+	if err := decoder.Decode(&struct{}{}); !errors.Is(err, io.EOF) {
+		return errors.New("malformed JSON body: unexpected data after JSON value")
+	}
+	return nil
+}
+
+// parseRequest reads the next request from the connection's reader.
+// writer is only used for the interim "100 Continue" response, it goes out
+// behind any pipelined responses still buffered there. A request with more
+// than maxHeaders header lines is rejected with 431. headersDone, if not nil,
+// runs once the headers are in and before the body is read; its error ends
+// parsing, and lazyBody leaves the body unread in Request.BodyReader.
+//
+// io.EOF is only returned when the client closed the connection before
+// sending anything, the normal end of a keep-alive connection. A request
+// cut off partway fails with an error wrapping io.ErrUnexpectedEOF.
+func parseRequest(reader *bufio.Reader, writer *bufio.Writer, maxHeaders int, headersDone func(*Request) (lazyBody bool, err error)) (*Request, error) {
 	requestLine, err := reader.ReadString('\n')
 	if err != nil {
+		if errors.Is(err, io.EOF) && requestLine != "" {
+			return nil, fmt.Errorf("reading request line %q: %w", requestLine, io.ErrUnexpectedEOF)
+		}
 		return nil, err
 	}
 
@@ -38,25 +263,53 @@ func parseRequest(conn net.Conn) (*Request, error) {
 	parts := strings.Fields(requestLine)
 
 	if len(parts) != 3 {
-		return nil, fmt.Errorf("invalid request line: %s", requestLine)
+		return nil, newRequestError(http.StatusBadRequest, "invalid request line: %q", requestLine)
+	}
+	if err := validateMethod(parts[0]); err != nil {
+		return nil, err
 	}
+	major, minor, err := parseVersion(parts[2])
+	if err != nil {
+		return nil, err
+	}
+
+	// The asterisk form is only defined for OPTIONS, see handleServerOptions
+	if parts[1] == "*" && parts[0] != http.MethodOptions {
+		return nil, newRequestError(http.StatusBadRequest, "request target * is only allowed for OPTIONS")
+	}
+	// Anything else must be a path: "echo/" would slip past the router's
+	// prefix match and leave handlers slicing a path shorter than their prefix
+	if parts[1] != "*" && !strings.HasPrefix(parts[1], "/") {
+		return nil, newRequestError(http.StatusBadRequest, "invalid request target: %q", parts[1])
+	}
+
+	// Split off the query string: "/files/a.txt?mode=append" → "/files/a.txt" + "mode=append"
+	path, rawQuery, _ := strings.Cut(parts[1], "?")
 	req := &Request{
-		Method:  parts[0],
-		Path:    parts[1],
-		Version: parts[2],
-		Headers: make(map[string]string),
+		Method:     parts[0],
+		Path:       path,
+		RawQuery:   rawQuery,
+		Version:    parts[2],
+		ProtoMajor: major,
+		ProtoMinor: minor,
+		Headers:    make(map[string]string),
+		reader:     reader,
 	}
 
 	// 2. Read headers
 	// Example: Host: localhost\r\n Content-Length: 13\r\n \r\n
-	for {
+	for count := 0; ; count++ {
 		line, err := reader.ReadString('\n')
 
 		if err != nil {
+			if errors.Is(err, io.EOF) {
+				// The request line is in, the client hung up mid-request
+				return nil, fmt.Errorf("reading headers: %w", io.ErrUnexpectedEOF)
+			}
 			return nil, err
 		}
 
-		line = strings.TrimSpace(line)
+		line = strings.TrimRight(line, "\r\n")
 		// HTTP protocol specification: Headers are separated from the body by an empty line
 		/*
 			GET /echo/hello HTTP/1.1\r\n          ← Request line
@@ -69,72 +322,333 @@ func parseRequest(conn net.Conn) (*Request, error) {
 			break // End of headers
 		}
 
+		// Tens of thousands of one-byte headers fit in any byte limit and
+		// would still cost a map entry each, count them too
+		if count == maxHeaders {
+			return nil, newRequestError(http.StatusRequestHeaderFieldsTooLarge, "more than %d header fields", maxHeaders)
+		}
+
+		/*
+		   Obsolete line folding (RFC 7230 §3.2.4):
+
+		     X-Custom: first part\r\n
+		      second part\r\n          ← continuation, starts with SP or HTAB
+
+		   Proxies disagree on whether that is one header or a broken second
+		   one, exactly the kind of mismatch request smuggling feeds on.
+		   Folding and lines without a colon are rejected, never guessed at.
+		*/
+		if line[0] == ' ' || line[0] == '\t' {
+			return nil, newRequestError(http.StatusBadRequest, "obsolete line folding in header: %q", line)
+		}
+		colonIdx := strings.Index(line, ":")
+		if colonIdx < 0 {
+			return nil, newRequestError(http.StatusBadRequest, "malformed header line: %q", line)
+		}
+
+		// "Host : x" is not "Host: x" to every parser, some take "Host " as the
+		// name; no whitespace is allowed before the colon (RFC 7230 §3.2.4)
+		if colonIdx == 0 || line[colonIdx-1] == ' ' || line[colonIdx-1] == '\t' {
+			return nil, newRequestError(http.StatusBadRequest, "invalid header name: %q", line[:colonIdx])
+		}
+
 		// Parse header line
-		if strings.Contains(line, ":") {
-			colonIdx := strings.Index(line, ":")
-			key := strings.TrimSpace(line[:colonIdx])
-			value := strings.TrimSpace(line[colonIdx+1:])
-			req.Headers[strings.ToLower(key)] = value // Store headers in lowercase for case-insensitive access
+		key := line[:colonIdx]
+		value := strings.TrimSpace(line[colonIdx+1:])
+		if !validHeaderValue(value) {
+			return nil, newRequestError(http.StatusBadRequest, "control character in header %s", key)
+		}
+		if _, dup := req.GetHeader("Host"); dup && strings.EqualFold(key, "Host") {
+			// Two Host headers make it ambiguous which site is addressed (RFC 7230 §5.4)
+			return nil, newRequestError(http.StatusBadRequest, "multiple Host headers")
+		}
+		if prev, dup := req.GetHeader("Content-Length"); dup && strings.EqualFold(key, "Content-Length") {
+			// Keep every value, bodyLength rejects them unless they all agree
+			value = prev + ", " + value
+		}
+		req.Headers[strings.ToLower(key)] = value // Store headers in lowercase for case-insensitive access
+	}
+
+	// HTTP/1.1 clients must always send Host, even if it is empty (RFC 7230 §5.4)
+	host, hasHost := req.GetHeader("Host")
+	if !hasHost && req.Version == "HTTP/1.1" {
+		return nil, newRequestError(http.StatusBadRequest, "missing Host header")
+	}
+	req.Host = host
+
+	/*
+	   Request smuggling (RFC 7230 §3.3.3):
+
+	     POST / HTTP/1.1
+	     Content-Length: 6
+	     Transfer-Encoding: chunked
+
+	     0\r\n\r\nGET /admin ...
+
+	   A proxy that trusts Transfer-Encoding and a server that trusts
+	   Content-Length (or the other way round) disagree on where this request
+	   ends, and the leftover bytes become a second request the proxy never
+	   saw. A message with both is never legitimate, refuse it outright.
+	*/
+	if _, chunked := req.GetHeader("Transfer-Encoding"); chunked {
+		if _, ok := req.GetHeader("Content-Length"); ok {
+			return nil, newRequestError(http.StatusBadRequest, "both Content-Length and Transfer-Encoding present")
 		}
 	}
 
 	// Read body if Content-Length header is present
-	contentLength, exists := req.GetHeader("Content-Length")
-	if exists {
-		// 3. At this point, reader cursor is positioned at "Hello, World!"
-		//    It has NOT re-read any previous data
-		var length int
-
-		// strconv.Atoi() converts string "123" to int 123
-		// Returns error for invalid inputs like "abc", or empty string
-		length, err := strconv.Atoi(contentLength)
-		if err != nil {
-			return nil, fmt.Errorf("invalid Content-Length: %w", err)
+	length, err := bodyLength(req)
+	if err != nil {
+		return nil, err
+	}
+	chunked, err := isChunked(req)
+	if err != nil {
+		return nil, err
+	}
+
+	lazyBody := false
+	if headersDone != nil {
+		if lazyBody, err = headersDone(req); err != nil {
+			return nil, err
 		}
-		fmt.Println("length:", length)
+	}
+	// A lazy body is streamed by its handler, it never sits in memory whole
+	if !lazyBody && length > maxBodyBytes {
+		return nil, newRequestError(http.StatusRequestEntityTooLarge, "Content-Length too large: %d", length)
+	}
+
+	/*
+	   3. Expect: 100-continue
+
+	   Client → POST /files/big.iso, Content-Length: 4294967296, Expect: 100-continue
+	   Client waits (instead of sending 4 GB that may be rejected anyway)
+	   Server → HTTP/1.1 100 Continue        ← "go ahead"
+	   Client → <body>
+	   Server → HTTP/1.1 201 Created         ← the real, final response
 
-		// Validate Content-Length
-		if length < 0 {
-			return nil, fmt.Errorf("negative Content-Length: %d", length)
+	   A request we already know we'll reject never gets the 100: a body
+	   too large fails above, one refused by its route's WithPrecheck is
+	   left unread, and the final status is sent instead. The 100 itself
+	   goes out with the first read of the body (see bodyReader), a
+	   lazy-body handler that never reads it never asks the client to send it.
+	*/
+	expectContinue := false
+	if expect, ok := req.GetHeader("Expect"); ok && req.Version != "HTTP/1.0" {
+		if !strings.EqualFold(expect, "100-continue") {
+			return nil, newRequestError(http.StatusExpectationFailed, "unsupported Expect: %s", expect)
 		}
+		expectContinue = true
+	}
 
-		// Prevent excessively large bodies
-		if length > 10*1024*1024 { // 10 MB limit
-			return nil, fmt.Errorf("Content-Length too large: %d", length)
+	bodyLen := int64(length)
+	if chunked {
+		bodyLen = -1
+	}
+	req.body = newBodyReader(reader, writer, bodyLen, expectContinue)
+	if lazyBody {
+		req.BodyReader = req.body
+		return req, nil
+	}
+
+	// 4. At this point, reader cursor is positioned at "Hello, World!"
+	//    It has NOT re-read any previous data
+	if chunked {
+		// No length up front, the limit is checked while reading
+		body, err := io.ReadAll(io.LimitReader(req.body, maxBodyBytes+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(body) > maxBodyBytes {
+			return nil, newRequestError(http.StatusRequestEntityTooLarge, "chunked body too large")
+		}
+		if len(body) > 0 {
+			req.Body = body
 		}
+	} else if length > 0 {
+		req.Body = make([]byte, length)
+		/*
+			WHY io.ReadFull() instead of reader.Read()?
 
-		if length > 0 {
-			req.Body = make([]byte, length)
-			/*
-				WHY io.ReadFull() instead of reader.Read()?
+			reader.Read() contract: "I'll read AT LEAST 1 byte, UP TO len(buf) bytes"
+			  - Might return 10 bytes when you wanted 1000
+			  - Network packets can arrive in chunks
+			  - Example: 1000-byte body might arrive as:
+			      First call:  300 bytes (rest are zeros!)
+			      Need to call Read() again to get remaining 700 bytes
 
-				reader.Read() contract: "I'll read AT LEAST 1 byte, UP TO len(buf) bytes"
-				  - Might return 10 bytes when you wanted 1000
-				  - Network packets can arrive in chunks
-				  - Example: 1000-byte body might arrive as:
-				      First call:  300 bytes (rest are zeros!)
-				      Need to call Read() again to get remaining 700 bytes
+			io.ReadFull() contract: "I'll read EXACTLY len(buf) bytes or return error"
+			  - Keeps reading internally until buffer is completely filled
+			  - Handles TCP packet fragmentation automatically
+			  - Guarantees: n == len(buf) OR error != nil
 
-				io.ReadFull() contract: "I'll read EXACTLY len(buf) bytes or return error"
-				  - Keeps reading internally until buffer is completely filled
-				  - Handles TCP packet fragmentation automatically
-				  - Guarantees: n == len(buf) OR error != nil
+			Real scenario:
+			  POST request with 20-byte body arriving in 2 TCP packets:
+			  Packet 1: "1234567890" (10 bytes)
+			  Packet 2: "1234567890" (10 bytes)
 
-				Real scenario:
-				  POST request with 20-byte body arriving in 2 TCP packets:
-				  Packet 1: "1234567890" (10 bytes)
-				  Packet 2: "1234567890" (10 bytes)
+			  reader.Read():  returns 10, need manual retry
+			  io.ReadFull():  waits and returns all 20 bytes ✓
 
-				  reader.Read():  returns 10, need manual retry
-				  io.ReadFull():  waits and returns all 20 bytes ✓
+			bufio.Reader maintains position - already consumed headers, now positioned at body start
+		*/
+		// A body cut short comes back as a 400 requestError from bodyReader
+		if _, err := io.ReadFull(req.body, req.Body); err != nil {
+			return nil, err
+		}
+	}
 
-				bufio.Reader maintains position - already consumed headers, now positioned at body start
-			*/
-			_, err := io.ReadFull(reader, req.Body)
-			if err != nil {
-				return nil, err
-			}
+	// 5. Undo Content-Encoding so handlers always see the plain body
+	if encoding, ok := req.GetHeader("Content-Encoding"); ok && len(req.Body) > 0 {
+		if err := decodeBody(req, strings.ToLower(strings.TrimSpace(encoding))); err != nil {
+			return nil, err
 		}
 	}
 	return req, nil
 }
+
+// knownMethods are the methods of RFC 9110 §9 plus PATCH (RFC 5789).
+// Methods are case-sensitive, "get" is not GET.
+var knownMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodPost:    true,
+	http.MethodPut:     true,
+	http.MethodDelete:  true,
+	http.MethodPatch:   true,
+	http.MethodOptions: true,
+	http.MethodTrace:   true,
+	http.MethodConnect: true,
+}
+
+// validateMethod rejects a method that is not a token (400) and a well-formed
+// one we don't implement (501), before it ever reaches the router.
+func validateMethod(method string) error {
+	for i := 0; i < len(method); i++ {
+		if !isTokenChar(method[i]) {
+			return newRequestError(http.StatusBadRequest, "invalid method: %q", method)
+		}
+	}
+	if !knownMethods[method] {
+		return newRequestError(http.StatusNotImplemented, "unsupported method: %s", method)
+	}
+	return nil
+}
+
+// isTokenChar reports whether c may appear in a token (RFC 9110 §5.6.2):
+// letters, digits and !#$%&'*+-.^_`|~
+func isTokenChar(c byte) bool {
+	switch {
+	case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		return true
+	}
+	return strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0
+}
+
+// parseVersion checks the request line's version token, "HTTP/1.1" → 1, 1.
+// Anything not shaped like "HTTP/x.y" is a malformed request (400); a well-formed
+// version we don't speak, e.g. "HTTP/2.0" or "HTTP/0.9", gets 505.
+func parseVersion(version string) (int, int, error) {
+	digits, ok := strings.CutPrefix(version, "HTTP/")
+	if !ok || len(digits) != 3 || digits[1] != '.' ||
+		digits[0] < '0' || digits[0] > '9' || digits[2] < '0' || digits[2] > '9' {
+		return 0, 0, newRequestError(http.StatusBadRequest, "invalid HTTP version: %q", version)
+	}
+
+	major, minor := int(digits[0]-'0'), int(digits[2]-'0')
+	if major != 1 || minor > 1 {
+		return 0, 0, newRequestError(http.StatusHTTPVersionNotSupported, "unsupported HTTP version: %s", version)
+	}
+	return major, minor, nil
+}
+
+// validHeaderValue rejects control characters (NUL, a bare CR, DEL...) that
+// could split a response if the value is reflected. HTAB is allowed, and so
+// are bytes >= 0x80 (obs-text, RFC 7230 §3.2).
+func validHeaderValue(value string) bool {
+	for i := 0; i < len(value); i++ {
+		if c := value[i]; (c < 0x20 && c != '\t') || c == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// bodyLength validates the Content-Length header, 0 if there is none
+func bodyLength(req *Request) (int, error) {
+	contentLength, exists := req.GetHeader("Content-Length")
+	if !exists {
+		return 0, nil
+	}
+
+	// Repeated headers arrive as "5, 5". Identical copies are harmless,
+	// different ones leave the body length ambiguous (RFC 7230 §3.3.2).
+	values := strings.Split(contentLength, ",")
+	for _, v := range values[1:] {
+		if strings.TrimSpace(v) != strings.TrimSpace(values[0]) {
+			return 0, newRequestError(http.StatusBadRequest, "conflicting Content-Length values: %s", contentLength)
+		}
+	}
+
+	// strconv.Atoi() converts string "123" to int 123
+	// Returns error for invalid inputs like "abc", or empty string
+	length, err := strconv.Atoi(strings.TrimSpace(values[0]))
+	if err != nil {
+		return 0, newRequestError(http.StatusBadRequest, "invalid Content-Length: %w", err)
+	}
+
+	// Validate Content-Length
+	if length < 0 {
+		return 0, newRequestError(http.StatusBadRequest, "negative Content-Length: %d", length)
+	}
+
+	return length, nil
+}
+
+// isChunked reports whether the body comes with Transfer-Encoding: chunked.
+// Other transfer codings leave no way to find the end of the body.
+func isChunked(req *Request) (bool, error) {
+	encoding, ok := req.GetHeader("Transfer-Encoding")
+	if !ok {
+		return false, nil
+	}
+	if !strings.EqualFold(strings.TrimSpace(encoding), "chunked") {
+		return false, newRequestError(http.StatusNotImplemented, "unsupported Transfer-Encoding: %s", encoding)
+	}
+	return true, nil
+}
+
+func decodeBody(req *Request, encoding string) error {
+	switch encoding {
+	case "gzip":
+		gr, err := gzip.NewReader(bytes.NewReader(req.Body))
+		if err != nil {
+			return newRequestError(http.StatusBadRequest, "malformed gzip body: %v", err)
+		}
+		defer gr.Close()
+
+		/*
+		   Zip bomb protection:
+		     A few KB of gzip can expand to gigabytes. Content-Length only limits
+		     the compressed size, so the limit is applied again while inflating.
+		     Reading maxBodyBytes+1 tells "exactly at the limit" from "over the limit"
+		     without ever holding more than that in memory.
+		*/
+		body, err := io.ReadAll(io.LimitReader(gr, maxBodyBytes+1))
+		if err != nil {
+			// Truncated or corrupt stream, e.g. io.ErrUnexpectedEOF or gzip.ErrChecksum
+			return newRequestError(http.StatusBadRequest, "malformed gzip body: %v", err)
+		}
+		if len(body) > maxBodyBytes {
+			return newRequestError(http.StatusRequestEntityTooLarge, "decompressed body too large")
+		}
+
+		// The body is now identity-encoded; keep the headers truthful for handlers
+		req.Body = body
+		delete(req.Headers, "content-encoding")
+		req.Headers["content-length"] = strconv.Itoa(len(body))
+	case "identity":
+	default:
+		return newRequestError(http.StatusUnsupportedMediaType, "unsupported Content-Encoding: %s", encoding)
+	}
+	return nil
+}
@@ -0,0 +1,631 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRequestTargetWithoutLeadingSlash(t *testing.T) {
+	s, _ := startTestServer(t, testConfig())
+	for _, target := range []string{"echo/", "files/", "echo/hi", "user-agent"} {
+		resp, _ := roundTrip(t, s, "GET "+target+" HTTP/1.1\r\nHost: localhost\r\n\r\n")
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("GET %s: got %d, want 400", target, resp.StatusCode)
+		}
+	}
+
+	// The server must still be up
+	if resp, body := get(t, s, "GET", "/echo/hi"); resp.StatusCode != http.StatusOK || body != "hi" {
+		t.Errorf("GET /echo/hi after bad targets: got %d %q", resp.StatusCode, body)
+	}
+}
+
+func TestDecodeJSON(t *testing.T) {
+	type payload struct {
+		Name  string `json:"name"`
+		Count int    `json:"count"`
+	}
+	jsonHeaders := map[string]string{"Content-Type": "application/json; charset=utf-8"}
+
+	var p payload
+	req := newTestRequest(http.MethodPost, "/", jsonHeaders, `{"name":"a","count":2}`)
+	if err := req.DecodeJSON(&p); err != nil {
+		t.Fatalf("valid object: %v", err)
+	}
+	if p != (payload{Name: "a", Count: 2}) {
+		t.Errorf("decoded %+v", p)
+	}
+
+	for _, tc := range []struct {
+		name    string
+		headers map[string]string
+		body    string
+	}{
+		{"malformed", jsonHeaders, `{"name":`},
+		{"trailing garbage", jsonHeaders, `{"name":"a"} garbage`},
+		{"empty body", jsonHeaders, ""},
+		{"wrong content type", map[string]string{"Content-Type": "text/plain"}, `{"name":"a"}`},
+		{"no content type", nil, `{"name":"a"}`},
+	} {
+		req := newTestRequest(http.MethodPost, "/", tc.headers, tc.body)
+		if err := req.DecodeJSON(&payload{}); err == nil {
+			t.Errorf("%s: DecodeJSON succeeded", tc.name)
+		}
+	}
+
+	// +json media types are JSON too
+	req = newTestRequest(http.MethodPost, "/", map[string]string{"Content-Type": "application/problem+json"}, `{"name":"b"}`)
+	if err := req.DecodeJSON(&p); err != nil {
+		t.Errorf("application/problem+json: %v", err)
+	}
+}
+
+func TestDecodeJSONStrict(t *testing.T) {
+	var p struct {
+		Name string `json:"name"`
+	}
+	headers := map[string]string{"Content-Type": "application/json"}
+	body := `{"name":"a","extra":1}`
+	if err := newTestRequest(http.MethodPost, "/", headers, body).DecodeJSON(&p); err != nil {
+		t.Errorf("DecodeJSON with an unknown field: %v", err)
+	}
+	if err := newTestRequest(http.MethodPost, "/", headers, body).DecodeJSONStrict(&p); err == nil {
+		t.Error("DecodeJSONStrict accepted an unknown field")
+	}
+}
+
+func TestCookies(t *testing.T) {
+	req := newTestRequest(http.MethodGet, "/", map[string]string{"Cookie": ` a=1 ;b="two words";  c=3; malformed; =nameless`}, "")
+	want := map[string]string{"a": "1", "b": "two words", "c": "3"}
+	got := req.Cookies()
+	if len(got) != len(want) {
+		t.Errorf("Cookies: got %q, want %q", got, want)
+	}
+	for name, value := range want {
+		if v, ok := req.Cookie(name); !ok || v != value {
+			t.Errorf("Cookie(%q): got %q %v, want %q", name, v, ok, value)
+		}
+	}
+	if _, ok := req.Cookie("missing"); ok {
+		t.Error("Cookie(missing) reported a value")
+	}
+
+	noCookies := newTestRequest(http.MethodGet, "/", nil, "")
+	if got := noCookies.Cookies(); got == nil || len(got) != 0 {
+		t.Errorf("no Cookie header: got %v, want an empty map", got)
+	}
+}
+
+func gzipBytes(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var b bytes.Buffer
+	w := gzip.NewWriter(&b)
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	return b.Bytes()
+}
+
+// postBody sends body to target with the given extra header lines
+func postBody(t *testing.T, s *Server, target string, body []byte, headers ...string) (*http.Response, string) {
+	t.Helper()
+	return sendBody(t, s, http.MethodPost, target, body, headers...)
+}
+
+func TestGzipRequestBody(t *testing.T) {
+	s, _ := newTestServer(t, testConfig())
+	s.router.RegisterExactRoute("/body", func(r *Request) *Response {
+		resp := NewResponse(http.StatusOK, "OK", r.Body)
+		_, encoded := r.GetHeader("Content-Encoding")
+		length, _ := r.GetHeader("Content-Length")
+		resp.SetHeader("X-Seen", strconv.FormatBool(encoded)+" "+length)
+		return resp
+	})
+	start(t, s)
+
+	plain := []byte(strings.Repeat("hello gzip ", 100))
+	compressed := gzipBytes(t, plain)
+
+	resp, body := postBody(t, s, "/body", compressed, "Content-Encoding: gzip")
+	if resp.StatusCode != http.StatusOK || body != string(plain) {
+		t.Fatalf("valid gzip: got %d, %d bytes", resp.StatusCode, len(body))
+	}
+	// The handler sees an identity body with its real length
+	if got, want := resp.Header.Get("X-Seen"), "false "+strconv.Itoa(len(plain)); got != want {
+		t.Errorf("headers seen by the handler: got %q, want %q", got, want)
+	}
+
+	truncated := compressed[:len(compressed)/2]
+	if resp, _ := postBody(t, s, "/body", truncated, "Content-Encoding: gzip"); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("truncated gzip: got %d, want 400", resp.StatusCode)
+	}
+	if resp, _ := postBody(t, s, "/body", []byte("not gzip at all"), "Content-Encoding: gzip"); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("not gzip: got %d, want 400", resp.StatusCode)
+	}
+	if resp, _ := postBody(t, s, "/body", []byte("x"), "Content-Encoding: br"); resp.StatusCode != http.StatusUnsupportedMediaType {
+		t.Errorf("unknown encoding: got %d, want 415", resp.StatusCode)
+	}
+}
+
+func TestGzipRequestBodyBomb(t *testing.T) {
+	s, _ := newTestServer(t, testConfig())
+	s.router.RegisterExactRoute("/body", echoBody)
+	start(t, s)
+	// About 10 KB on the wire, just over the 10 MB limit inflated
+	bomb := gzipBytes(t, make([]byte, maxBodyBytes+1))
+	if resp, _ := postBody(t, s, "/body", bomb, "Content-Encoding: gzip"); resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("zip bomb: got %d, want 413", resp.StatusCode)
+	}
+}
+
+// parse runs parseRequest over raw with the default limits
+func parse(raw string) (*Request, error) {
+	var out bytes.Buffer
+	return parseRequest(bufio.NewReader(strings.NewReader(raw)), bufio.NewWriter(&out), Config{}.maxHeaderCount(), nil)
+}
+
+// statusOf is the status parseRequest's error asks for, 0 if it isn't a requestError
+func statusOf(err error) int {
+	var reqErr *requestError
+	if errors.As(err, &reqErr) {
+		return reqErr.StatusCode
+	}
+	return 0
+}
+
+func TestHostHeader(t *testing.T) {
+	req, err := parse("GET / HTTP/1.1\r\nHost: example.com:4221\r\n\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.Host != "example.com:4221" {
+		t.Errorf("Host: got %q", req.Host)
+	}
+
+	for name, raw := range map[string]string{
+		"missing":        "GET / HTTP/1.1\r\nAccept: */*\r\n\r\n",
+		"duplicate":      "GET / HTTP/1.1\r\nHost: a.example\r\nHost: b.example\r\n\r\n",
+		"duplicate case": "GET / HTTP/1.1\r\nHost: a.example\r\nhost: a.example\r\n\r\n",
+	} {
+		if _, err := parse(raw); statusOf(err) != http.StatusBadRequest {
+			t.Errorf("%s Host: got %v, want a 400", name, err)
+		}
+	}
+
+	// HTTP/1.0 predates Host
+	if _, err := parse("GET / HTTP/1.0\r\n\r\n"); err != nil {
+		t.Errorf("HTTP/1.0 without Host: %v", err)
+	}
+	// Empty is allowed, for a request target without an authority
+	if _, err := parse("GET / HTTP/1.1\r\nHost:\r\n\r\n"); err != nil {
+		t.Errorf("empty Host: %v", err)
+	}
+}
+
+func TestExpectContinue(t *testing.T) {
+	s, dir := filesServer(t, testConfig(), nil)
+
+	conn, r := dial(t, s)
+	io.WriteString(conn, "POST /files/up.txt HTTP/1.1\r\nHost: localhost\r\nContent-Length: 6\r\nExpect: 100-continue\r\n\r\n")
+	// The client holds the body back until the server says go ahead
+	if line, _ := r.ReadString('\n'); line != "HTTP/1.1 100 Continue\r\n" {
+		t.Fatalf("got %q, want 100 Continue", line)
+	}
+	if line, _ := r.ReadString('\n'); line != "\r\n" {
+		t.Fatalf("100 Continue not terminated: %q", line)
+	}
+	io.WriteString(conn, "upload")
+	if resp, _ := readResponse(t, r, http.MethodPost); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("final response: got %d, want 201", resp.StatusCode)
+	}
+	if content, _ := os.ReadFile(filepath.Join(dir, "up.txt")); string(content) != "upload" {
+		t.Errorf("uploaded file: %q", content)
+	}
+
+	if resp, _ := roundTrip(t, s, "POST /files/x HTTP/1.1\r\nHost: localhost\r\nContent-Length: 1\r\nExpect: something-else\r\n\r\nx"); resp.StatusCode != http.StatusExpectationFailed {
+		t.Errorf("unknown expectation: got %d, want 417", resp.StatusCode)
+	}
+}
+
+func TestRequestSmuggling(t *testing.T) {
+	for name, raw := range map[string]string{
+		"both headers":            "POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 6\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\nG",
+		"both headers TE first":   "POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\nContent-Length: 6\r\n\r\n0\r\n\r\nG",
+		"conflicting lengths":     "POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 3\r\nContent-Length: 5\r\n\r\nhello",
+		"conflicting in one line": "POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 3, 5\r\n\r\nhello",
+	} {
+		if _, err := parse(raw); statusOf(err) != http.StatusBadRequest {
+			t.Errorf("%s: got %v, want a 400", name, err)
+		}
+	}
+
+	// Identical copies agree on the length
+	req, err := parse("POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 5\r\nContent-Length: 5\r\n\r\nhello")
+	if err != nil {
+		t.Fatalf("identical Content-Length values: %v", err)
+	}
+	if string(req.Body) != "hello" {
+		t.Errorf("body: %q", req.Body)
+	}
+}
+
+func TestRequestSmugglingClosesConnection(t *testing.T) {
+	s, _ := startTestServer(t, testConfig())
+	// Were the "G" taken as the start of the next request, it would poison it
+	out := rawResponse(t, s, "POST /echo/x HTTP/1.1\r\nHost: localhost\r\nContent-Length: 6\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\nGET /echo/y HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	if !strings.HasPrefix(out, "HTTP/1.1 400 ") || strings.Count(out, "HTTP/1.1 ") != 1 {
+		t.Errorf("got %q, want a single 400 and the connection closed", out)
+	}
+}
+
+func TestHTTPVersion(t *testing.T) {
+	for _, tc := range []struct {
+		version      string
+		major, minor int
+	}{
+		{"HTTP/1.0", 1, 0},
+		{"HTTP/1.1", 1, 1},
+	} {
+		req, err := parse("GET / " + tc.version + "\r\nHost: x\r\n\r\n")
+		if err != nil {
+			t.Errorf("%s: %v", tc.version, err)
+			continue
+		}
+		if req.Version != tc.version || req.ProtoMajor != tc.major || req.ProtoMinor != tc.minor {
+			t.Errorf("%s: got %s %d.%d", tc.version, req.Version, req.ProtoMajor, req.ProtoMinor)
+		}
+	}
+
+	for version, status := range map[string]int{
+		"BANANA":   http.StatusBadRequest,
+		"HTTP/1":   http.StatusBadRequest,
+		"http/1.1": http.StatusBadRequest,
+		"HTTP/1.x": http.StatusBadRequest,
+		"HTTP/11":  http.StatusBadRequest,
+		"HTTP/2.0": http.StatusHTTPVersionNotSupported,
+		"HTTP/0.9": http.StatusHTTPVersionNotSupported,
+		"HTTP/1.2": http.StatusHTTPVersionNotSupported,
+	} {
+		if _, err := parse("GET / " + version + "\r\nHost: x\r\n\r\n"); statusOf(err) != status {
+			t.Errorf("%s: got %v, want a %d", version, err, status)
+		}
+	}
+}
+
+func TestRequestMethod(t *testing.T) {
+	for _, method := range []string{"GET", "HEAD", "POST", "PUT", "DELETE", "PATCH", "OPTIONS", "TRACE", "CONNECT"} {
+		if _, err := parse(method + " / HTTP/1.1\r\nHost: x\r\n\r\n"); err != nil {
+			t.Errorf("%s: %v", method, err)
+		}
+	}
+	for method, status := range map[string]int{
+		"get":     http.StatusNotImplemented, // methods are case-sensitive
+		"FOO":     http.StatusNotImplemented,
+		"BREW":    http.StatusNotImplemented,
+		"G\x01ET": http.StatusBadRequest,
+		"GET\x7f": http.StatusBadRequest,
+		"GE(T)":   http.StatusBadRequest,
+		"G\"ET\"": http.StatusBadRequest,
+		"\x00":    http.StatusBadRequest,
+	} {
+		if _, err := parse(method + " / HTTP/1.1\r\nHost: x\r\n\r\n"); statusOf(err) != status {
+			t.Errorf("%q: got %v, want a %d", method, err, status)
+		}
+	}
+
+	s, _ := startTestServer(t, testConfig())
+	if resp, _ := roundTrip(t, s, "FOO /echo/x HTTP/1.1\r\nHost: localhost\r\n\r\n"); resp.StatusCode != http.StatusNotImplemented {
+		t.Errorf("FOO over the wire: got %d, want 501", resp.StatusCode)
+	}
+}
+
+func TestContentType(t *testing.T) {
+	for _, tc := range []struct {
+		header, mediaType string
+		params            map[string]string
+	}{
+		{"application/json", "application/json", map[string]string{}},
+		{"Text/HTML; Charset=utf-8", "text/html", map[string]string{"charset": "utf-8"}},
+		{`multipart/form-data; charset=UTF-8; boundary="----x y"`, "multipart/form-data", map[string]string{"charset": "UTF-8", "boundary": "----x y"}},
+		{"text/plain; charset", "text/plain", map[string]string{}}, // broken parameter, usable type
+		{"not a media type", "", nil},
+	} {
+		req := newTestRequest(http.MethodPost, "/", map[string]string{"Content-Type": tc.header}, "")
+		mediaType, params := req.ContentType()
+		if mediaType != tc.mediaType || len(params) != len(tc.params) {
+			t.Errorf("%q: got %q %v, want %q %v", tc.header, mediaType, params, tc.mediaType, tc.params)
+			continue
+		}
+		for name, value := range tc.params {
+			if params[name] != value {
+				t.Errorf("%q: param %s = %q, want %q", tc.header, name, params[name], value)
+			}
+		}
+	}
+
+	if mediaType, params := newTestRequest(http.MethodPost, "/", nil, "").ContentType(); mediaType != "" || params != nil {
+		t.Errorf("no header: got %q %v", mediaType, params)
+	}
+}
+
+func TestObsoleteLineFolding(t *testing.T) {
+	for name, headers := range map[string]string{
+		"space fold":       "Host: x\r\nX-Long: first\r\n second\r\n",
+		"tab fold":         "Host: x\r\nX-Long: first\r\n\tsecond\r\n",
+		"first line":       " Host: x\r\n",
+		"no colon":         "Host: x\r\nNoColonHere\r\n",
+		"no colon, spaced": "Host: x\r\nX-A 1\r\n",
+	} {
+		if _, err := parse("GET / HTTP/1.1\r\n" + headers + "\r\n"); statusOf(err) != http.StatusBadRequest {
+			t.Errorf("%s: got %v, want a 400", name, err)
+		}
+	}
+
+	s, _ := startTestServer(t, testConfig())
+	resp, _ := roundTrip(t, s, "GET /echo/x HTTP/1.1\r\nHost: localhost\r\nX-Long: a\r\n b\r\n\r\n")
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("folded header over the wire: got %d, want 400", resp.StatusCode)
+	}
+}
+
+func TestWhitespaceBeforeColon(t *testing.T) {
+	for _, line := range []string{"Host :x", "Host : x", "Host\t: x"} {
+		if _, err := parse("GET / HTTP/1.1\r\n" + line + "\r\n\r\n"); statusOf(err) != http.StatusBadRequest {
+			t.Errorf("%q: got %v, want a 400", line, err)
+		}
+	}
+	for _, line := range []string{"Host: value", "Host:value", "Host: \tvalue \t"} {
+		req, err := parse("GET / HTTP/1.1\r\n" + line + "\r\n\r\n")
+		if err != nil {
+			t.Errorf("%q: %v", line, err)
+			continue
+		}
+		if req.Host != "value" {
+			t.Errorf("%q: Host %q, want the whitespace around the value trimmed", line, req.Host)
+		}
+	}
+}
+
+func TestHeaderValueControlCharacters(t *testing.T) {
+	for name, value := range map[string]string{
+		"NUL":     "a\x00b",
+		"bare CR": "a\rSet-Cookie: injected",
+		"DEL":     "a\x7f",
+		"ESC":     "\x1b[31m",
+	} {
+		if _, err := parse("GET / HTTP/1.1\r\nHost: x\r\nX-Value: " + value + "\r\n\r\n"); statusOf(err) != http.StatusBadRequest {
+			t.Errorf("%s: got %v, want a 400", name, err)
+		}
+	}
+	for name, value := range map[string]string{
+		"HTAB":     "a\tb",
+		"obs-text": "caf\xe9",
+	} {
+		req, err := parse("GET / HTTP/1.1\r\nHost: x\r\nX-Value: " + value + "\r\n\r\n")
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+		} else if got, _ := req.GetHeader("X-Value"); got != value {
+			t.Errorf("%s: got %q", name, got)
+		}
+	}
+
+	s, _ := startTestServer(t, testConfig())
+	if resp, _ := roundTrip(t, s, "GET /echo/x HTTP/1.1\r\nHost: localhost\r\nX-Value: a\x00b\r\n\r\n"); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("NUL over the wire: got %d, want 400", resp.StatusCode)
+	}
+}
+
+func TestGetHeader(t *testing.T) {
+	req, err := parse("GET / HTTP/1.1\r\nHost: x\r\ncontent-type: text/plain\r\nX-MiXeD-Case: yes\r\nX-Empty:\r\n\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Stored lowercased, found in any casing
+	if _, ok := req.Headers["content-type"]; !ok {
+		t.Fatalf("headers: %v", req.Headers)
+	}
+	for _, key := range []string{"Content-Type", "content-type", "CONTENT-TYPE"} {
+		if value, ok := req.GetHeader(key); !ok || value != "text/plain" {
+			t.Errorf("GetHeader(%q): got %q, %v", key, value, ok)
+		}
+	}
+	if value, ok := req.GetHeader("x-mixed-case"); !ok || value != "yes" {
+		t.Errorf("GetHeader(x-mixed-case): got %q, %v", value, ok)
+	}
+	// Present but empty is not missing
+	if value, ok := req.GetHeader("X-Empty"); !ok || value != "" {
+		t.Errorf("GetHeader(X-Empty): got %q, %v", value, ok)
+	}
+	if value, ok := req.GetHeader("Accept"); ok || value != "" {
+		t.Errorf("GetHeader(Accept): got %q, %v, want it missing", value, ok)
+	}
+}
+
+func TestTruncatedRequest(t *testing.T) {
+	if _, err := parse(""); err != io.EOF {
+		t.Errorf("nothing sent: got %v, want io.EOF", err)
+	}
+	for name, raw := range map[string]string{
+		"request line":       "GET /echo/x HT",
+		"after request line": "GET /echo/x HTTP/1.1\r\n",
+		"mid header":         "GET /echo/x HTTP/1.1\r\nHost: x\r\nX-A: 1",
+		"before blank line":  "GET /echo/x HTTP/1.1\r\nHost: x\r\n",
+	} {
+		if _, err := parse(raw); !errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) {
+			t.Errorf("%s: got %v, want io.ErrUnexpectedEOF", name, err)
+		}
+	}
+}
+
+func TestTruncatedRequestLogging(t *testing.T) {
+	config := testConfig()
+	config.LogLevel = LevelDebug
+	s, logs := startTestServer(t, config)
+
+	// closeAfter sends raw and hangs up, then waits for the server to log a line about it
+	closeAfter := func(raw, want string) string {
+		conn, _ := dial(t, s)
+		io.WriteString(conn, raw)
+		conn.Close()
+		deadline := time.Now().Add(2 * time.Second)
+		for !strings.Contains(logs.String(), want) {
+			if time.Now().After(deadline) {
+				t.Fatalf("%q never logged:\n%s", want, logs.String())
+			}
+			time.Sleep(time.Millisecond)
+		}
+		return logs.String()
+	}
+
+	closeAfter("", "DEBUG Client closed connection\n")
+	out := closeAfter("GET /echo/x HTTP/1.1\r\nHost: loc", "INFO Client closed connection mid-request")
+	if strings.Contains(out, "Error parsing request") {
+		t.Errorf("a truncated request logged as a parse error:\n%s", out)
+	}
+}
+
+func TestTruncatedBody(t *testing.T) {
+	s, _ := startTestServer(t, testConfig())
+
+	conn, r := dial(t, s)
+	io.WriteString(conn, "POST /echo/x HTTP/1.1\r\nHost: localhost\r\nContent-Length: 100\r\n\r\n"+strings.Repeat("b", 40))
+	// Half-close: the server reads EOF but can still answer
+	conn.(*net.TCPConn).CloseWrite()
+
+	resp, _ := readResponse(t, r, http.MethodPost)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("40 of 100 bytes: got %d, want 400", resp.StatusCode)
+	}
+	if _, err := r.ReadByte(); err != io.EOF {
+		t.Errorf("after the 400: got %v, want the connection closed", err)
+	}
+
+	// Unlike a body cut off, a connection closed before the next request gets no answer
+	conn, r = dial(t, s)
+	conn.(*net.TCPConn).CloseWrite()
+	if out, _ := io.ReadAll(r); len(out) != 0 {
+		t.Errorf("clean close: got %q, want nothing", out)
+	}
+}
+
+// withHeaders builds a request with n extra header lines
+func withHeaders(n int) string {
+	var b strings.Builder
+	b.WriteString("GET /echo/x HTTP/1.1\r\nHost: localhost\r\n")
+	for i := range n {
+		fmt.Fprintf(&b, "X-H%d: v\r\n", i)
+	}
+	b.WriteString("\r\n")
+	return b.String()
+}
+
+func TestMaxHeaderCount(t *testing.T) {
+	s, _ := startTestServer(t, testConfig())
+	// Host plus 99 is exactly the default limit
+	if resp, _ := roundTrip(t, s, withHeaders(defaultMaxHeaderCount-1)); resp.StatusCode != http.StatusOK {
+		t.Errorf("%d headers: got %d, want 200", defaultMaxHeaderCount, resp.StatusCode)
+	}
+	if resp, _ := roundTrip(t, s, withHeaders(defaultMaxHeaderCount)); resp.StatusCode != http.StatusRequestHeaderFieldsTooLarge {
+		t.Errorf("%d headers: got %d, want 431", defaultMaxHeaderCount+1, resp.StatusCode)
+	}
+
+	config := testConfig()
+	config.MaxHeaderCount = 5
+	s, _ = startTestServer(t, config)
+	if resp, _ := roundTrip(t, s, withHeaders(5)); resp.StatusCode != http.StatusRequestHeaderFieldsTooLarge {
+		t.Errorf("6 headers with MaxHeaderCount 5: got %d, want 431", resp.StatusCode)
+	}
+	if err := (Config{MaxHeaderCount: -1}).validate(); err == nil {
+		t.Error("negative MaxHeaderCount accepted")
+	}
+}
+
+func TestMalformedRequestAnswered(t *testing.T) {
+	s, _ := startTestServer(t, testConfig())
+	for name, raw := range map[string]string{
+		"garbage":               "garbage\r\n\r\n",
+		"two parts":             "GET /\r\n\r\n",
+		"four parts":            "GET / HTTP/1.1 extra\r\n\r\n",
+		"bad Content-Length":    "POST /echo/x HTTP/1.1\r\nHost: localhost\r\nContent-Length: ten\r\n\r\n",
+		"signed Content-Length": "POST /echo/x HTTP/1.1\r\nHost: localhost\r\nContent-Length: -1\r\n\r\n",
+	} {
+		conn, r := dial(t, s)
+		io.WriteString(conn, raw)
+		resp, _ := readResponse(t, r, http.MethodGet)
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: got %d, want 400", name, resp.StatusCode)
+		}
+		if !resp.Close {
+			t.Errorf("%s: the connection stays open after a 400", name)
+		}
+		if _, err := r.ReadByte(); err != io.EOF {
+			t.Errorf("%s: got %v after the 400, want the connection closed", name, err)
+		}
+	}
+}
+
+func TestIsKeepAlive(t *testing.T) {
+	for _, tc := range []struct {
+		minor      int
+		connection string
+		want       bool
+	}{
+		{1, "", true}, // HTTP/1.1 defaults to persistent
+		{1, "close", false},
+		{1, "keep-alive", true},
+		{1, "Keep-Alive, Close", false},
+		{0, "", false}, // HTTP/1.0 closes unless asked not to
+		{0, "keep-alive", true},
+		{0, "Keep-Alive", true},
+		{0, "keep-alive, close", false},
+	} {
+		headers := map[string]string{}
+		if tc.connection != "" {
+			headers["Connection"] = tc.connection
+		}
+		req := newTestRequest(http.MethodGet, "/", headers, "")
+		req.ProtoMinor = tc.minor
+		if got := req.IsKeepAlive(); got != tc.want {
+			t.Errorf("HTTP/1.%d, Connection %q: got %v, want %v", tc.minor, tc.connection, got, tc.want)
+		}
+	}
+}
+
+func TestIsWebSocketUpgrade(t *testing.T) {
+	for _, tc := range []struct {
+		upgrade, connection string
+		want                bool
+	}{
+		{"websocket", "Upgrade", true},
+		{"WebSocket", "keep-alive, Upgrade", true},
+		{"h2c, websocket", "upgrade", true},
+		{"websocket", "", false},
+		{"", "Upgrade", false},
+		{"h2c", "Upgrade", false},
+		{"websocket", "keep-alive", false},
+	} {
+		headers := map[string]string{}
+		if tc.upgrade != "" {
+			headers["Upgrade"] = tc.upgrade
+		}
+		if tc.connection != "" {
+			headers["Connection"] = tc.connection
+		}
+		if got := newTestRequest(http.MethodGet, "/", headers, "").IsWebSocketUpgrade(); got != tc.want {
+			t.Errorf("Upgrade %q, Connection %q: got %v, want %v", tc.upgrade, tc.connection, got, tc.want)
+		}
+	}
+}
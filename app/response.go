@@ -4,20 +4,73 @@ import (
 	"bufio"
 	"bytes"
 	"compress/gzip"
+	"compress/zlib"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"html"
+	"io"
+	"maps"
 	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/textproto"
+	"slices"
 	"strings"
+	"sync"
 )
 
+// supportedCompression are the content codings doCompression implements
 var supportedCompression = map[string]bool{
-	"gzip": true,
+	"gzip":    true,
+	"deflate": true,
 }
 
 type Response struct {
+	Version    string // protocol of the status line, "HTTP/1.1" when empty
 	StatusCode int
 	StatusText string
 	Headers    map[string]string
 	Body       []byte
+
+	// Stream, when set, produces the body incrementally instead of Body.
+	// The response is then sent with Transfer-Encoding: chunked.
+	Stream StreamFunc
+
+	// Trailers are sent after the last chunk of a Stream, for values only known
+	// once the body is done (a checksum, a signature). Only names announced
+	// with DeclareTrailers are sent; see SetTrailer.
+	Trailers map[string]string
+
+	// BodyReader, when set, is copied to the connection instead of Body.
+	// The handler must set Content-Length; an io.Closer is closed after sending.
+	BodyReader io.Reader
+
+	// Hijack, when set, takes over the connection once the response headers
+	// have been sent (e.g. after "101 Switching Protocols"). The HTTP loop
+	// stops reading requests and closes the connection when Hijack returns.
+	Hijack func(conn net.Conn, reader *bufio.Reader)
+
+	// Set-Cookie is the one header that can't be folded into a single line,
+	// so every cookie is kept as its own serialized header value.
+	Cookies []string
+}
+
+// StreamFunc writes a response body piece by piece. Every Write becomes one chunk
+// on the wire; the writer also implements Flusher to push buffered chunks out early.
+type StreamFunc func(w io.Writer) error
+
+// Flusher is implemented by the writer handed to a StreamFunc.
+type Flusher interface {
+	Flush() error
+}
+
+// NewStreamResponse creates a response whose body is generated by stream while it is being sent,
+// so the handler never has to buffer the whole body or know its length up front.
+func NewStreamResponse(statusCode int, statusText string, stream StreamFunc) *Response {
+	resp := NewResponse(statusCode, statusText, nil)
+	resp.Stream = stream
+	return resp
 }
 
 func NewResponse(statusCode int, statusText string, body []byte) *Response {
@@ -29,11 +82,104 @@ func NewResponse(statusCode int, statusText string, body []byte) *Response {
 	}
 }
 
+// DeclareTrailers announces the trailer fields a Stream will set, as the Trailer header.
+// The client learns about them before the body, so this must be called by the handler.
+func (r *Response) DeclareTrailers(names ...string) {
+	for _, name := range names {
+		name = textproto.CanonicalMIMEHeaderKey(name)
+		if trailer, ok := r.Headers["Trailer"]; ok && trailer != "" {
+			if !headerHasToken(trailer, name) {
+				r.SetHeader("Trailer", trailer+", "+name)
+			}
+		} else {
+			r.SetHeader("Trailer", name)
+		}
+	}
+}
+
+// SetTrailer sets a declared trailer value; call it from the Stream before it returns.
+func (r *Response) SetTrailer(name, value string) {
+	if r.Trailers == nil {
+		r.Trailers = make(map[string]string)
+	}
+	r.Trailers[textproto.CanonicalMIMEHeaderKey(name)] = value
+}
+
+// AddVary appends field to the Vary header unless it is already listed
+func (r *Response) AddVary(field string) {
+	vary, ok := r.Headers["Vary"]
+	if !ok || strings.TrimSpace(vary) == "" {
+		r.SetHeader("Vary", field)
+		return
+	}
+	if headerHasToken(vary, field) {
+		return
+	}
+	r.SetHeader("Vary", vary+", "+field)
+}
+
+// AddCookie queues a Set-Cookie header for c.
+// Secure, HttpOnly, Max-Age and SameSite are serialized by http.Cookie itself.
+func (r *Response) AddCookie(c *http.Cookie) {
+	// String() returns "" for a cookie with an invalid name
+	if v := c.String(); v != "" {
+		r.Cookies = append(r.Cookies, v)
+	}
+}
+
+// NewRedirect builds a 3xx response pointing the client at location.
+// A non-3xx code is a programming error and yields a 500 instead of a redirect.
+func NewRedirect(statusCode int, location string) *Response {
+	if statusCode < 300 || statusCode > 399 {
+		return NewResponse(http.StatusInternalServerError, "Internal Server Error",
+			[]byte(fmt.Sprintf("invalid redirect status code: %d", statusCode)))
+	}
+
+	// Browsers follow the Location header; the body is only shown by clients that don't
+	body := fmt.Sprintf("<html><body><a href=\"%s\">%s</a>.</body></html>\n",
+		html.EscapeString(location), http.StatusText(statusCode))
+	resp := NewResponse(statusCode, http.StatusText(statusCode), []byte(body))
+	resp.SetHeader("Location", location)
+	resp.SetHeader("Content-Type", "text/html; charset=utf-8")
+	return resp
+}
+
+// SetHeader stores the header under its canonical name, so "content-type" and
+// "Content-Type" refer to the same entry.
 func (r *Response) SetHeader(key, value string) {
-	r.Headers[key] = value
+	r.Headers[textproto.CanonicalMIMEHeaderKey(key)] = value
 }
 
-func writeResponse(conn net.Conn, resp *Response) error {
+// SetJSON marshals v into the response body and marks it as JSON.
+// Marshal errors are returned untouched so the handler can answer with a 500.
+func (r *Response) SetJSON(v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	r.Body = body
+	r.SetHeader("Content-Type", "application/json")
+	return nil
+}
+
+// NewJSONResponse builds a response with v marshaled as its JSON body, the
+// status text taken from statusCode. Marshal errors are returned as with SetJSON.
+func NewJSONResponse(statusCode int, v interface{}) (*Response, error) {
+	resp := NewResponse(statusCode, http.StatusText(statusCode), nil)
+	if err := resp.SetJSON(v); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// writeResponse serializes resp into the connection's writer. Streamed and
+// file bodies are flushed as they go; a plain response may stay buffered,
+// the caller decides when to flush (see handleConnection).
+func writeResponse(w *bufio.Writer, resp *Response) error {
+	if closer, ok := resp.BodyReader.(io.Closer); ok {
+		defer closer.Close()
+	}
+
 	/*
 	   WHY bufio.Writer instead of strings.Builder?
 
@@ -70,18 +216,73 @@ func writeResponse(conn net.Conn, resp *Response) error {
 
 	   Conclusion: bufio.Writer is the Go idiom for network I/O
 	               (Used internally by net/http standard library)
+
+	   The writer belongs to the connection (see handleConnection), not to this call.
 	*/
-	w := bufio.NewWriter(conn)
+
+	// HTTP/1.0 has no chunked encoding: a stream goes out as it is and the
+	// end of the connection ends the body (processCommonHeaders sets
+	// Connection: close). There is no place left for trailers.
+	rawStream := resp.Stream != nil && resp.Version == "HTTP/1.0"
+	if resp.Stream != nil {
+		// Length is unknown until the stream finishes, chunked framing replaces Content-Length
+		delete(resp.Headers, "Content-Length")
+		if rawStream {
+			delete(resp.Headers, "Trailer")
+		} else {
+			resp.SetHeader("Transfer-Encoding", "chunked")
+		}
+	}
+
+	// Handlers may also write to resp.Headers directly with any casing, so names are
+	// canonicalized here as well: "content-type" → "Content-Type".
+	headers := make(map[string]string, len(resp.Headers))
+	for key, value := range resp.Headers {
+		headers[textproto.CanonicalMIMEHeaderKey(key)] = value
+	}
+
+	/*
+	   Response splitting:
+
+	     resp.SetHeader("X-Echo", "a\r\nSet-Cookie: session=evil")
+
+	   would put a header of the attacker's choosing on the wire (or, with
+	   "\r\n\r\n", a whole body). Nothing is written before every line has
+	   been checked, so a bad value fails the response without half of it sent.
+	*/
+	for name, value := range headers {
+		if strings.ContainsAny(name, "\r\n") || strings.ContainsAny(value, "\r\n") {
+			return fmt.Errorf("invalid response header %q: contains CR or LF", name)
+		}
+	}
+	for _, cookie := range resp.Cookies {
+		if strings.ContainsAny(cookie, "\r\n") {
+			return errors.New("invalid Set-Cookie: contains CR or LF")
+		}
+	}
 
 	// Write status line
-	statusLine := fmt.Sprintf("HTTP/1.1 %d %s\r\n", resp.StatusCode, resp.StatusText)
+	version := resp.Version
+	if version == "" {
+		version = "HTTP/1.1"
+	}
+	statusLine := fmt.Sprintf("%s %d %s\r\n", version, resp.StatusCode, resp.StatusText)
 	if _, err := w.WriteString(statusLine); err != nil {
 		return err
 	}
 
 	// Write headers
-	for key, value := range resp.Headers {
-		if _, err := w.WriteString(fmt.Sprintf("%s: %s\r\n", key, value)); err != nil {
+	// Map iteration order is random, so sort the keys to make the output byte-for-byte
+	// reproducible. Alphabetical order also keeps Content-Encoding/Length/Type together.
+	for _, name := range slices.Sorted(maps.Keys(headers)) {
+		if _, err := w.WriteString(fmt.Sprintf("%s: %s\r\n", name, headers[name])); err != nil {
+			return err
+		}
+	}
+
+	// Write cookies, one Set-Cookie line each
+	for _, cookie := range resp.Cookies {
+		if _, err := w.WriteString(fmt.Sprintf("Set-Cookie: %s\r\n", cookie)); err != nil {
 			return err
 		}
 	}
@@ -91,6 +292,34 @@ func writeResponse(conn net.Conn, resp *Response) error {
 		return err
 	}
 
+	if rawStream {
+		// *bufio.Writer is already a Flusher
+		if err := resp.Stream(w); err != nil {
+			return err
+		}
+		return w.Flush()
+	}
+	if resp.Stream != nil {
+		return writeChunkedBody(w, resp)
+	}
+
+	if resp.BodyReader != nil {
+		/*
+		   Headers go out first, then the body is copied straight to the socket.
+		   With an empty buffer, bufio.Writer.ReadFrom hands the copy to the
+		   underlying writer: for a *net.TCPConn and an *os.File that is
+		   TCPConn.ReadFrom → sendfile(2), the kernel moves file pages to the
+		   socket and the body never enters user space.
+		*/
+		if err := w.Flush(); err != nil {
+			return err
+		}
+		if _, err := io.Copy(w, resp.BodyReader); err != nil {
+			return err
+		}
+		return w.Flush()
+	}
+
 	// Write body
 	if len(resp.Body) > 0 {
 		if _, err := w.Write(resp.Body); err != nil {
@@ -98,62 +327,227 @@ func writeResponse(conn net.Conn, resp *Response) error {
 		}
 	}
 
+	return nil
+}
+
+func writeChunkedBody(w *bufio.Writer, resp *Response) error {
+	/*
+	   Chunked transfer encoding:
+
+	     HTTP/1.1 200 OK\r\n
+	     Transfer-Encoding: chunked\r\n
+	     \r\n
+	     5\r\n          ← chunk size in hex
+	     Hello\r\n      ← chunk data
+	     7\r\n
+	     , World\r\n
+	     0\r\n          ← zero-sized chunk marks the end of the body
+	     X-Checksum: 9a0364b9\r\n   ← optional trailers, announced by "Trailer:"
+	     \r\n          ← end of trailer section
+
+	   The client reassembles the body without knowing its length in advance.
+	*/
+	cw := &chunkedWriter{w: w, chunks: httputil.NewChunkedWriter(w)}
+	if err := resp.Stream(cw); err != nil {
+		// Status line is already sent, the only way to signal failure is to
+		// not terminate the body - the caller closes the connection
+		return err
+	}
+
+	// Writes the final "0\r\n" chunk
+	if err := cw.chunks.Close(); err != nil {
+		return err
+	}
+	// Undeclared trailers are dropped, the client was not told to expect them
+	declared := resp.Headers["Trailer"]
+	for _, name := range slices.Sorted(maps.Keys(resp.Trailers)) {
+		if !headerHasToken(declared, name) {
+			continue
+		}
+		if strings.ContainsAny(name, "\r\n") || strings.ContainsAny(resp.Trailers[name], "\r\n") {
+			return fmt.Errorf("invalid trailer %q: contains CR or LF", name)
+		}
+		if _, err := w.WriteString(fmt.Sprintf("%s: %s\r\n", name, resp.Trailers[name])); err != nil {
+			return err
+		}
+	}
+	if _, err := w.WriteString("\r\n"); err != nil {
+		return err
+	}
 	return w.Flush()
 }
 
-func processCommonHeaders(r *Request, resp *Response) error {
+type chunkedWriter struct {
+	w      *bufio.Writer
+	chunks io.WriteCloser
+}
+
+func (c *chunkedWriter) Write(p []byte) (int, error) {
+	return c.chunks.Write(p)
+}
+
+func (c *chunkedWriter) Flush() error {
+	return c.w.Flush()
+}
+
+func (s *Server) processCommonHeaders(r *Request, resp *Response) error {
 	// Handle Accept-Encoding for compression
-	if compressType, ok := r.GetHeader("Accept-Encoding"); ok {
-		if err := compressBody(resp, compressType); err != nil {
+	// Streamed bodies are not available here, so they are always sent uncompressed.
+	// An empty body stays empty: gzip would turn it into a 20-byte stream,
+	// which breaks bodyless responses like "101 Switching Protocols".
+	// A body the handler already encoded (e.g. a .gz sidecar) is left as it is.
+	_, encoded := resp.Headers["Content-Encoding"]
+	if compressType, ok := r.GetHeader("Accept-Encoding"); ok && len(resp.Body) > 0 && resp.Stream == nil && resp.BodyReader == nil && !encoded {
+		config := s.config.Load()
+		if err := compressBody(resp, compressType, config.compressionPreference(), config.gzipLevel()); err != nil {
 			return err
 		}
+		// The body now depends on Accept-Encoding, even if we ended up not compressing.
+		// Without Vary a shared cache could hand the gzip body to a client that can't decode it.
+		resp.AddVary("Accept-Encoding")
 	}
 
-	// If body is present, set Content-Length header, if not already set
-	// This is important after compression, as body length may have changed
-	if len(resp.Body) > 0 {
+	// Set Content-Length header, if not already set
+	// This is important after compression, as body length may have changed.
+	// An empty body still gets "Content-Length: 0", otherwise a keep-alive
+	// client can't tell it apart from a body that hasn't arrived yet.
+	if resp.Stream == nil && bodyAllowed(resp.StatusCode) {
 		if _, exists := resp.Headers["Content-Length"]; !exists {
 			resp.Headers["Content-Length"] = fmt.Sprintf("%d", len(resp.Body))
 		}
 	}
 
+	// Some responses never carry a body, whatever the handler put in resp.
+	// HEAD keeps the headers (Content-Length included) of the GET it mirrors.
+	if !bodyAllowed(resp.StatusCode) {
+		dropBody(resp)
+		delete(resp.Headers, "Content-Length")
+	} else if r.Method == http.MethodHead {
+		dropBody(resp)
+	}
+
+	if s.config.Load().NoSniff {
+		if _, set := resp.Headers["X-Content-Type-Options"]; !set {
+			resp.SetHeader("X-Content-Type-Options", "nosniff")
+		}
+	}
+
+	// Answer in the client's protocol version, an HTTP/1.0 client may not understand 1.1
+	if r.Version == "HTTP/1.0" {
+		resp.Version = "HTTP/1.0"
+		if resp.Stream != nil {
+			// Without chunked framing only closing the connection ends a stream
+			resp.SetHeader("Connection", "close")
+		}
+	}
+
 	// Handle Connection: close
-	if val, ok := r.GetHeader("Connection"); ok && val == "close" {
+	if !r.IsKeepAlive() {
 		resp.SetHeader("Connection", "close")
+	} else if _, set := resp.Headers["Connection"]; !set && r.Version == "HTTP/1.0" {
+		// Keep-alive is opt-in for HTTP/1.0: confirm it, or the client closes anyway.
+		// Keep-Alive tells it how long an idle connection is held (ReadTimeout).
+		// A handler that set Connection itself (e.g. "Upgrade") is left alone.
+		resp.SetHeader("Connection", "keep-alive")
+		resp.SetHeader("Keep-Alive", fmt.Sprintf("timeout=%d", int(s.config.Load().ReadTimeout.Seconds())))
 	}
 
 	return nil
 }
 
-func compressBody(resp *Response, compressType string) error {
-	// "Accept-Encoding: invalid-encoding-1, gzip, invalid-encoding-2"
-	// Check each encoding in order, use the first supported one
-	compressTypePart := strings.SplitSeq(strings.TrimSpace(compressType), ",")
+// SanitizeHeaderValue makes user-supplied text safe to reflect in a header:
+// control characters, CR and LF among them, are dropped. writeResponse rejects
+// values with CR or LF, so handlers that reflect input should pass it through here.
+func SanitizeHeaderValue(value string) string {
+	return strings.Map(func(r rune) rune {
+		if (r < 0x20 && r != '\t') || r == 0x7f {
+			return -1
+		}
+		return r
+	}, value)
+}
 
-	for ct := range compressTypePart {
-		// Trim spaces around each encoding type
-		ct = strings.TrimSpace(ct)
+// dropBody discards every kind of body resp may hold, closing a pending BodyReader
+func dropBody(resp *Response) {
+	resp.Body = nil
+	resp.Stream = nil
+	if closer, ok := resp.BodyReader.(io.Closer); ok {
+		closer.Close()
+	}
+	resp.BodyReader = nil
+}
 
-		// Check if this compression type is supported
-		if supportedCompression[ct] {
-			fmt.Println("compressType", ct)
-			if err := doCompression(resp, ct); err != nil {
-				// Log error but continue - try next encoding
-				// May be next compression type in the list is working error free
-				continue
-			}
-			return nil // Successfully compressed
-		}
+// bodyAllowed reports whether a response with this status can have a body.
+// 1xx, 204 No Content and 304 Not Modified never do (RFC 9110 §6.4.1),
+// and must not send Content-Length either.
+func bodyAllowed(statusCode int) bool {
+	return statusCode >= 200 && statusCode != http.StatusNoContent && statusCode != http.StatusNotModified
+}
+
+// compressBody compresses the body with the coding chooseEncoding settles on.
+// If compression fails the body is sent as it is, which every client understands.
+func compressBody(resp *Response, acceptEncoding string, preference []string, level int) error {
+	// "Accept-Encoding: invalid-encoding-1, gzip, invalid-encoding-2" → gzip
+	encoding := chooseEncoding(acceptEncoding, preference)
+	if encoding == "" {
+		return nil // No supported encoding found - send uncompressed
 	}
-	// No supported encoding found - send uncompressed
+	// doCompression only replaces the body once it succeeded
+	_ = doCompression(resp, encoding, level)
 	return nil
 }
 
-func doCompression(resp *Response, compressType string) error {
+/*
+   Pooling compression state:
+
+   A gzip.Writer carries ~800 KB of internal tables, allocating one per
+   response shows up right at the top of allocation profiles under load.
+   sync.Pool keeps released writers around for reuse:
+
+     w := pool.Get()   → reuse an old writer (or allocate if the pool is empty)
+     w.Reset(buf)      → forget all previous state, write into buf from now on
+     ... Write, Close ...
+     pool.Put(w)       → hand it back for the next response
+
+   Writers are level-specific, so there is one pool per gzip level
+   (HuffmanOnly = -2 ... BestCompression = 9).
+*/
+
+var gzipWriterPools [gzip.BestCompression - gzip.HuffmanOnly + 1]sync.Pool
+
+var compressBufferPool = sync.Pool{
+	New: func() any { return new(bytes.Buffer) },
+}
+
+func getGzipWriter(w io.Writer, level int) (*gzip.Writer, error) {
+	if level < gzip.HuffmanOnly || level > gzip.BestCompression {
+		return nil, fmt.Errorf("invalid gzip level: %d", level)
+	}
+	if gw, ok := gzipWriterPools[level-gzip.HuffmanOnly].Get().(*gzip.Writer); ok {
+		gw.Reset(w)
+		return gw, nil
+	}
+	return gzip.NewWriterLevel(w, level)
+}
+
+func doCompression(resp *Response, compressType string, level int) error {
 	switch compressType {
 	case "gzip":
-		var b bytes.Buffer
-		w := gzip.NewWriter(&b)
+		b := compressBufferPool.Get().(*bytes.Buffer)
+		b.Reset()
+		defer compressBufferPool.Put(b)
+
+		w, err := getGzipWriter(b, level)
+		if err != nil {
+			return err
+		}
+		// Only a writer that was closed successfully has a clean state worth reusing
+		closed := false
+		defer func() {
+			if closed {
+				gzipWriterPools[level-gzip.HuffmanOnly].Put(w)
+			}
+		}()
 
 		// Write data to the gzip writer; it gets compressed into 'b'
 		if _, err := w.Write(resp.Body); err != nil {
@@ -164,8 +558,26 @@ func doCompression(resp *Response, compressType string) error {
 		if err := w.Close(); err != nil {
 			return err
 		}
+		closed = true
 
 		// Replace response body with compressed data
+		// Copy it out: b goes back to the pool and will be overwritten by the next response
+		resp.Body = bytes.Clone(b.Bytes())
+		resp.SetHeader("Content-Encoding", compressType)
+	case "deflate":
+		// HTTP's "deflate" is the zlib format (RFC 9110 §8.4.1.2), not raw DEFLATE.
+		// It is rarely chosen over gzip, so its writers aren't pooled.
+		var b bytes.Buffer
+		w, err := zlib.NewWriterLevel(&b, level)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(resp.Body); err != nil {
+			return err
+		}
+		if err := w.Close(); err != nil {
+			return err
+		}
 		resp.Body = b.Bytes()
 		resp.SetHeader("Content-Encoding", compressType)
 	}
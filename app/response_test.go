@@ -0,0 +1,585 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNewJSONResponse(t *testing.T) {
+	type item struct {
+		ID   int      `json:"id"`
+		Name string   `json:"name"`
+		Tags []string `json:"tags,omitempty"`
+	}
+	resp, err := NewJSONResponse(http.StatusCreated, item{ID: 7, Name: "widget", Tags: []string{"a"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(resp.Body), `{"id":7,"name":"widget","tags":["a"]}`; got != want {
+		t.Errorf("body: got %s, want %s", got, want)
+	}
+	if got := resp.Headers["Content-Type"]; got != "application/json" {
+		t.Errorf("Content-Type: got %q", got)
+	}
+	if resp.StatusCode != http.StatusCreated || resp.StatusText != "Created" {
+		t.Errorf("status: got %d %q", resp.StatusCode, resp.StatusText)
+	}
+}
+
+func TestSetJSONError(t *testing.T) {
+	resp := NewResponse(http.StatusOK, "OK", []byte("unchanged"))
+	// A channel has no JSON form, the handler must get the error to answer 500
+	if err := resp.SetJSON(map[string]interface{}{"c": make(chan int)}); err == nil {
+		t.Fatal("SetJSON accepted a value that can't be marshaled")
+	}
+	if string(resp.Body) != "unchanged" || resp.Headers["Content-Type"] != "" {
+		t.Errorf("a failed SetJSON changed the response: %q %v", resp.Body, resp.Headers)
+	}
+	if _, err := NewJSONResponse(http.StatusOK, make(chan int)); err == nil {
+		t.Error("NewJSONResponse accepted a value that can't be marshaled")
+	}
+}
+
+func streamHello() *Response {
+	resp := NewStreamResponse(http.StatusOK, "OK", func(w io.Writer) error {
+		io.WriteString(w, "hel")
+		w.(Flusher).Flush()
+		io.WriteString(w, "lo")
+		return nil
+	})
+	resp.DeclareTrailers("X-Checksum")
+	resp.SetTrailer("X-Checksum", "abc")
+	return resp
+}
+
+func TestStreamResponseChunked(t *testing.T) {
+	s, _ := newTestServer(t, testConfig())
+	s.router.RegisterExactRoute("/s", func(r *Request) *Response { return streamHello() })
+	start(t, s)
+
+	resp, body := get(t, s, "GET", "/s")
+	if got := resp.TransferEncoding; len(got) != 1 || got[0] != "chunked" {
+		t.Errorf("Transfer-Encoding: got %v, want chunked", got)
+	}
+	if body != "hello" {
+		t.Errorf("body: got %q, want hello", body)
+	}
+	if got := resp.Trailer.Get("X-Checksum"); got != "abc" {
+		t.Errorf("trailer X-Checksum: got %q, want abc", got)
+	}
+}
+
+func TestStreamResponseHTTP10(t *testing.T) {
+	s, _ := newTestServer(t, testConfig())
+	s.router.RegisterExactRoute("/s", func(r *Request) *Response { return streamHello() })
+	start(t, s)
+
+	// Even a keep-alive HTTP/1.0 client can only see the end of the body by the connection closing
+	out := rawResponse(t, s, "GET /s HTTP/1.0\r\nConnection: keep-alive\r\n\r\n")
+	head, body, _ := strings.Cut(out, "\r\n\r\n")
+	if !strings.HasPrefix(head, "HTTP/1.0 200 OK\r\n") {
+		t.Errorf("status line: got %q", head)
+	}
+	for _, unwanted := range []string{"Transfer-Encoding", "Trailer", "Content-Length"} {
+		if strings.Contains(head, unwanted+":") {
+			t.Errorf("HTTP/1.0 stream has %s:\n%s", unwanted, head)
+		}
+	}
+	if !strings.Contains(head, "Connection: close") {
+		t.Errorf("HTTP/1.0 stream without Connection: close:\n%s", head)
+	}
+	if body != "hello" {
+		t.Errorf("body: got %q, want the raw stream hello", body)
+	}
+}
+
+func TestNewRedirect(t *testing.T) {
+	resp := NewRedirect(http.StatusFound, "../login?next=%2F")
+	if resp.StatusCode != http.StatusFound || resp.StatusText != "Found" {
+		t.Errorf("status: got %d %s", resp.StatusCode, resp.StatusText)
+	}
+	if got := resp.Headers["Location"]; got != "../login?next=%2F" {
+		t.Errorf("Location: got %q, want the relative location unchanged", got)
+	}
+	if !strings.Contains(string(resp.Body), `<a href="../login?next=%2F">`) {
+		t.Errorf("body: got %q", resp.Body)
+	}
+
+	// Escaped in the HTML body, never in the header
+	resp = NewRedirect(http.StatusSeeOther, `/a"><script>`)
+	if strings.Contains(string(resp.Body), "<script>") {
+		t.Errorf("location not escaped in body: %q", resp.Body)
+	}
+
+	for _, code := range []int{http.StatusOK, http.StatusBadRequest, 299, 400} {
+		resp := NewRedirect(code, "/elsewhere")
+		if resp.StatusCode != http.StatusInternalServerError {
+			t.Errorf("NewRedirect(%d): got %d, want 500", code, resp.StatusCode)
+		}
+		if _, ok := resp.Headers["Location"]; ok {
+			t.Errorf("NewRedirect(%d) set Location", code)
+		}
+	}
+}
+
+func TestAddCookie(t *testing.T) {
+	s, _ := newTestServer(t, testConfig())
+	s.router.RegisterExactRoute("/login", func(r *Request) *Response {
+		resp := NewResponse(http.StatusOK, "OK", nil)
+		resp.AddCookie(&http.Cookie{Name: "session", Value: "abc", Path: "/", HttpOnly: true, Secure: true, SameSite: http.SameSiteStrictMode})
+		resp.AddCookie(&http.Cookie{Name: "theme", Value: "dark", MaxAge: 3600})
+		resp.AddCookie(&http.Cookie{Name: "bad name", Value: "dropped"})
+		return resp
+	})
+	start(t, s)
+
+	resp, _ := get(t, s, http.MethodGet, "/login")
+	got := resp.Header.Values("Set-Cookie")
+	want := []string{
+		"session=abc; Path=/; HttpOnly; Secure; SameSite=Strict",
+		"theme=dark; Max-Age=3600",
+	}
+	if len(got) != len(want) {
+		t.Fatalf("Set-Cookie lines: got %q, want %q", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("Set-Cookie %d: got %q, want %q", i, got[i], want[i])
+		}
+	}
+}
+
+// serialize runs writeResponse into memory
+func serialize(t *testing.T, resp *Response) string {
+	t.Helper()
+	var b bytes.Buffer
+	w := bufio.NewWriter(&b)
+	if err := writeResponse(w, resp); err != nil {
+		t.Fatal(err)
+	}
+	w.Flush()
+	return b.String()
+}
+
+func TestWriteResponseDeterministic(t *testing.T) {
+	build := func() *Response {
+		resp := NewResponse(http.StatusOK, "OK", []byte("hi"))
+		for _, name := range []string{"X-Zeta", "Content-Type", "X-Alpha", "Content-Length", "Cache-Control", "ETag", "Vary"} {
+			resp.SetHeader(name, "v")
+		}
+		return resp
+	}
+	first := serialize(t, build())
+	for range 20 {
+		if again := serialize(t, build()); again != first {
+			t.Fatalf("identical responses serialized differently:\n%q\n%q", first, again)
+		}
+	}
+	want := "HTTP/1.1 200 OK\r\nCache-Control: v\r\nContent-Length: v\r\nContent-Type: v\r\nEtag: v\r\nVary: v\r\nX-Alpha: v\r\nX-Zeta: v\r\n\r\nhi"
+	if first != want {
+		t.Errorf("got %q, want %q", first, want)
+	}
+}
+
+func TestWriteResponseCanonicalHeaders(t *testing.T) {
+	resp := NewResponse(http.StatusOK, "OK", nil)
+	resp.SetHeader("content-type", "text/plain")
+	// Written to the map directly, bypassing SetHeader
+	resp.Headers["x-request-id"] = "42"
+	resp.Headers["CACHE-CONTROL"] = "no-store"
+
+	out := serialize(t, resp)
+	for _, want := range []string{"\r\nContent-Type: text/plain\r\n", "\r\nX-Request-Id: 42\r\n", "\r\nCache-Control: no-store\r\n"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %q in %q", want, out)
+		}
+	}
+	for _, unwanted := range []string{"content-type", "x-request-id", "CACHE-CONTROL"} {
+		if strings.Contains(out, unwanted) {
+			t.Errorf("non-canonical %q in %q", unwanted, out)
+		}
+	}
+}
+
+func TestStreamResponseHTTPClient(t *testing.T) {
+	s, _ := newTestServer(t, testConfig())
+	s.router.RegisterExactRoute("/big", func(r *Request) *Response {
+		return NewStreamResponse(http.StatusOK, "OK", func(w io.Writer) error {
+			for i := range 1000 {
+				if _, err := io.WriteString(w, strings.Repeat(string(rune('a'+i%26)), 100)); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	})
+	start(t, s)
+
+	// Without keep-alive, Shutdown doesn't wait out the idle connection
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	resp, err := client.Get("http://" + s.Addr().String() + "/big")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("reading the chunked body: %v", err)
+	}
+	if len(body) != 100000 || !strings.HasPrefix(string(body), strings.Repeat("a", 100)+"b") {
+		t.Errorf("body: got %d bytes starting %q", len(body), body[:min(len(body), 120)])
+	}
+	if resp.ContentLength != -1 {
+		t.Errorf("ContentLength: got %d, want unknown", resp.ContentLength)
+	}
+}
+
+func TestVaryAcceptEncoding(t *testing.T) {
+	s, _ := newTestServer(t, testConfig())
+	s.router.RegisterExactRoute("/cors", func(r *Request) *Response {
+		resp := NewResponse(http.StatusOK, "OK", []byte(strings.Repeat("compress me ", 50)))
+		resp.SetHeader("Vary", "Origin")
+		return resp
+	})
+	start(t, s)
+
+	resp, _ := get(t, s, http.MethodGet, "/echo/"+strings.Repeat("a", 200), "Accept-Encoding: gzip")
+	if resp.Header.Get("Content-Encoding") != "gzip" || !headerHasToken(resp.Header.Get("Vary"), "Accept-Encoding") {
+		t.Errorf("gzip: Content-Encoding %q, Vary %q", resp.Header.Get("Content-Encoding"), resp.Header.Get("Vary"))
+	}
+	// Negotiated but not compressed, the body still depends on the header
+	resp, _ = get(t, s, http.MethodGet, "/echo/abc", "Accept-Encoding: identity")
+	if resp.Header.Get("Content-Encoding") != "" || !headerHasToken(resp.Header.Get("Vary"), "Accept-Encoding") {
+		t.Errorf("identity: Content-Encoding %q, Vary %q", resp.Header.Get("Content-Encoding"), resp.Header.Get("Vary"))
+	}
+	// Appended to the handler's Vary
+	resp, _ = get(t, s, http.MethodGet, "/cors", "Accept-Encoding: gzip")
+	if got := resp.Header.Get("Vary"); got != "Origin, Accept-Encoding" {
+		t.Errorf("existing Vary: got %q", got)
+	}
+}
+
+// compressibleText is prose-like filler: repetitive enough to compress well,
+// varied enough that the gzip levels come out differently
+func compressibleText(words int) []byte {
+	vocabulary := strings.Fields("the quick brown fox jumps over a lazy dog while seven wizards quietly judge boxing matches")
+	rng := rand.New(rand.NewPCG(1, 2))
+	var b bytes.Buffer
+	for range words {
+		b.WriteString(vocabulary[rng.IntN(len(vocabulary))])
+		b.WriteByte(' ')
+	}
+	return b.Bytes()
+}
+
+func gunzip(t *testing.T, data []byte) []byte {
+	t.Helper()
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestCompressionLevel(t *testing.T) {
+	body := compressibleText(20000)
+	sizes := make(map[int]int)
+	for _, level := range []int{gzip.BestSpeed, gzip.BestCompression} {
+		resp := NewResponse(http.StatusOK, "OK", body)
+		if err := doCompression(resp, "gzip", level); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(gunzip(t, resp.Body), body) {
+			t.Fatalf("level %d: the body doesn't round-trip", level)
+		}
+		sizes[level] = len(resp.Body)
+	}
+	if sizes[gzip.BestCompression] >= sizes[gzip.BestSpeed] {
+		t.Errorf("BestCompression %d bytes, BestSpeed %d bytes from %d", sizes[gzip.BestCompression], sizes[gzip.BestSpeed], len(body))
+	}
+
+	for _, level := range []int{-3, gzip.HuffmanOnly, gzip.DefaultCompression, 10} {
+		if err := (Config{CompressionLevel: level}).validate(); err == nil {
+			t.Errorf("CompressionLevel %d accepted", level)
+		}
+	}
+	if got := (Config{}).gzipLevel(); got != gzip.DefaultCompression {
+		t.Errorf("default level: got %d", got)
+	}
+}
+
+func TestDoCompressionReusesWriters(t *testing.T) {
+	// Every writer after the first comes from the pool, no state may leak between bodies
+	var wg sync.WaitGroup
+	for i := range 8 {
+		wg.Go(func() {
+			for j := range 50 {
+				body := []byte(strings.Repeat(fmt.Sprintf("body %d/%d ", i, j), 20+j))
+				resp := NewResponse(http.StatusOK, "OK", body)
+				if err := doCompression(resp, "gzip", gzip.DefaultCompression); err != nil {
+					t.Error(err)
+					return
+				}
+				// Not gunzip, t.Fatal must not be called off the test goroutine
+				r, err := gzip.NewReader(bytes.NewReader(resp.Body))
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if got, err := io.ReadAll(r); err != nil || !bytes.Equal(got, body) {
+					t.Errorf("body %d/%d came back as %q, %v", i, j, got, err)
+					return
+				}
+			}
+		})
+	}
+	wg.Wait()
+}
+
+// compressUnpooled is doCompression without the pools, the allocation baseline
+func compressUnpooled(resp *Response, level int) error {
+	var b bytes.Buffer
+	w, err := gzip.NewWriterLevel(&b, level)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(resp.Body); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	resp.Body = b.Bytes()
+	resp.SetHeader("Content-Encoding", "gzip")
+	return nil
+}
+
+func BenchmarkCompressPooled(b *testing.B) {
+	body := compressibleText(2000)
+	b.ReportAllocs()
+	for b.Loop() {
+		doCompression(NewResponse(http.StatusOK, "OK", body), "gzip", gzip.DefaultCompression)
+	}
+}
+
+func BenchmarkCompressUnpooled(b *testing.B) {
+	body := compressibleText(2000)
+	b.ReportAllocs()
+	for b.Loop() {
+		compressUnpooled(NewResponse(http.StatusOK, "OK", body), gzip.DefaultCompression)
+	}
+}
+
+func TestKeepAliveHeaders(t *testing.T) {
+	config := testConfig()
+	config.ReadTimeout = 7 * time.Second
+	s, _ := newTestServer(t, config)
+
+	for _, tc := range []struct {
+		version, connection   string
+		wantConn, wantTimeout string
+	}{
+		{"HTTP/1.0", "keep-alive", "keep-alive", "timeout=7"},
+		{"HTTP/1.0", "Keep-Alive", "keep-alive", "timeout=7"},
+		{"HTTP/1.0", "", "close", ""},
+		{"HTTP/1.1", "", "", ""}, // persistent by default, nothing to say
+		{"HTTP/1.1", "close", "close", ""},
+	} {
+		req := newTestRequest(http.MethodGet, "/", nil, "")
+		req.Version = tc.version
+		if tc.version == "HTTP/1.0" {
+			req.ProtoMinor = 0
+		}
+		if tc.connection != "" {
+			req.Headers["connection"] = tc.connection
+		}
+		resp := NewResponse(http.StatusOK, "OK", nil)
+		if err := s.processCommonHeaders(req, resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.Headers["Connection"] != tc.wantConn || resp.Headers["Keep-Alive"] != tc.wantTimeout {
+			t.Errorf("%s with Connection %q: got Connection %q, Keep-Alive %q, want %q, %q", tc.version, tc.connection,
+				resp.Headers["Connection"], resp.Headers["Keep-Alive"], tc.wantConn, tc.wantTimeout)
+		}
+	}
+}
+
+func TestEmptyBodyContentLength(t *testing.T) {
+	s, _ := newTestServer(t, testConfig())
+	for _, code := range []int{http.StatusNoContent, http.StatusNotModified} {
+		s.router.RegisterExactRoute("/"+strconv.Itoa(code), func(r *Request) *Response {
+			// A body set by mistake must not make it out either
+			return NewResponse(code, http.StatusText(code), []byte("stray"))
+		})
+	}
+	start(t, s)
+
+	fetch := func(target string) string {
+		return rawResponse(t, s, "GET "+target+" HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+	}
+	if out := fetch("/"); !strings.HasPrefix(out, "HTTP/1.1 200 OK\r\n") || !strings.Contains(out, "\r\nContent-Length: 0\r\n") {
+		t.Errorf("bodyless 200: got %q, want Content-Length: 0", out)
+	}
+	for _, target := range []string{"/204", "/304"} {
+		out := fetch(target)
+		if strings.Contains(out, "Content-Length") || !strings.HasSuffix(out, "\r\n\r\n") {
+			t.Errorf("GET %s: got %q, want no length and no body", target, out)
+		}
+	}
+}
+
+func TestNoBodyResponses(t *testing.T) {
+	s, _ := newTestServer(t, testConfig())
+	s.router.RegisterExactRoute("/204", func(r *Request) *Response {
+		return NewResponse(http.StatusNoContent, "No Content", []byte("stray"))
+	})
+	s.router.RegisterExactRoute("/304", func(r *Request) *Response {
+		resp := NewResponse(http.StatusNotModified, "Not Modified", []byte("stray"))
+		resp.SetHeader("Content-Length", "5")
+		return resp
+	})
+	start(t, s)
+
+	for _, tc := range []struct {
+		request, length string // length "" means no Content-Length at all
+	}{
+		{"GET /204", ""},
+		{"GET /304", ""}, // even the handler's own
+		{"HEAD /echo/hello", "5"},
+		{"HEAD /204", ""},
+	} {
+		out := rawResponse(t, s, tc.request+" HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+		head, body, ok := strings.Cut(out, "\r\n\r\n")
+		if !ok || body != "" {
+			t.Errorf("%s: got %q after the headers, want nothing", tc.request, body)
+		}
+		hasLength := strings.Contains(head, "\r\nContent-Length: ")
+		if tc.length == "" && hasLength {
+			t.Errorf("%s: has a Content-Length:\n%s", tc.request, head)
+		}
+		if tc.length != "" && !strings.Contains(head, "\r\nContent-Length: "+tc.length+"\r\n") {
+			t.Errorf("%s: want Content-Length %s:\n%s", tc.request, tc.length, head)
+		}
+	}
+}
+
+func TestStreamTrailers(t *testing.T) {
+	var resp *Response
+	resp = NewStreamResponse(http.StatusOK, "OK", func(w io.Writer) error {
+		sum := sha256.New()
+		out := io.MultiWriter(w, sum)
+		io.WriteString(out, "Hello")
+		io.WriteString(out, ", World")
+		// Only known once the body is written
+		resp.SetTrailer("x-checksum", hex.EncodeToString(sum.Sum(nil))[:8])
+		resp.SetTrailer("X-Undeclared", "dropped")
+		return nil
+	})
+	resp.DeclareTrailers("X-Checksum")
+
+	out := serialize(t, resp)
+	if !strings.Contains(out, "\r\nTrailer: X-Checksum\r\n") {
+		t.Errorf("no Trailer header:\n%q", out)
+	}
+	sum := sha256.Sum256([]byte("Hello, World"))
+	if want := "5\r\nHello\r\n7\r\n, World\r\n0\r\nX-Checksum: " + hex.EncodeToString(sum[:])[:8] + "\r\n\r\n"; !strings.HasSuffix(out, want) {
+		t.Errorf("body and trailers:\ngot  %q\nwant suffix %q", out, want)
+	}
+
+	// A trailer value would otherwise end the trailer section early
+	bad := NewStreamResponse(http.StatusOK, "OK", func(w io.Writer) error { return nil })
+	bad.DeclareTrailers("X-Checksum")
+	bad.SetTrailer("X-Checksum", "a\r\nX-Injected: 1")
+	if err := writeResponse(bufio.NewWriter(io.Discard), bad); err == nil {
+		t.Error("a trailer with CRLF was written")
+	}
+}
+
+func TestResponseSplitting(t *testing.T) {
+	for name, build := range map[string]func(*Response){
+		"value":        func(r *Response) { r.SetHeader("X-Echo", "a\r\nSet-Cookie: session=evil") },
+		"bare LF":      func(r *Response) { r.SetHeader("X-Echo", "a\nb") },
+		"body":         func(r *Response) { r.SetHeader("X-Echo", "a\r\n\r\n<script>") },
+		"name":         func(r *Response) { r.Headers["X-A\r\nX-B"] = "1" },
+		"cookie":       func(r *Response) { r.Cookies = append(r.Cookies, "a=1\r\nX-Injected: 1") },
+		"content type": func(r *Response) { r.SetHeader("Content-Type", "text/plain\r\n") },
+	} {
+		resp := NewResponse(http.StatusOK, "OK", []byte("hi"))
+		build(resp)
+		var b bytes.Buffer
+		w := bufio.NewWriter(&b)
+		if err := writeResponse(w, resp); err == nil {
+			t.Errorf("%s: written without an error", name)
+		}
+		w.Flush()
+		if b.Len() != 0 {
+			t.Errorf("%s: %q went out before the error", name, b.String())
+		}
+	}
+
+	resp := NewResponse(http.StatusOK, "OK", nil)
+	resp.SetHeader("X-Echo", SanitizeHeaderValue("a\r\nSet-Cookie: \x00session=evil\tok"))
+	if out := serialize(t, resp); !strings.Contains(out, "\r\nX-Echo: aSet-Cookie: session=evil\tok\r\n") {
+		t.Errorf("sanitized value:\n%q", out)
+	}
+}
+
+func TestResponseSplittingOverTheWire(t *testing.T) {
+	s, _ := newTestServer(t, testConfig())
+	s.router.RegisterPrefixRoute("/reflect/", func(r *Request) *Response {
+		resp := NewResponse(http.StatusOK, "OK", nil)
+		resp.SetHeader("X-Echo", r.Query().Get("v")) // a careless handler
+		return resp
+	})
+	start(t, s)
+
+	conn, r := dial(t, s)
+	io.WriteString(conn, "GET /reflect/?v=a%0d%0aSet-Cookie:%20evil HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	if out, _ := io.ReadAll(r); len(out) != 0 {
+		t.Errorf("got %q, want the connection closed without a response", out)
+	}
+}
+
+func TestNoSniff(t *testing.T) {
+	config := testConfig()
+	config.NoSniff = true
+	s, _ := newTestServer(t, config)
+	s.router.RegisterExactRoute("/own", func(r *Request) *Response {
+		resp := NewResponse(http.StatusOK, "OK", nil)
+		resp.SetHeader("X-Content-Type-Options", "custom")
+		return resp
+	})
+	start(t, s)
+
+	for _, target := range []string{"/echo/hi", "/missing"} {
+		if resp, _ := get(t, s, http.MethodGet, target); resp.Header.Get("X-Content-Type-Options") != "nosniff" {
+			t.Errorf("%s: X-Content-Type-Options %q, want nosniff", target, resp.Header.Get("X-Content-Type-Options"))
+		}
+	}
+	if resp, _ := get(t, s, http.MethodGet, "/own"); resp.Header.Get("X-Content-Type-Options") != "custom" {
+		t.Errorf("the handler's own value was overridden with %q", resp.Header.Get("X-Content-Type-Options"))
+	}
+}
+
+func TestNoSniffDisabled(t *testing.T) {
+	s, _ := startTestServer(t, testConfig())
+	if resp, _ := get(t, s, http.MethodGet, "/echo/hi"); resp.Header.Get("X-Content-Type-Options") != "" {
+		t.Errorf("X-Content-Type-Options sent by default: %q", resp.Header.Get("X-Content-Type-Options"))
+	}
+}
@@ -1,73 +1,407 @@
 package main
 
 import (
-	"sort"
+	"net/http"
+	"slices"
 	"strings"
+	"time"
 )
 
 type HandleFunc func(req *Request) *Response
 
-type PrefixRoute struct {
-	prefix  string
+/*
+   Segment trie:
+
+   Routes are split on "/" and stored one segment per node:
+
+     RegisterExactRoute("/", ...)              root ─┬─ ""          (exact)
+     RegisterPrefixRoute("/echo/", ...)              ├─ "echo"      (prefix)
+     RegisterExactRoute("/user-agent", ...)          ├─ "user-agent" (exact)
+     RegisterExactRoute("/users/:id", ...)           └─ "users" ── :id (exact)
+
+   Matching walks the request path one segment at a time, so the cost is
+   O(number of segments in the path) no matter how many routes exist.
+
+   Segment kinds, in matching priority:
+     1. static   "users"  must equal the path segment
+     2. param    ":id"    matches any single segment, captured as Params["id"]
+     3. wildcard "*"      terminal, matches all remaining segments (Params["*"]);
+                 "*filepath" is the same, captured as Params["filepath"]
+   A prefix route at a node matches whenever the path continues below it.
+*/
+
+type node struct {
+	children map[string]*node
+
+	param     *node  // child for a ":name" segment
+	paramName string // name of the captured segment, without ":"
+
+	wildcard     *route // terminal "*" segment
+	wildcardName string // "*" or the name after it, "*filepath" → "filepath"
+
+	handler       *route // exact route ending at this node
+	prefixHandler *route // prefix route rooted at this node
+	prefixSelf    bool   // prefix was registered without a trailing "/", so it matches this node too
+}
+
+// route is what the trie stores: the handler, with WithMethods already
+// applied, and the registration it came from
+type route struct {
 	handler HandleFunc
+	info    RouteInfo
+}
+
+func newNode() *node {
+	return &node{children: make(map[string]*node)}
 }
 
 type Router struct {
-	exactRoutes  map[string]HandleFunc
-	prefixRoutes []PrefixRoute
+	root        *node
+	middlewares []Middleware
+	routes      []RouteInfo // in registration order, see Routes
+
+	notFound         HandleFunc // nil uses handleNotFound
+	methodNotAllowed HandleFunc // nil sends an empty 405
+
+	// RedirectTrailingSlash answers an unmatched "/a/" with a redirect to "/a"
+	// (or "/a" to "/a/") when only the other form is registered.
+	RedirectTrailingSlash bool
+
+	// CaseInsensitivePaths makes "/ECHO/Hi" match the "/echo/" route.
+	// Only the matching is case-insensitive: handlers still see the original
+	// Request.Path and captured params keep their case.
+	// Must be set before routes are registered.
+	CaseInsensitivePaths bool
 }
 
 func NewRouter() *Router {
 	return &Router{
-		exactRoutes:  make(map[string]HandleFunc),
-		prefixRoutes: make([]PrefixRoute, 0),
+		root: newNode(),
 	}
 }
 
-func (r *Router) RegisterExactRoute(path string, handler HandleFunc) {
-	r.exactRoutes[path] = handler
+// Use adds middlewares that wrap every handler this router returns,
+// including the not-found and redirect handlers.
+func (r *Router) Use(middlewares ...Middleware) {
+	r.middlewares = append(r.middlewares, middlewares...)
+}
+
+// SetNotFoundHandler replaces the 404 response for paths no route matches.
+// Middlewares still wrap it.
+func (r *Router) SetNotFoundHandler(handler HandleFunc) {
+	r.notFound = handler
+}
+
+// SetMethodNotAllowedHandler replaces the 405 response for routes restricted
+// with WithMethods. The Allow header is added to whatever it returns.
+func (r *Router) SetMethodNotAllowedHandler(handler HandleFunc) {
+	r.methodNotAllowed = handler
+}
+
+// splitPath turns "/a/b" into ["a", "b"]. "/" becomes [""] and "/a/" becomes ["a", ""].
+func splitPath(path string) []string {
+	return strings.Split(strings.TrimPrefix(path, "/"), "/")
+}
+
+// insert walks (and creates) the nodes for the given segments and returns the last one
+func (r *Router) insert(segments []string) *node {
+	n := r.root
+	for _, segment := range segments {
+		if name, ok := strings.CutPrefix(segment, ":"); ok {
+			if n.param == nil {
+				n.param = newNode()
+				n.paramName = name
+			}
+			n = n.param
+			continue
+		}
+
+		if r.CaseInsensitivePaths {
+			segment = strings.ToLower(segment)
+		}
+		child, ok := n.children[segment]
+		if !ok {
+			child = newNode()
+			n.children[segment] = child
+		}
+		n = child
+	}
+	return n
+}
+
+// RouteKind tells how a route's pattern matches a path
+type RouteKind string
+
+const (
+	RouteExact    RouteKind = "exact"    // "/user-agent"
+	RoutePrefix   RouteKind = "prefix"   // "/echo/", everything below it
+	RouteParam    RouteKind = "param"    // "/users/:id", an exact route capturing segments
+	RouteWildcard RouteKind = "wildcard" // "/static/*", the rest of the path
+)
+
+// RouteInfo describes a registered route, see Routes
+type RouteInfo struct {
+	Kind    RouteKind
+	Pattern string   // as registered, e.g. "/users/:id"
+	Methods []string // empty means any method
+
+	// ReadTimeout and WriteTimeout replace Config's for requests on this
+	// route, 0 keeps the server's. See WithTimeouts.
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+
+	// LazyBody leaves the request body for the handler to read, see WithLazyBody
+	LazyBody bool
+
+	// Precheck runs before the body is read, see WithPrecheck
+	Precheck HandleFunc
+}
+
+// RouteOption configures a route at registration
+type RouteOption func(*RouteInfo)
+
+// WithMethods restricts a route to the given methods. Other methods get
+// 405 Method Not Allowed with an Allow header instead of reaching the handler.
+func WithMethods(methods ...string) RouteOption {
+	return func(info *RouteInfo) {
+		info.Methods = append(info.Methods, methods...)
+	}
+}
+
+// WithTimeouts gives a route its own read and write timeouts, e.g. for
+// large uploads or downloads that take longer than Config allows. The read
+// timeout starts once the headers are in and covers the body, the write
+// timeout covers handling and sending the response. 0 keeps the server's.
+func WithTimeouts(read, write time.Duration) RouteOption {
+	return func(info *RouteInfo) {
+		info.ReadTimeout, info.WriteTimeout = read, write
+	}
+}
+
+// WithLazyBody hands the handler the request body unread, as
+// Request.BodyReader, instead of reading it into Request.Body first.
+// Uploads can be streamed to disk without the 10 MB in-memory limit, and
+// a handler that ignores the body doesn't wait for it.
+func WithLazyBody() RouteOption {
+	return func(info *RouteInfo) {
+		info.LazyBody = true
+	}
+}
+
+// WithPrecheck runs check as soon as the request headers are in, before
+// the body is read and before a client sending "Expect: 100-continue" is
+// told to go ahead. check sees the headers and Params but no Body; if it
+// returns a response (e.g. 401 for a missing token), that is the final
+// response, the handler doesn't run and the client never sends the body.
+// A nil response lets the request through.
+func WithPrecheck(check HandleFunc) RouteOption {
+	return func(info *RouteInfo) {
+		info.Precheck = check
+	}
 }
 
-func (r *Router) RegisterPrefixRoute(prefix string, handler HandleFunc) {
-	r.prefixRoutes = append(r.prefixRoutes, PrefixRoute{
-		prefix:  prefix,
-		handler: handler,
+// Routes lists the registered routes sorted by pattern, so the output does
+// not depend on registration order. Re-registered patterns appear once.
+func (r *Router) Routes() []RouteInfo {
+	routes := slices.Clone(r.routes)
+	slices.SortStableFunc(routes, func(a, b RouteInfo) int {
+		if c := strings.Compare(a.Pattern, b.Pattern); c != 0 {
+			return c
+		}
+		return strings.Compare(string(a.Kind), string(b.Kind))
 	})
+	return routes
+}
+
+// addRoute records a registration for Routes and applies its options to handler
+func (r *Router) addRoute(kind RouteKind, pattern string, handler HandleFunc, opts []RouteOption) *route {
+	info := RouteInfo{Kind: kind, Pattern: pattern}
+	for _, opt := range opts {
+		opt(&info)
+	}
+
+	// A later registration replaces the handler in the trie, and so here
+	if i := slices.IndexFunc(r.routes, func(ri RouteInfo) bool { return ri.Kind == kind && ri.Pattern == pattern }); i >= 0 {
+		r.routes[i] = info
+	} else {
+		r.routes = append(r.routes, info)
+	}
+
+	if len(info.Methods) == 0 {
+		return &route{handler: handler, info: info}
+	}
+	methods := info.Methods
+	if check := info.Precheck; check != nil {
+		// A method the route doesn't take is answered 405 by restricted,
+		// not with whatever the precheck would say
+		info.Precheck = func(req *Request) *Response {
+			if !slices.Contains(methods, req.Method) {
+				return nil
+			}
+			return check(req)
+		}
+	}
+	restricted := func(req *Request) *Response {
+		if !slices.Contains(methods, req.Method) {
+			// Looked up per request, the handler may be set after the route
+			var resp *Response
+			if r.methodNotAllowed != nil {
+				resp = r.methodNotAllowed(req)
+			} else {
+				resp = NewResponse(http.StatusMethodNotAllowed, "Method Not Allowed", nil)
+			}
+			resp.SetHeader("Allow", strings.Join(methods, ", "))
+			return resp
+		}
+		return handler(req)
+	}
+	return &route{handler: restricted, info: info}
+}
 
-	// Sort by length (longest first) for proper matching priority
-	// This ensures /api/v2/users matches before /api/v2
-	sort.Slice(r.prefixRoutes, func(i, j int) bool {
-		return len(r.prefixRoutes[i].prefix) > len(r.prefixRoutes[j].prefix)
+func (r *Router) RegisterExactRoute(path string, handler HandleFunc, opts ...RouteOption) {
+	segments := splitPath(path)
+	last := len(segments) - 1
+	for _, segment := range segments[:last] {
+		if strings.HasPrefix(segment, "*") {
+			panic("router: wildcard must be the last segment in " + path)
+		}
+	}
+	if name, ok := strings.CutPrefix(segments[last], "*"); ok {
+		if name == "" {
+			name = "*"
+		}
+		n := r.insert(segments[:last])
+		n.wildcard = r.addRoute(RouteWildcard, path, handler, opts)
+		n.wildcardName = name
+		return
+	}
+	kind := RouteExact
+	if strings.Contains(path, "/:") {
+		kind = RouteParam
+	}
+	r.insert(segments).handler = r.addRoute(kind, path, handler, opts)
+}
+
+// RegisterRedirect permanently redirects requests for the exact path from to to.
+func (r *Router) RegisterRedirect(from, to string) {
+	r.RegisterExactRoute(from, func(req *Request) *Response {
+		return NewRedirect(http.StatusMovedPermanently, to)
 	})
 }
 
-func (r *Router) Match(path string) HandleFunc {
+// RegisterPrefixRoute matches every path below prefix.
+// Prefixes are matched on whole segments: "/api/" matches "/api/" and "/api/users",
+// "/api" additionally matches "/api" itself, but neither matches "/apiv2".
+func (r *Router) RegisterPrefixRoute(prefix string, handler HandleFunc, opts ...RouteOption) {
+	trimmed, hasSlash := strings.CutSuffix(prefix, "/")
+	n := r.root
+	if trimmed != "" {
+		n = r.insert(splitPath(trimmed))
+	}
+	n.prefixHandler = r.addRoute(RoutePrefix, prefix, handler, opts)
+	n.prefixSelf = !hasSlash
+}
+
+// Match returns the handler for path wrapped in the middlewares, the params it
+// captured and the matched route's registration. Not-found and redirect
+// handlers come with a zero RouteInfo.
+func (r *Router) Match(path string) (HandleFunc, map[string]string, RouteInfo) {
+	handler, params, info := r.match(path)
+	return chain(handler, r.middlewares), params, info
+}
+
+func (r *Router) match(path string) (HandleFunc, map[string]string, RouteInfo) {
 	/*
 	   Matching strategy:
-	   1. Try exact match first (fastest - O(1) map lookup)
-	   2. Try prefix routes in order (longest to shortest)
-	   3. Return 404 handler if no match
-
-	   Why longest-first?
-	     Given routes: /api/users and /api
-	     Request: /api/users/123
-	     Should match: /api/users (more specific)
-	     Not: /api (less specific)
-
-	   Time complexity:
-	     Exact match: O(1)
-	     Prefix match: O(n) where n = number of prefix routes
-	     Can be optimized to O(log n) with trie data structure
+	   1. Walk the trie segment by segment (O(path length))
+	   2. Prefer static segments, then params, then the wildcard
+	   3. A deeper match always wins over a shallower prefix route,
+	      which keeps the old "longest prefix wins" behaviour:
+	        Given routes: /api/users/ and /api/
+	        Request: /api/users/123
+	        Should match: /api/users/ (more specific)
+	        Not: /api/ (less specific)
+	   4. Return 404 handler if no match
 	*/
-	if handler, ok := r.exactRoutes[path]; ok {
-		return handler
+	params := make(map[string]string)
+	if rt := r.root.match(splitPath(path), params, r.CaseInsensitivePaths); rt != nil {
+		return rt.handler, params, rt.info
 	}
 
-	// Match the longest prefix route
-	for _, route := range r.prefixRoutes {
-		if strings.HasPrefix(path, route.prefix) {
-			return route.handler
+	if r.RedirectTrailingSlash {
+		if target, ok := r.trailingSlashTarget(path); ok {
+			return func(req *Request) *Response {
+				if req.RawQuery != "" {
+					target += "?" + req.RawQuery
+				}
+				// 308 (unlike 301) guarantees the client repeats the same method and body
+				return NewRedirect(http.StatusPermanentRedirect, target)
+			}, nil, RouteInfo{}
 		}
 	}
-	return handleNotFound
+	if r.notFound != nil {
+		return r.notFound, nil, RouteInfo{}
+	}
+	return handleNotFound, nil, RouteInfo{}
+}
+
+// trailingSlashTarget returns path with its trailing slash added or removed,
+// if that form matches a registered route.
+func (r *Router) trailingSlashTarget(path string) (string, bool) {
+	if path == "/" {
+		return "", false
+	}
+
+	target := path + "/"
+	if trimmed, ok := strings.CutSuffix(path, "/"); ok {
+		target = trimmed
+	}
+
+	if r.root.match(splitPath(target), make(map[string]string), r.CaseInsensitivePaths) == nil {
+		return "", false
+	}
+	return target, true
+}
+
+// match resolves segments below n. With fold set, static segments are compared
+// lowercased (they were stored lowercased by insert) while captures keep the original case.
+func (n *node) match(segments []string, params map[string]string, fold bool) *route {
+	if len(segments) == 0 {
+		if n.handler != nil {
+			return n.handler
+		}
+		if n.prefixSelf {
+			return n.prefixHandler
+		}
+		return nil
+	}
+
+	segment, rest := segments[0], segments[1:]
+
+	key := segment
+	if fold {
+		key = strings.ToLower(segment)
+	}
+	if child, ok := n.children[key]; ok {
+		if rt := child.match(rest, params, fold); rt != nil {
+			return rt
+		}
+	}
+
+	// Params never match an empty segment, "/users/" is not "/users/:id"
+	if n.param != nil && segment != "" {
+		params[n.paramName] = segment
+		if rt := n.param.match(rest, params, fold); rt != nil {
+			return rt
+		}
+		delete(params, n.paramName) // Backtrack, this branch did not match
+	}
+
+	if n.wildcard != nil {
+		params[n.wildcardName] = strings.Join(segments, "/")
+		return n.wildcard
+	}
+
+	// Nothing more specific matched below this node
+	return n.prefixHandler
 }
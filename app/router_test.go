@@ -0,0 +1,508 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func requireToken(r *Request) *Response {
+	if _, ok := r.GetHeader("Authorization"); !ok {
+		return NewResponse(http.StatusUnauthorized, "Unauthorized", []byte("no token"))
+	}
+	return nil
+}
+
+func echoBody(r *Request) *Response {
+	return NewResponse(http.StatusOK, "OK", r.Body)
+}
+
+func TestPrecheckRejectsBeforeContinue(t *testing.T) {
+	s, _ := newTestServer(t, testConfig())
+	s.router.RegisterExactRoute("/up", echoBody, WithPrecheck(requireToken))
+	start(t, s)
+
+	conn, r := dial(t, s)
+	io.WriteString(conn, "POST /up HTTP/1.1\r\nHost: localhost\r\nContent-Length: 5\r\nExpect: 100-continue\r\n\r\n")
+	resp, body := readResponse(t, r, http.MethodPost)
+	if resp.StatusCode != http.StatusUnauthorized || body != "no token" {
+		t.Fatalf("got %d %q, want the precheck's 401 instead of 100 Continue", resp.StatusCode, body)
+	}
+	if !resp.Close {
+		t.Error("the unsent body is still announced, the connection must close")
+	}
+
+	// With the token the client is told to go ahead and the handler sees the body
+	conn, r = dial(t, s)
+	io.WriteString(conn, "POST /up HTTP/1.1\r\nHost: localhost\r\nAuthorization: t\r\nContent-Length: 5\r\nExpect: 100-continue\r\n\r\n")
+	line, _ := r.ReadString('\n')
+	if line != "HTTP/1.1 100 Continue\r\n" {
+		t.Fatalf("got %q, want 100 Continue", line)
+	}
+	r.ReadString('\n')
+	io.WriteString(conn, "hello")
+	if resp, body := readResponse(t, r, http.MethodPost); resp.StatusCode != http.StatusOK || body != "hello" {
+		t.Errorf("after 100 Continue: got %d %q", resp.StatusCode, body)
+	}
+}
+
+func TestPrecheckSeesConnectionDetails(t *testing.T) {
+	s, _ := newTestServer(t, testConfig())
+	var remoteAddr string
+	var hasCtx bool
+	s.router.RegisterExactRoute("/up", echoBody, WithPrecheck(func(r *Request) *Response {
+		remoteAddr, hasCtx = r.RemoteAddr, r.ctx != nil
+		return nil
+	}))
+	start(t, s)
+
+	get(t, s, http.MethodGet, "/up")
+	if !strings.HasPrefix(remoteAddr, "127.0.0.1:") {
+		t.Errorf("precheck RemoteAddr: got %q, want the client's address", remoteAddr)
+	}
+	if !hasCtx {
+		t.Error("precheck ran without the request context")
+	}
+}
+
+func TestPrecheckAfterMethodCheck(t *testing.T) {
+	s, _ := newTestServer(t, testConfig())
+	s.router.RegisterExactRoute("/up", echoBody, WithMethods(http.MethodGet), WithPrecheck(requireToken))
+	start(t, s)
+
+	resp, _ := roundTrip(t, s, "POST /up HTTP/1.1\r\nHost: localhost\r\nContent-Length: 2\r\n\r\nhi")
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("POST to a GET-only route: got %d, want 405", resp.StatusCode)
+	}
+	if resp, _ := get(t, s, http.MethodGet, "/up"); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("GET without token: got %d, want 401", resp.StatusCode)
+	}
+}
+
+func TestExpectContinueOverLimit(t *testing.T) {
+	s, _ := startTestServer(t, testConfig())
+
+	conn, r := dial(t, s)
+	io.WriteString(conn, "POST /echo/x HTTP/1.1\r\nHost: localhost\r\nContent-Length: 99999999999\r\nExpect: 100-continue\r\n\r\n")
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	resp, _ := readResponse(t, r, http.MethodPost)
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("got %d, want 413 without waiting for the body", resp.StatusCode)
+	}
+	if !resp.Close {
+		t.Error("the body was never sent, the connection must close")
+	}
+}
+
+func TestPrecheckBodyLimit(t *testing.T) {
+	s, _ := newTestServer(t, testConfig())
+	var bodyRead bool
+	// A route taking far less than the server-wide 10 MB
+	s.router.RegisterExactRoute("/avatar", func(r *Request) *Response {
+		bodyRead = true
+		return echoBody(r)
+	}, WithPrecheck(func(r *Request) *Response {
+		if length, _ := r.GetHeader("Content-Length"); len(length) > 3 {
+			return NewResponse(http.StatusRequestEntityTooLarge, "Content Too Large", []byte("at most 999 bytes"))
+		}
+		return nil
+	}))
+	start(t, s)
+
+	conn, r := dial(t, s)
+	io.WriteString(conn, "POST /avatar HTTP/1.1\r\nHost: localhost\r\nContent-Length: 50000\r\nExpect: 100-continue\r\n\r\n")
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	resp, body := readResponse(t, r, http.MethodPost)
+	if resp.StatusCode != http.StatusRequestEntityTooLarge || body != "at most 999 bytes" {
+		t.Errorf("got %d %q, want the precheck's 413 instead of 100 Continue", resp.StatusCode, body)
+	}
+	if bodyRead {
+		t.Error("the handler ran for a rejected request")
+	}
+}
+
+func TestRegisterRedirect(t *testing.T) {
+	s, _ := newTestServer(t, testConfig())
+	s.router.RegisterRedirect("/old", "/echo/new")
+	start(t, s)
+
+	resp, _ := get(t, s, http.MethodGet, "/old")
+	if resp.StatusCode != http.StatusMovedPermanently {
+		t.Errorf("status: got %d, want 301", resp.StatusCode)
+	}
+	if got := resp.Header.Get("Location"); got != "/echo/new" {
+		t.Errorf("Location: got %q", got)
+	}
+}
+
+// named answers with its name, telling the tests which route matched
+func named(name string) HandleFunc {
+	return func(r *Request) *Response {
+		return NewResponse(http.StatusOK, "OK", []byte(name))
+	}
+}
+
+// matched runs the handler Match picks for path and returns its body, or
+// "404" when nothing matched
+func matched(router *Router, path string) (string, map[string]string) {
+	handler, params, _ := router.Match(path)
+	resp := handler(newTestRequest(http.MethodGet, path, nil, ""))
+	if resp.StatusCode == http.StatusNotFound {
+		return "404", params
+	}
+	return string(resp.Body), params
+}
+
+func TestRouterTrie(t *testing.T) {
+	router := NewRouter()
+	router.RegisterExactRoute("/", named("root"))
+	router.RegisterExactRoute("/users/me", named("me"))
+	router.RegisterExactRoute("/users/:id", named("user"))
+	router.RegisterExactRoute("/users/:id/posts/:post", named("post"))
+	router.RegisterExactRoute("/static/*filepath", named("static"))
+	router.RegisterPrefixRoute("/api/", named("api"))
+	router.RegisterPrefixRoute("/api/users/", named("api users"))
+	router.RegisterPrefixRoute("/docs", named("docs"))
+
+	for _, tc := range []struct {
+		path, want string
+		params     map[string]string
+	}{
+		{"/", "root", nil},
+		{"/users/me", "me", nil}, // static beats the param
+		{"/users/42", "user", map[string]string{"id": "42"}},
+		{"/users/42/posts/7", "post", map[string]string{"id": "42", "post": "7"}},
+		{"/static/css/site.css", "static", map[string]string{"filepath": "css/site.css"}},
+		{"/api/", "api", nil},
+		{"/api/v1/things", "api", nil},
+		{"/api/users/123", "api users", nil}, // the longest prefix wins
+		{"/docs", "docs", nil},
+		{"/docs/intro", "docs", nil},
+		{"/docsearch", "404", nil}, // prefixes match whole segments
+		{"/users/", "404", nil},    // a param never matches an empty segment
+		{"/users/42/posts", "404", nil},
+		{"/nothing", "404", nil},
+	} {
+		got, params := matched(router, tc.path)
+		if got != tc.want {
+			t.Errorf("%s: matched %q, want %q", tc.path, got, tc.want)
+			continue
+		}
+		for name, value := range tc.params {
+			if params[name] != value {
+				t.Errorf("%s: param %s = %q, want %q", tc.path, name, params[name], value)
+			}
+		}
+	}
+}
+
+func TestRouterWildcardNotLast(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("a wildcard before the last segment was accepted")
+		}
+	}()
+	NewRouter().RegisterExactRoute("/a/*rest/b", named("bad"))
+}
+
+// sliceRouter is the linear scan the trie replaced, kept as the benchmark baseline
+type sliceRouter struct {
+	exactRoutes  map[string]HandleFunc
+	prefixRoutes []sliceRoute
+}
+
+type sliceRoute struct {
+	prefix  string
+	handler HandleFunc
+}
+
+func (r *sliceRouter) RegisterPrefixRoute(prefix string, handler HandleFunc) {
+	r.prefixRoutes = append(r.prefixRoutes, sliceRoute{prefix: prefix, handler: handler})
+	sort.Slice(r.prefixRoutes, func(i, j int) bool {
+		return len(r.prefixRoutes[i].prefix) > len(r.prefixRoutes[j].prefix)
+	})
+}
+
+func (r *sliceRouter) Match(path string) HandleFunc {
+	if handler, ok := r.exactRoutes[path]; ok {
+		return handler
+	}
+	for _, route := range r.prefixRoutes {
+		if strings.HasPrefix(path, route.prefix) {
+			return route.handler
+		}
+	}
+	return handleNotFound
+}
+
+const benchRoutes = 1000
+
+// The request for the last registered prefix is the slice scan's worst case
+var benchPath = fmt.Sprintf("/r%d/items/42", benchRoutes-1)
+
+func BenchmarkRouterTrie(b *testing.B) {
+	router := NewRouter()
+	for i := range benchRoutes {
+		router.RegisterPrefixRoute(fmt.Sprintf("/r%d/", i), okHandler)
+	}
+	for b.Loop() {
+		router.Match(benchPath)
+	}
+}
+
+func BenchmarkRouterSliceScan(b *testing.B) {
+	router := &sliceRouter{exactRoutes: make(map[string]HandleFunc)}
+	for i := range benchRoutes {
+		router.RegisterPrefixRoute(fmt.Sprintf("/r%d/", i), okHandler)
+	}
+	for b.Loop() {
+		router.Match(benchPath)
+	}
+}
+
+func TestRedirectTrailingSlash(t *testing.T) {
+	config := testConfig()
+	config.RedirectTrailingSlash = true
+	s, _ := startTestServer(t, config)
+
+	for _, tc := range []struct{ target, location string }{
+		{"/echo", "/echo/"},                             // adds the slash the prefix route was registered with
+		{"/user-agent/", "/user-agent"},                 // strips it for an exact route
+		{"/user-agent/?a=1&b=2", "/user-agent?a=1&b=2"}, // the query survives
+	} {
+		resp, _ := get(t, s, http.MethodGet, tc.target)
+		if resp.StatusCode != http.StatusPermanentRedirect {
+			t.Errorf("%s: got %d, want 308", tc.target, resp.StatusCode)
+		}
+		if got := resp.Header.Get("Location"); got != tc.location {
+			t.Errorf("%s: Location %q, want %q", tc.target, got, tc.location)
+		}
+	}
+	if resp, _ := get(t, s, http.MethodGet, "/nowhere/"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("neither form registered: got %d, want 404", resp.StatusCode)
+	}
+}
+
+func TestRedirectTrailingSlashDisabled(t *testing.T) {
+	s, _ := startTestServer(t, testConfig())
+	for _, target := range []string{"/echo", "/user-agent/"} {
+		if resp, _ := get(t, s, http.MethodGet, target); resp.StatusCode != http.StatusNotFound {
+			t.Errorf("%s by default: got %d, want 404", target, resp.StatusCode)
+		}
+	}
+}
+
+func TestCaseInsensitivePaths(t *testing.T) {
+	config := testConfig()
+	config.CaseInsensitivePaths = true
+	s, _ := startTestServer(t, config)
+
+	if resp, body := get(t, s, http.MethodGet, "/ECHO/Hi"); resp.StatusCode != http.StatusOK || body != "Hi" {
+		t.Errorf("GET /ECHO/Hi: got %d %q, want the remainder echoed in its own case", resp.StatusCode, body)
+	}
+	if resp, body := get(t, s, http.MethodGet, "/User-Agent", "User-Agent: probe"); resp.StatusCode != http.StatusOK || body != "probe" {
+		t.Errorf("GET /User-Agent: got %d %q", resp.StatusCode, body)
+	}
+
+	// Captured params keep their case too
+	router := NewRouter()
+	router.CaseInsensitivePaths = true
+	router.RegisterExactRoute("/Users/:id", named("user"))
+	if got, params := matched(router, "/uSeRs/AbC"); got != "user" || params["id"] != "AbC" {
+		t.Errorf("/uSeRs/AbC: matched %q with id %q", got, params["id"])
+	}
+}
+
+func TestCaseSensitivePathsByDefault(t *testing.T) {
+	s, _ := startTestServer(t, testConfig())
+	if resp, _ := get(t, s, http.MethodGet, "/ECHO/Hi"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("GET /ECHO/Hi by default: got %d, want 404", resp.StatusCode)
+	}
+}
+
+func TestRoutes(t *testing.T) {
+	register := []func(*Router){
+		func(r *Router) { r.RegisterExactRoute("/users/:id", named("user"), WithMethods(http.MethodGet)) },
+		func(r *Router) { r.RegisterPrefixRoute("/echo/", named("echo")) },
+		func(r *Router) { r.RegisterExactRoute("/static/*filepath", named("static")) },
+		func(r *Router) {
+			r.RegisterExactRoute("/", named("root"), WithMethods(http.MethodGet, http.MethodHead))
+		},
+		func(r *Router) { r.RegisterExactRoute("/echo", named("echo exact")) },
+	}
+	want := []RouteInfo{
+		{Kind: RouteExact, Pattern: "/", Methods: []string{http.MethodGet, http.MethodHead}},
+		{Kind: RouteExact, Pattern: "/echo"},
+		{Kind: RoutePrefix, Pattern: "/echo/"},
+		{Kind: RouteWildcard, Pattern: "/static/*filepath"},
+		{Kind: RouteParam, Pattern: "/users/:id", Methods: []string{http.MethodGet}},
+	}
+
+	forward, backward := NewRouter(), NewRouter()
+	for i := range register {
+		register[i](forward)
+		register[len(register)-1-i](backward)
+	}
+	// Re-registering replaces the entry instead of adding one
+	forward.RegisterPrefixRoute("/echo/", named("echo again"))
+
+	for name, router := range map[string]*Router{"forward": forward, "backward": backward} {
+		got := router.Routes()
+		if len(got) != len(want) {
+			t.Errorf("%s: got %d routes, want %d: %+v", name, len(got), len(want), got)
+			continue
+		}
+		for i := range want {
+			if got[i].Kind != want[i].Kind || got[i].Pattern != want[i].Pattern || !slices.Equal(got[i].Methods, want[i].Methods) {
+				t.Errorf("%s: route %d: got %+v, want %+v", name, i, got[i], want[i])
+			}
+		}
+	}
+}
+
+// tail answers with the captured "filepath"
+func tail(r *Request) *Response {
+	return NewResponse(http.StatusOK, "OK", []byte("tail="+r.Param("filepath")))
+}
+
+func TestWildcardRoute(t *testing.T) {
+	s, _ := newTestServer(t, testConfig())
+	s.router.RegisterExactRoute("/app/*filepath", tail)
+	s.router.RegisterExactRoute("/app/login", named("login"))
+	s.router.RegisterExactRoute("/app/users/:id", func(r *Request) *Response {
+		return NewResponse(http.StatusOK, "OK", []byte("user="+r.Param("id")))
+	})
+	start(t, s)
+
+	for _, tc := range []struct{ target, want string }{
+		{"/app/dashboard", "tail=dashboard"},
+		{"/app/a/b/c.js", "tail=a/b/c.js"}, // the whole remainder, slashes included
+		{"/app/", "tail="},
+		{"/app/login", "login"},                    // a specific route wins
+		{"/app/users/7", "user=7"},                 // so does a param route
+		{"/app/users/7/edit", "tail=users/7/edit"}, // and the wildcard picks up what it doesn't match
+		{"/app/login/extra", "tail=login/extra"},
+	} {
+		if resp, body := get(t, s, http.MethodGet, tc.target); resp.StatusCode != http.StatusOK || body != tc.want {
+			t.Errorf("%s: got %d %q, want %q", tc.target, resp.StatusCode, body, tc.want)
+		}
+	}
+	if resp, _ := get(t, s, http.MethodGet, "/application"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("/application: got %d, want 404, the wildcard is under /app/ only", resp.StatusCode)
+	}
+}
+
+func TestCustomNotFound(t *testing.T) {
+	s, _ := newTestServer(t, testConfig())
+	s.router.Use(func(next HandleFunc) HandleFunc {
+		return func(r *Request) *Response {
+			resp := next(r)
+			resp.SetHeader("X-Wrapped", "yes")
+			return resp
+		}
+	})
+	s.router.SetNotFoundHandler(func(r *Request) *Response {
+		return NewResponse(http.StatusNotFound, "Not Found", []byte("no page at "+r.Path))
+	})
+	s.router.SetMethodNotAllowedHandler(func(r *Request) *Response {
+		return NewResponse(http.StatusMethodNotAllowed, "Method Not Allowed", []byte("try another method"))
+	})
+	start(t, s)
+
+	resp, body := get(t, s, http.MethodGet, "/missing")
+	if resp.StatusCode != http.StatusNotFound || body != "no page at /missing" {
+		t.Errorf("unmatched path: got %d %q", resp.StatusCode, body)
+	}
+	if resp.Header.Get("X-Wrapped") != "yes" {
+		t.Error("the custom 404 skipped the middlewares")
+	}
+
+	resp, body = roundTrip(t, s, "DELETE /user-agent HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	if resp.StatusCode != http.StatusMethodNotAllowed || body != "try another method" {
+		t.Errorf("DELETE /user-agent: got %d %q", resp.StatusCode, body)
+	}
+	if resp.Header.Get("Allow") == "" {
+		t.Error("the custom 405 lost the Allow header")
+	}
+}
+
+func TestRouteTimeouts(t *testing.T) {
+	config := testConfig()
+	config.ReadTimeout, config.WriteTimeout = 100*time.Millisecond, 100*time.Millisecond
+	config.LogLevel = LevelError
+	s, _ := newTestServer(t, config)
+	slow := func(r *Request) *Response {
+		time.Sleep(300 * time.Millisecond)
+		return NewResponse(http.StatusOK, "OK", []byte("done"))
+	}
+	s.router.RegisterExactRoute("/upload", echoBody, WithTimeouts(2*time.Second, 2*time.Second))
+	s.router.RegisterExactRoute("/upload-default", echoBody)
+	s.router.RegisterExactRoute("/report", slow, WithTimeouts(0, 2*time.Second))
+	s.router.RegisterExactRoute("/report-default", slow)
+	start(t, s)
+
+	// slowUpload sends the headers and, 300ms later, the body
+	slowUpload := func(target string) (string, error) {
+		conn, r := dial(t, s)
+		io.WriteString(conn, "POST "+target+" HTTP/1.1\r\nHost: localhost\r\nContent-Length: 4\r\n\r\n")
+		time.Sleep(300 * time.Millisecond)
+		io.WriteString(conn, "body")
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		resp, err := http.ReadResponse(r, nil)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		return string(body), err
+	}
+	if body, err := slowUpload("/upload"); err != nil || body != "body" {
+		t.Errorf("slow upload with a long read timeout: got %q, %v", body, err)
+	}
+	if body, err := slowUpload("/upload-default"); err == nil && body == "body" {
+		t.Error("slow upload outlived the 100ms ReadTimeout")
+	}
+
+	if resp, body := get(t, s, http.MethodGet, "/report"); resp.StatusCode != http.StatusOK || body != "done" {
+		t.Errorf("slow handler with a long write timeout: got %d %q", resp.StatusCode, body)
+	}
+	conn, r := dial(t, s)
+	io.WriteString(conn, "GET /report-default HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := http.ReadResponse(r, nil); err == nil {
+		t.Error("slow handler answered past the 100ms WriteTimeout")
+	}
+}
+
+func TestMaxPathSegments(t *testing.T) {
+	deep := func(n int) string { return "/echo" + strings.Repeat("/a", n-1) }
+
+	s, _ := startTestServer(t, testConfig())
+	if resp, _ := get(t, s, http.MethodGet, deep(defaultMaxPathSegments)); resp.StatusCode != http.StatusOK {
+		t.Errorf("%d segments: got %d, want 200", defaultMaxPathSegments, resp.StatusCode)
+	}
+	if resp, _ := get(t, s, http.MethodGet, deep(defaultMaxPathSegments+1)); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("%d segments: got %d, want 400", defaultMaxPathSegments+1, resp.StatusCode)
+	}
+
+	config := testConfig()
+	config.MaxPathSegments = 3
+	s, _ = startTestServer(t, config)
+	for target, want := range map[string]int{
+		"/echo/a/b":       http.StatusOK,
+		"/echo/a/b/c":     http.StatusBadRequest,
+		"/files/../../..": http.StatusBadRequest, // counted before any cleaning
+	} {
+		if resp, _ := get(t, s, http.MethodGet, target); resp.StatusCode != want {
+			t.Errorf("%s with MaxPathSegments 3: got %d, want %d", target, resp.StatusCode, want)
+		}
+	}
+	if err := (Config{MaxPathSegments: -1}).validate(); err == nil {
+		t.Error("negative MaxPathSegments accepted")
+	}
+}
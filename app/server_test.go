@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testConfig is the Config tests start from: short timeouts, Config's zero values otherwise
+func testConfig() Config {
+	return Config{ReadTimeout: 2 * time.Second, WriteTimeout: 2 * time.Second}
+}
+
+// logBuffer collects a test server's log output, safe for the connection goroutines
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *logBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// newTestServer creates a server on 127.0.0.1:0 without starting it, so
+// routes can still be registered
+func newTestServer(t testing.TB, config Config) (*Server, *logBuffer) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() }) // for servers that are never started, Shutdown closes it otherwise
+	logs := &logBuffer{}
+	s, err := NewServerWithListener(config, log.New(logs, "", 0), l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, logs
+}
+
+// start serves until the test ends
+func start(t testing.TB, s *Server) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		s.Start(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		s.Shutdown()
+		<-done
+	})
+}
+
+// startTestServer is newTestServer and start in one
+func startTestServer(t testing.TB, config Config) (*Server, *logBuffer) {
+	t.Helper()
+	s, logs := newTestServer(t, config)
+	start(t, s)
+	return s, logs
+}
+
+// dial opens a connection to s, closed when the test ends
+func dial(t testing.TB, s *Server) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	conn, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	t.Cleanup(func() { conn.Close() })
+	return conn, bufio.NewReader(conn)
+}
+
+// readResponse reads the next response off the connection. method is the
+// request's, a HEAD response has no body despite its Content-Length.
+func readResponse(t testing.TB, r *bufio.Reader, method string) (*http.Response, string) {
+	t.Helper()
+	resp, err := http.ReadResponse(r, &http.Request{Method: method})
+	if err != nil {
+		t.Fatalf("reading response: %v", err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("reading response body: %v", err)
+	}
+	return resp, string(body)
+}
+
+// roundTrip sends raw on a new connection and reads one response
+func roundTrip(t testing.TB, s *Server, raw string) (*http.Response, string) {
+	t.Helper()
+	conn, r := dial(t, s)
+	if _, err := io.WriteString(conn, raw); err != nil {
+		t.Fatal(err)
+	}
+	method, _, _ := strings.Cut(raw, " ")
+	return readResponse(t, r, method)
+}
+
+// rawResponse sends raw on a new connection and returns everything the
+// server writes until it closes the connection
+func rawResponse(t testing.TB, s *Server, raw string) string {
+	t.Helper()
+	conn, r := dial(t, s)
+	if _, err := io.WriteString(conn, raw); err != nil {
+		t.Fatal(err)
+	}
+	out, _ := io.ReadAll(r)
+	return string(out)
+}
+
+// get sends a bodyless request for target with the given extra header lines
+func get(t testing.TB, s *Server, method, target string, headers ...string) (*http.Response, string) {
+	t.Helper()
+	raw := method + " " + target + " HTTP/1.1\r\nHost: localhost\r\n"
+	for _, h := range headers {
+		raw += h + "\r\n"
+	}
+	return roundTrip(t, s, raw+"\r\n")
+}
+
+// sendBody sends a request with body for target and the given extra header lines
+func sendBody(t testing.TB, s *Server, method, target string, body []byte, headers ...string) (*http.Response, string) {
+	t.Helper()
+	raw := method + " " + target + " HTTP/1.1\r\nHost: localhost\r\nContent-Length: " + strconv.Itoa(len(body)) + "\r\n"
+	for _, h := range headers {
+		raw += h + "\r\n"
+	}
+	return roundTrip(t, s, raw+"\r\n"+string(body))
+}
+
+// newTestRequest builds a parsed request for calling handlers directly
+func newTestRequest(method, target string, headers map[string]string, body string) *Request {
+	path, rawQuery, _ := strings.Cut(target, "?")
+	req := &Request{
+		Method:     method,
+		Path:       path,
+		RawQuery:   rawQuery,
+		Version:    "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Headers:    make(map[string]string),
+	}
+	for name, value := range headers {
+		req.Headers[strings.ToLower(name)] = value
+	}
+	if body != "" {
+		req.Body = []byte(body)
+	}
+	return req
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// EventStream writes Server-Sent Events to a client
+type EventStream struct {
+	w   io.Writer
+	ctx context.Context
+}
+
+/*
+   Server-Sent Events (text/event-stream):
+
+     HTTP/1.1 200 OK
+     Content-Type: text/event-stream
+     Cache-Control: no-cache
+     Transfer-Encoding: chunked
+
+     event: tick          ← optional event name
+     data: first line     ← one "data:" line per line of payload
+     data: second line
+                          ← blank line dispatches the event in the browser
+
+   The body never "ends" until the handler returns, so it is sent as a
+   chunked stream and flushed after every event to reach the client now.
+*/
+
+// NewEventStream returns a streaming response that runs serve until it returns,
+// the client goes away (a Send fails) or the server shuts down (Context is done).
+func NewEventStream(r *Request, serve func(es *EventStream) error) *Response {
+	resp := NewStreamResponse(http.StatusOK, "OK", func(w io.Writer) error {
+		return serve(&EventStream{w: w, ctx: r.Context()})
+	})
+	resp.SetHeader("Content-Type", "text/event-stream")
+	resp.SetHeader("Cache-Control", "no-cache")
+	return resp
+}
+
+// Context is cancelled when the server shuts down; serve functions should select on it.
+func (es *EventStream) Context() context.Context {
+	return es.ctx
+}
+
+// Send writes one event and flushes it to the client. event may be empty,
+// but not contain CR or LF. Every line of data gets its own "data:" field,
+// CRs in it are dropped.
+func (es *EventStream) Send(event, data string) error {
+	// A line break in either would start fields, or whole events, of the
+	// sender's choosing: "tick\ndata: forged\n\n". CR ends a line as well.
+	if strings.ContainsAny(event, "\r\n") {
+		return fmt.Errorf("invalid event name %q: contains CR or LF", event)
+	}
+	data = strings.ReplaceAll(data, "\r", "")
+
+	var b strings.Builder
+	if event != "" {
+		fmt.Fprintf(&b, "event: %s\n", event)
+	}
+	for line := range strings.SplitSeq(data, "\n") {
+		fmt.Fprintf(&b, "data: %s\n", line)
+	}
+	b.WriteString("\n")
+
+	if _, err := io.WriteString(es.w, b.String()); err != nil {
+		return err
+	}
+	if f, ok := es.w.(Flusher); ok {
+		return f.Flush()
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// flushRecorder is a stream writer that counts flushes
+type flushRecorder struct {
+	bytes.Buffer
+	flushes int
+}
+
+func (f *flushRecorder) Flush() error {
+	f.flushes++
+	return nil
+}
+
+func TestEventStreamSend(t *testing.T) {
+	var w flushRecorder
+	es := &EventStream{w: &w, ctx: context.Background()}
+	if err := es.Send("tick", "first line\nsecond line"); err != nil {
+		t.Fatal(err)
+	}
+	if err := es.Send("", "plain"); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "event: tick\ndata: first line\ndata: second line\n\ndata: plain\n\n"
+	if got := w.String(); got != want {
+		t.Errorf("stream:\ngot  %q\nwant %q", got, want)
+	}
+	if w.flushes != 2 {
+		t.Errorf("flushes: got %d, want one per event", w.flushes)
+	}
+}
+
+func TestEventStreamInjection(t *testing.T) {
+	var w flushRecorder
+	es := &EventStream{w: &w, ctx: context.Background()}
+	for _, event := range []string{"tick\ndata: forged", "tick\r\n\r\nevent: other", "a\rb"} {
+		if err := es.Send(event, "x"); err == nil {
+			t.Errorf("Send accepted event name %q", event)
+		}
+	}
+	if w.Len() != 0 {
+		t.Errorf("rejected events were written: %q", w.String())
+	}
+
+	// CR would end the line in the browser too, "\r\n" must not leave a stray CR behind
+	if err := es.Send("tick", "a\r\nb\rc"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := w.String(), "event: tick\ndata: a\ndata: bc\n\n"; got != want {
+		t.Errorf("stream:\ngot  %q\nwant %q", got, want)
+	}
+}
+
+func TestEventStreamResponse(t *testing.T) {
+	s, _ := newTestServer(t, testConfig())
+	s.router.RegisterExactRoute("/events", func(r *Request) *Response {
+		return NewEventStream(r, func(es *EventStream) error {
+			for _, n := range []string{"1", "2"} {
+				if err := es.Send("count", n); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	})
+	start(t, s)
+
+	resp, body := get(t, s, http.MethodGet, "/events")
+	if got := resp.Header.Get("Content-Type"); got != "text/event-stream" {
+		t.Errorf("Content-Type: got %q", got)
+	}
+	if got := resp.Header.Get("Cache-Control"); got != "no-cache" {
+		t.Errorf("Cache-Control: got %q", got)
+	}
+	if strings.Count(body, "event: count\n") != 2 || !strings.Contains(body, "data: 2\n\n") {
+		t.Errorf("body: got %q", body)
+	}
+}
+
+// ticker sends an event every few milliseconds until Send fails or the server
+// shuts down, then closes stopped
+func ticker(stopped chan<- error) HandleFunc {
+	return func(r *Request) *Response {
+		return NewEventStream(r, func(es *EventStream) error {
+			var err error
+			defer func() { stopped <- err }()
+			for {
+				select {
+				case <-es.Context().Done():
+					return nil
+				case <-time.After(5 * time.Millisecond):
+				}
+				if err = es.Send("tick", "t"); err != nil {
+					return err
+				}
+			}
+		})
+	}
+}
+
+func TestEventStreamClientDisconnect(t *testing.T) {
+	s, _ := newTestServer(t, testConfig())
+	stopped := make(chan error, 1)
+	s.router.RegisterExactRoute("/events", ticker(stopped))
+	start(t, s)
+
+	conn, r := dial(t, s)
+	io.WriteString(conn, "GET /events HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line, _ := bufio.NewReader(resp.Body).ReadString('\n'); line != "event: tick\n" {
+		t.Fatalf("first event: got %q", line)
+	}
+	conn.Close()
+
+	select {
+	case err := <-stopped:
+		if err == nil {
+			t.Error("serve stopped without a Send error")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("serve kept running after the client went away")
+	}
+}
+
+func TestEventStreamServerShutdown(t *testing.T) {
+	s, _ := newTestServer(t, testConfig())
+	stopped := make(chan error, 1)
+	s.router.RegisterExactRoute("/events", ticker(stopped))
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		s.Start(ctx)
+		close(done)
+	}()
+
+	conn, r := dial(t, s)
+	io.WriteString(conn, "GET /events HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := bufio.NewReader(resp.Body)
+	if line, _ := body.ReadString('\n'); line != "event: tick\n" {
+		t.Fatalf("first event: got %q", line)
+	}
+
+	cancel()
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Errorf("serve: %v, want a clean return on shutdown", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("serve kept running after the server context was cancelled")
+	}
+	// The stream ends properly and the HTTP loop doesn't wait for another request
+	if _, err := io.Copy(io.Discard, body); err != nil {
+		t.Errorf("rest of the stream: %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := r.ReadByte(); err != io.EOF {
+		t.Errorf("after the stream: got %v, want the connection closed", err)
+	}
+	s.Shutdown()
+	<-done
+}
@@ -0,0 +1,32 @@
+package main
+
+import "net/http"
+
+// ServerStats is a snapshot of the server's counters, see Server.Stats
+type ServerStats struct {
+	ActiveConnections int64 `json:"active_connections"`
+	TotalConnections  int64 `json:"total_connections"`
+	ShedConnections   int64 `json:"shed_connections"` // answered with 503 by Config.LoadShedFunc
+	TotalRequests     int64 `json:"total_requests"`
+}
+
+// Stats reads the counters. Each one is read atomically, but not all at the
+// same instant, so they may be a request or connection apart.
+func (s *Server) Stats() ServerStats {
+	return ServerStats{
+		ActiveConnections: s.activeConns.Load(),
+		TotalConnections:  s.totalConns.Load(),
+		ShedConnections:   s.shedConns.Load(),
+		TotalRequests:     s.totalRequests.Load(),
+	}
+}
+
+// handleStats serves Stats as JSON, registered at /stats by Config.EnableStats
+func (s *Server) handleStats(r *Request) *Response {
+	resp, err := NewJSONResponse(http.StatusOK, s.Stats())
+	if err != nil {
+		return NewResponse(http.StatusInternalServerError, "Internal Server Error", []byte(err.Error()))
+	}
+	resp.SetHeader("Cache-Control", "no-store")
+	return resp
+}
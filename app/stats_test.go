@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// waitForActive polls until the server counts want active connections,
+// the count drops on the connection's goroutine after the client closed
+func waitForActive(t *testing.T, s *Server, want int64) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for s.Stats().ActiveConnections != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("active connections: got %d, want %d", s.Stats().ActiveConnections, want)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestStatsActiveConnections(t *testing.T) {
+	s, _ := startTestServer(t, testConfig())
+
+	conn, r := dial(t, s)
+	for range 2 {
+		io.WriteString(conn, "GET /echo/hi HTTP/1.1\r\nHost: localhost\r\n\r\n")
+		readResponse(t, r, http.MethodGet)
+	}
+	waitForActive(t, s, 1)
+
+	conn.Close()
+	waitForActive(t, s, 0)
+	if stats := s.Stats(); stats.TotalConnections != 1 || stats.TotalRequests != 2 {
+		t.Errorf("totals: got %+v, want 1 connection with 2 requests", stats)
+	}
+}
+
+func TestStatsEndpoint(t *testing.T) {
+	config := testConfig()
+	config.EnableStats = true
+	s, _ := startTestServer(t, config)
+	get(t, s, http.MethodGet, "/echo/hi")
+
+	resp, body := get(t, s, http.MethodGet, "/stats")
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/json" {
+		t.Fatalf("got %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	var stats ServerStats
+	if err := json.Unmarshal([]byte(body), &stats); err != nil {
+		t.Fatal(err)
+	}
+	// get dials a connection per request, and /stats counts its own before it is handled
+	if stats.ActiveConnections < 1 || stats.TotalConnections != 2 || stats.TotalRequests != 2 {
+		t.Errorf("got %+v", stats)
+	}
+}
+
+func TestStatsEndpointDisabled(t *testing.T) {
+	s, _ := startTestServer(t, testConfig())
+	if resp, _ := get(t, s, http.MethodGet, "/stats"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("/stats by default: got %d, want 404", resp.StatusCode)
+	}
+}
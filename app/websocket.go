@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// GUID every server appends to Sec-WebSocket-Key (RFC 6455 §1.3)
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// WebSocket opcodes (RFC 6455 §5.2)
+const (
+	OpContinuation byte = 0x0
+	OpText         byte = 0x1
+	OpBinary       byte = 0x2
+	OpClose        byte = 0x8
+	OpPing         byte = 0x9
+	OpPong         byte = 0xA
+)
+
+// WebSocketConn is a connection that finished the WebSocket handshake
+type WebSocketConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// NewWebSocketHandler returns a HandleFunc that upgrades the request to a
+// WebSocket and then runs serve on the connection. The HTTP loop hands the
+// raw connection over and closes it once serve returns.
+func NewWebSocketHandler(serve func(ws *WebSocketConn)) HandleFunc {
+	return func(r *Request) *Response {
+		/*
+		   Opening handshake:
+
+		     GET /chat HTTP/1.1
+		     Upgrade: websocket
+		     Connection: Upgrade
+		     Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==
+		     Sec-WebSocket-Version: 13
+
+		     HTTP/1.1 101 Switching Protocols
+		     Upgrade: websocket
+		     Connection: Upgrade
+		     Sec-WebSocket-Accept: s3pPLMBiTxaQ9kYGzzhZRbK+xOo=
+
+		   Accept = base64(sha1(Key + GUID)), it proves the server speaks WebSocket
+		   and is not some HTTP server replaying a cached response.
+		*/
+		if r.Method != http.MethodGet {
+			return NewResponse(http.StatusMethodNotAllowed, "Method Not Allowed", nil)
+		}
+		if !r.IsWebSocketUpgrade() {
+			return NewResponse(http.StatusBadRequest, "Bad Request", []byte("WebSocket upgrade required"))
+		}
+		if version, _ := r.GetHeader("Sec-WebSocket-Version"); version != "13" {
+			resp := NewResponse(http.StatusUpgradeRequired, "Upgrade Required", nil)
+			resp.SetHeader("Sec-WebSocket-Version", "13")
+			return resp
+		}
+		key, _ := r.GetHeader("Sec-WebSocket-Key")
+		if decoded, err := base64.StdEncoding.DecodeString(key); err != nil || len(decoded) != 16 {
+			return NewResponse(http.StatusBadRequest, "Bad Request", []byte("invalid Sec-WebSocket-Key"))
+		}
+
+		resp := NewResponse(http.StatusSwitchingProtocols, "Switching Protocols", nil)
+		resp.SetHeader("Upgrade", "websocket")
+		resp.SetHeader("Connection", "Upgrade")
+		resp.SetHeader("Sec-WebSocket-Accept", websocketAccept(key))
+		resp.Hijack = func(conn net.Conn, reader *bufio.Reader) {
+			// WebSocket connections are long-lived, the HTTP timeouts no longer apply
+			conn.SetDeadline(time.Time{})
+			serve(&WebSocketConn{conn: conn, reader: reader})
+		}
+		return resp
+	}
+}
+
+func websocketAccept(key string) string {
+	sum := sha1.Sum([]byte(key + websocketGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// headerHasToken reports whether a comma-separated header like "keep-alive, Upgrade" contains token
+func headerHasToken(header, token string) bool {
+	for part := range strings.SplitSeq(header, ",") {
+		if strings.EqualFold(strings.TrimSpace(part), token) {
+			return true
+		}
+	}
+	return false
+}
+
+// ReadMessage returns the next text or binary message, reassembling fragments.
+// Pings are answered automatically; a close frame is echoed and reported as io.EOF.
+func (ws *WebSocketConn) ReadMessage() (opcode byte, payload []byte, err error) {
+	for {
+		fin, op, data, err := ws.readFrame()
+		if err != nil {
+			return 0, nil, err
+		}
+
+		switch op {
+		case OpPing:
+			if err := ws.WriteMessage(OpPong, data); err != nil {
+				return 0, nil, err
+			}
+			continue
+		case OpPong:
+			continue
+		case OpClose:
+			// Echo the status code back to complete the closing handshake
+			ws.WriteMessage(OpClose, data)
+			return 0, nil, io.EOF
+		case OpContinuation:
+			if opcode == 0 {
+				return 0, nil, errors.New("websocket: continuation frame without a message")
+			}
+		default:
+			if opcode != 0 {
+				return 0, nil, errors.New("websocket: new message inside a fragmented one")
+			}
+			opcode = op
+		}
+
+		payload = append(payload, data...)
+		if len(payload) > maxBodyBytes {
+			return 0, nil, errors.New("websocket: message too large")
+		}
+		if fin {
+			return opcode, payload, nil
+		}
+	}
+}
+
+func (ws *WebSocketConn) readFrame() (fin bool, opcode byte, payload []byte, err error) {
+	/*
+	   Frame layout (RFC 6455 §5.2):
+
+	     byte 0:  FIN(1) RSV(3) OPCODE(4)
+	     byte 1:  MASK(1) LEN(7)     LEN 126 → next 2 bytes, 127 → next 8 bytes
+	     [extended length]
+	     [4-byte masking key]        always present on client → server frames
+	     payload, XOR-ed with the masking key
+	*/
+	var header [2]byte
+	if _, err := io.ReadFull(ws.reader, header[:]); err != nil {
+		return false, 0, nil, err
+	}
+	fin = header[0]&0x80 != 0
+	opcode = header[0] & 0x0F
+	masked := header[1]&0x80 != 0
+	length := uint64(header[1] & 0x7F)
+
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(ws.reader, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(ws.reader, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+
+	if !masked {
+		return false, 0, nil, errors.New("websocket: client frame is not masked")
+	}
+	// Control frames must fit in one frame, so they can be answered in the middle of a message (§5.5)
+	if opcode >= OpClose && (!fin || length > 125) {
+		return false, 0, nil, ws.fail("fragmented or oversized control frame")
+	}
+	if length > maxBodyBytes {
+		return false, 0, nil, fmt.Errorf("websocket: frame too large: %d", length)
+	}
+
+	var mask [4]byte
+	if _, err := io.ReadFull(ws.reader, mask[:]); err != nil {
+		return false, 0, nil, err
+	}
+	payload = make([]byte, length)
+	if _, err := io.ReadFull(ws.reader, payload); err != nil {
+		return false, 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return fin, opcode, payload, nil
+}
+
+// WriteMessage sends payload as a single unfragmented frame.
+// Server frames are never masked.
+func (ws *WebSocketConn) WriteMessage(opcode byte, payload []byte) error {
+	frame := []byte{0x80 | opcode} // FIN set
+	switch n := len(payload); {
+	case n < 126:
+		frame = append(frame, byte(n))
+	case n <= 0xFFFF:
+		frame = append(frame, 126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(n))
+	default:
+		frame = append(frame, 127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(n))
+	}
+	frame = append(frame, payload...)
+
+	_, err := ws.conn.Write(frame)
+	return err
+}
+
+// fail answers a protocol violation with a 1002 close frame (RFC 6455 §7.4.1)
+// and returns the error that ends ReadMessage.
+func (ws *WebSocketConn) fail(reason string) error {
+	ws.WriteMessage(OpClose, binary.BigEndian.AppendUint16(nil, 1002))
+	return errors.New("websocket: " + reason)
+}
+
+// Close sends a normal-closure frame. The HTTP loop closes the socket itself
+// once the serve function returns.
+func (ws *WebSocketConn) Close() error {
+	return ws.WriteMessage(OpClose, binary.BigEndian.AppendUint16(nil, 1000))
+}
+
+// RemoteAddr returns the peer address of the underlying connection
+func (ws *WebSocketConn) RemoteAddr() net.Addr {
+	return ws.conn.RemoteAddr()
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// maskedFrame builds a client frame, which RFC 6455 requires to be masked
+func maskedFrame(fin bool, opcode byte, payload string) []byte {
+	first := opcode
+	if fin {
+		first |= 0x80
+	}
+	frame := []byte{first}
+	if len(payload) < 126 {
+		frame = append(frame, 0x80|byte(len(payload)))
+	} else {
+		frame = binary.BigEndian.AppendUint16(append(frame, 0x80|126), uint16(len(payload)))
+	}
+	mask := [4]byte{0x12, 0x34, 0x56, 0x78}
+	frame = append(frame, mask[:]...)
+	for i := range len(payload) {
+		frame = append(frame, payload[i]^mask[i%4])
+	}
+	return frame
+}
+
+// readServerFrame reads an unmasked frame of up to 125 bytes
+func readServerFrame(t *testing.T, r *bufio.Reader) (byte, string) {
+	t.Helper()
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		t.Fatalf("reading frame: %v", err)
+	}
+	if header[0]&0x80 == 0 || header[1]&0x80 != 0 {
+		t.Fatalf("frame header %x: want FIN set and no mask", header)
+	}
+	payload := make([]byte, header[1])
+	if _, err := io.ReadFull(r, payload); err != nil {
+		t.Fatalf("reading payload: %v", err)
+	}
+	return header[0] & 0x0F, string(payload)
+}
+
+func websocketServer(t *testing.T) *Server {
+	t.Helper()
+	s, _ := newTestServer(t, testConfig())
+	s.router.RegisterExactRoute("/ws", NewWebSocketHandler(func(ws *WebSocketConn) {
+		for {
+			opcode, payload, err := ws.ReadMessage()
+			if err != nil {
+				return
+			}
+			ws.WriteMessage(opcode, payload)
+		}
+	}))
+	start(t, s)
+	return s
+}
+
+// handshake upgrades a new connection to /ws
+func handshake(t *testing.T, s *Server) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	conn, r := dial(t, s)
+	// The example key from RFC 6455 §1.3
+	io.WriteString(conn, "GET /ws HTTP/1.1\r\nHost: localhost\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n")
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("handshake: got %d, want 101", resp.StatusCode)
+	}
+	if got := resp.Header.Get("Sec-WebSocket-Accept"); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("Sec-WebSocket-Accept: got %q", got)
+	}
+	return conn, r
+}
+
+func TestWebSocketEcho(t *testing.T) {
+	s := websocketServer(t)
+	conn, r := handshake(t, s)
+
+	conn.Write(maskedFrame(true, OpText, "hello"))
+	if opcode, payload := readServerFrame(t, r); opcode != OpText || payload != "hello" {
+		t.Errorf("echo: got opcode %d %q", opcode, payload)
+	}
+
+	// A ping in the middle of a fragmented message is answered right away
+	conn.Write(maskedFrame(false, OpText, "hel"))
+	conn.Write(maskedFrame(true, OpPing, "p"))
+	conn.Write(maskedFrame(true, OpContinuation, "lo"))
+	if opcode, payload := readServerFrame(t, r); opcode != OpPong || payload != "p" {
+		t.Errorf("ping: got opcode %d %q, want a pong", opcode, payload)
+	}
+	if opcode, payload := readServerFrame(t, r); opcode != OpText || payload != "hello" {
+		t.Errorf("fragmented echo: got opcode %d %q", opcode, payload)
+	}
+
+	conn.Write(maskedFrame(true, OpClose, "\x03\xe8"))
+	if opcode, payload := readServerFrame(t, r); opcode != OpClose || payload != "\x03\xe8" {
+		t.Errorf("close: got opcode %d %q", opcode, payload)
+	}
+	// The HTTP loop doesn't pick the connection back up
+	if _, err := r.ReadByte(); err != io.EOF {
+		t.Errorf("after close: got %v, want EOF", err)
+	}
+}
+
+func TestWebSocketBadHandshake(t *testing.T) {
+	s := websocketServer(t)
+	upgrade := "Upgrade: websocket\r\nConnection: Upgrade\r\n"
+	for _, tc := range []struct {
+		name, headers string
+		status        int
+	}{
+		{"no upgrade", "Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n", http.StatusBadRequest},
+		{"bad key", upgrade + "Sec-WebSocket-Key: short\r\nSec-WebSocket-Version: 13\r\n", http.StatusBadRequest},
+		{"old version", upgrade + "Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 8\r\n", http.StatusUpgradeRequired},
+	} {
+		resp, _ := roundTrip(t, s, "GET /ws HTTP/1.1\r\nHost: localhost\r\n"+tc.headers+"\r\n")
+		if resp.StatusCode != tc.status {
+			t.Errorf("%s: got %d, want %d", tc.name, resp.StatusCode, tc.status)
+		}
+	}
+}
+
+func TestWebSocketBadControlFrame(t *testing.T) {
+	s := websocketServer(t)
+	for _, tc := range []struct {
+		name  string
+		frame []byte
+	}{
+		{"fragmented ping", maskedFrame(false, OpPing, "p")},
+		{"fragmented pong", maskedFrame(false, OpPong, "p")},
+		{"fragmented close", maskedFrame(false, OpClose, "\x03\xe8")},
+		{"oversized ping", maskedFrame(true, OpPing, strings.Repeat("p", 126))},
+		{"oversized pong", maskedFrame(true, OpPong, strings.Repeat("p", 126))},
+		{"oversized close", maskedFrame(true, OpClose, "\x03\xe8"+strings.Repeat("x", 124))},
+	} {
+		conn, r := handshake(t, s)
+		conn.Write(tc.frame)
+		// 1002 is a protocol error, and the connection ends with it
+		if opcode, payload := readServerFrame(t, r); opcode != OpClose || payload != "\x03\xea" {
+			t.Errorf("%s: got opcode %d %q, want close 1002", tc.name, opcode, payload)
+		}
+		if _, err := r.ReadByte(); err != io.EOF {
+			t.Errorf("%s: after close got %v, want EOF", tc.name, err)
+		}
+		conn.Close()
+	}
+
+	// 125 bytes is still a valid ping
+	conn, r := handshake(t, s)
+	ping := strings.Repeat("p", 125)
+	conn.Write(maskedFrame(true, OpPing, ping))
+	if opcode, payload := readServerFrame(t, r); opcode != OpPong || payload != ping {
+		t.Errorf("125-byte ping: got opcode %d with %d bytes, want a pong", opcode, len(payload))
+	}
+}